@@ -0,0 +1,102 @@
+package bayesian
+
+import (
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "errors"
+  "math"
+  "github.com/skelterjohn/go.matrix"
+)
+
+func dot(vec1, vec2 []float64) (val float64) {
+  for i, v := range vec1 {
+    val += v * vec2[i]
+  }
+  return
+}
+
+// Posterior returns the mean and covariance of the coefficients given the
+// sufficient statistics XᵀWX and XᵀW(Y - offset), under the prior
+// β ~ N(0, I / alpha) and noise variance sigma2:
+//
+//   Σ = (alpha I + XᵀWX / sigma2)⁻¹,  m = Σ XᵀWY / sigma2.
+func Posterior(xtx [][]float64, xty []float64, alpha float64, sigma2 float64) ([]float64, [][]float64, error) {
+  if alpha <= 0.0 || sigma2 <= 0.0 {
+    return nil, nil, errors.New("Prior precision and noise variance must be positive")
+  }
+  p := len(xty)
+  precision := matrix.Eye(p)
+  precision.Scale(alpha)
+  for j := 0; j < p; j++ {
+    for k := 0; k < p; k++ {
+      precision.Set(j, k, precision.Get(j, k) + xtx[j][k] / sigma2)
+    }
+  }
+  covariance, err := precision.Inverse()
+  if err != nil {
+    return nil, nil, err
+  }
+  mean, err := covariance.TimesDense(matrix.MakeDenseMatrix(xty, p, 1))
+  if err != nil {
+    return nil, nil, err
+  }
+  mean.Scale(1.0 / sigma2)
+  return mean.Array(), covariance.Arrays(), nil
+}
+
+// EmpiricalBayes estimates the prior precision and noise variance by
+// maximizing the marginal likelihood with MacKay's fixed point updates,
+// starting from alpha and sigma2, along with the number of iterations run.
+// Once ctx is done it stops with ctx.Err().
+func EmpiricalBayes(ctx context.Context, xtx [][]float64, xty []float64, yty float64, sumWeights float64, alpha float64, sigma2 float64, iterations int) (float64, float64, int, error) {
+  p := float64(len(xty))
+  if sumWeights <= p {
+    return alpha, sigma2, 0, nil
+  }
+  iter := 0
+  for {
+    if ctx.Err() != nil {
+      return 0.0, 0.0, iter, ctx.Err()
+    }
+    iter++
+    mean, covariance, err := Posterior(xtx, xty, alpha, sigma2)
+    if err != nil {
+      return 0.0, 0.0, iter, err
+    }
+    // gamma is the effective number of well-determined coefficients
+    gamma := p
+    for j := range covariance {
+      gamma -= alpha * covariance[j][j]
+    }
+    rss := yty - 2.0 * dot(mean, xty)
+    for j, row := range xtx {
+      rss += mean[j] * dot(row, mean)
+    }
+    newAlpha := alpha
+    if mm := dot(mean, mean); mm > 0.0 && gamma > 0.0 {
+      newAlpha = gamma / mm
+    }
+    newSigma2 := math.Max(rss / (sumWeights - gamma), 1e-10)
+    diff := math.Abs(math.Log(newAlpha / alpha)) + math.Abs(math.Log(newSigma2 / sigma2))
+    alpha, sigma2 = newAlpha, newSigma2
+    if diff < 1e-6 {
+      logging.Debugf(ctx, "Converged after %v iterations", iter)
+      break
+    }
+    if iter >= iterations {
+      logging.Warnf(ctx, "Did not converge after %v iterations", iter)
+      break
+    }
+  }
+  return alpha, sigma2, iter, nil
+}
+
+// Predict returns the mean and variance of the posterior predictive
+// distribution, which is normal with variance sigma2 + xᵀΣx.
+func Predict(mean []float64, covariance [][]float64, covariates []float64, offset float64, sigma2 float64) (float64, float64) {
+  variance := sigma2
+  for j, row := range covariance {
+    variance += covariates[j] * dot(row, covariates)
+  }
+  return dot(mean, covariates) + offset, variance
+}
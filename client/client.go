@@ -0,0 +1,311 @@
+// Package client is a Go client for the cloudml HTTP API.
+package client
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Error is an error response from the server. Code, Details and RequestId
+// are empty if the server did not send them.
+type Error struct {
+  StatusCode int
+  Code string
+  Message string
+  Details json.RawMessage
+  RequestId string
+}
+
+func (e *Error) Error() string {
+  return fmt.Sprintf("cloudml: %v (%v)", e.Message, e.StatusCode)
+}
+
+// IsNotFound reports whether err is a 404 from the server.
+func IsNotFound(err error) bool {
+  var e *Error
+  return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// Client calls the API at BaseURL (such as "http://localhost:6060"). Requests
+// that are safe to repeat (reads and predictions) are retried up to
+// MaxRetries times on connection errors and 429, 502, 503 and 504 responses,
+// waiting RetryBackoff and then twice as long each time, or as long as the
+// server asks with Retry-After. The others are only retried when the server
+// cannot have acted on them: on 429 responses and failures to connect.
+// APIKey is sent with every request.
+type Client struct {
+  BaseURL string
+  APIKey string
+  HTTPClient *http.Client
+  MaxRetries int
+  RetryBackoff time.Duration
+}
+
+func New(baseURL string) *Client {
+  return &Client{
+    BaseURL: strings.TrimRight(baseURL, "/"),
+    HTTPClient: http.DefaultClient,
+    MaxRetries: 3,
+    RetryBackoff: 100 * time.Millisecond,
+  }
+}
+
+func (c *Client) CreateModel(ctx context.Context, pre *PreModel) (*Model, error) {
+  m := &Model{}
+  err := c.do(ctx, "POST", "/api/models", pre, m, false)
+  if err != nil {
+    return nil, err
+  }
+  return m, nil
+}
+
+func (c *Client) GetModel(ctx context.Context, id string) (*Model, error) {
+  m := &Model{}
+  err := c.do(ctx, "GET", modelPath(id), nil, m, true)
+  if err != nil {
+    return nil, err
+  }
+  return m, nil
+}
+
+func (c *Client) ListModels(ctx context.Context) ([]*Model, error) {
+  var models []*Model
+  err := c.do(ctx, "GET", "/api/models", nil, &models, true)
+  if err != nil {
+    return nil, err
+  }
+  return models, nil
+}
+
+// AddData adds the data to the model, returning them as saved. It is not
+// retried, as that could add the data twice.
+func (c *Client) AddData(ctx context.Context, id string, pres []*PreDatum) ([]*Datum, error) {
+  var data []*Datum
+  err := c.do(ctx, "POST", modelPath(id) + "/data", pres, &data, false)
+  if err != nil {
+    return nil, err
+  }
+  return data, nil
+}
+
+func (c *Client) Learn(ctx context.Context, id string) (*Model, error) {
+  m := &Model{}
+  err := c.do(ctx, "POST", modelPath(id) + "/learn", nil, m, false)
+  if err != nil {
+    return nil, err
+  }
+  return m, nil
+}
+
+func (c *Client) CV(ctx context.Context, id string) (*Model, error) {
+  m := &Model{}
+  err := c.do(ctx, "POST", modelPath(id) + "/cv", nil, m, false)
+  if err != nil {
+    return nil, err
+  }
+  return m, nil
+}
+
+func (c *Client) Predict(ctx context.Context, id string, pre *PreDatum) (*Prediction, error) {
+  p := &Prediction{}
+  err := c.do(ctx, "POST", modelPath(id) + "/predict", pre, p, true)
+  if err != nil {
+    return nil, err
+  }
+  return p, nil
+}
+
+// Export returns the model in the given format, "json" or "pmml".
+func (c *Client) Export(ctx context.Context, id string, format string) ([]byte, error) {
+  var data []byte
+  err := c.do(ctx, "GET", modelPath(id) + "/export?format=" + url.QueryEscape(format), nil, &data, true)
+  if err != nil {
+    return nil, err
+  }
+  return data, nil
+}
+
+// Delete deletes the model and all of its data.
+func (c *Client) Delete(ctx context.Context, id string) error {
+  return c.do(ctx, "DELETE", modelPath(id), nil, nil, false)
+}
+
+// CreateKey creates an API key of the tenant (by default that of the
+// client's key). Key.Key is only ever returned here. It needs an admin key,
+// or a super admin key for other tenants, as do ListKeys and DeleteKey.
+func (c *Client) CreateKey(ctx context.Context, pre *PreKey) (*Key, error) {
+  k := &Key{}
+  err := c.do(ctx, "POST", "/api/keys", pre, k, false)
+  if err != nil {
+    return nil, err
+  }
+  return k, nil
+}
+
+func (c *Client) ListKeys(ctx context.Context) ([]*Key, error) {
+  var keys []*Key
+  err := c.do(ctx, "GET", "/api/keys", nil, &keys, true)
+  if err != nil {
+    return nil, err
+  }
+  return keys, nil
+}
+
+func (c *Client) DeleteKey(ctx context.Context, id string) error {
+  return c.do(ctx, "DELETE", "/api/keys/" + url.PathEscape(id), nil, nil, false)
+}
+
+// Usage returns the quotas of the client's key and how much of them it uses.
+func (c *Client) Usage(ctx context.Context) (*Usage, error) {
+  u := &Usage{}
+  err := c.do(ctx, "GET", "/api/usage", nil, u, true)
+  if err != nil {
+    return nil, err
+  }
+  return u, nil
+}
+
+func modelPath(id string) string {
+  return "/api/models/" + url.PathEscape(id)
+}
+
+// do sends the request with body encoded as JSON and decodes the response
+// into out, unless it is nil. A *[]byte out gets the response as is. Only
+// requests with retry set are retried once they may have reached the server.
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, out interface{}, retry bool) error {
+  var data []byte
+  if body != nil {
+    var err error
+    data, err = json.Marshal(body)
+    if err != nil {
+      return err
+    }
+  }
+  backoff := c.RetryBackoff
+  for attempt := 0; ; attempt++ {
+    wait, err := c.send(ctx, method, path, data, out)
+    if err == nil {
+      return nil
+    }
+    if wait < 0 || attempt >= c.MaxRetries || !(retry || unprocessed(err)) {
+      return err
+    }
+    if wait == 0 {
+      wait = backoff
+    }
+    backoff *= 2
+    select {
+    case <-ctx.Done():
+      return ctx.Err()
+    case <-time.After(wait):
+    }
+  }
+}
+
+// send makes one attempt at the request. When it fails, it also returns how
+// long to wait before trying again: 0 for the default backoff, or -1 if the
+// error is not transient.
+func (c *Client) send(ctx context.Context, method string, path string, data []byte, out interface{}) (time.Duration, error) {
+  var body io.Reader
+  if data != nil {
+    body = bytes.NewReader(data)
+  }
+  req, err := http.NewRequest(method, c.BaseURL + path, body)
+  if err != nil {
+    return -1, err
+  }
+  req = req.WithContext(ctx)
+  if data != nil {
+    req.Header.Set("Content-Type", "application/json")
+  }
+  req.Header.Set("Accept", "application/json")
+  if c.APIKey != "" {
+    req.Header.Set("Authorization", "Bearer " + c.APIKey)
+  }
+  resp, err := c.HTTPClient.Do(req)
+  if err != nil {
+    if ctx.Err() != nil {
+      return -1, ctx.Err()
+    }
+    return 0, err
+  }
+  defer resp.Body.Close()
+  respData, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return 0, err
+  }
+  if resp.StatusCode >= 300 {
+    return retryAfter(resp), decodeError(resp.StatusCode, respData)
+  }
+  if out == nil {
+    return 0, nil
+  }
+  if raw, ok := out.(*[]byte); ok {
+    *raw = respData
+    return 0, nil
+  }
+  err = json.Unmarshal(respData, out)
+  if err != nil {
+    return -1, err
+  }
+  return 0, nil
+}
+
+// unprocessed reports whether err shows that the server did not act on the
+// request: it was rate limited or the connection was never made.
+func unprocessed(err error) bool {
+  var e *Error
+  if errors.As(err, &e) {
+    return e.StatusCode == http.StatusTooManyRequests
+  }
+  var opErr *net.OpError
+  return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+  switch resp.StatusCode {
+  case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+  default:
+    return -1
+  }
+  seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+  if err != nil || seconds < 0 {
+    return 0
+  }
+  return time.Duration(seconds) * time.Second
+}
+
+// decodeError reads an ErrorResponse, falling back to the {"error": message}
+// of older servers and then to the plain text of the response.
+func decodeError(statusCode int, data []byte) *Error {
+  e := &Error{StatusCode: statusCode}
+  var resp ErrorResponse
+  var legacy struct {
+    Error string `json:"error"`
+  }
+  if json.Unmarshal(data, &resp) == nil && resp.Error.Message != "" {
+    e.Code = resp.Error.Code
+    e.Message = resp.Error.Message
+    e.Details = resp.Error.Details
+    e.RequestId = resp.Error.RequestId
+  } else if json.Unmarshal(data, &legacy) == nil && legacy.Error != "" {
+    e.Message = legacy.Error
+  } else {
+    e.Message = strings.TrimSpace(string(data))
+  }
+  if e.Message == "" {
+    e.Message = http.StatusText(statusCode)
+  }
+  return e
+}
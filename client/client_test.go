@@ -0,0 +1,256 @@
+package client
+
+import (
+  "context"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+func newTestClient(handler http.HandlerFunc) (*Client, *httptest.Server) {
+  server := httptest.NewServer(handler)
+  c := New(server.URL)
+  c.RetryBackoff = time.Millisecond
+  return c, server
+}
+
+func TestCreateModel(t *testing.T) {
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    if req.Method != "POST" || req.URL.Path != "/api/models" {
+      t.Errorf("unexpected request %v %v", req.Method, req.URL.Path)
+    }
+    var pre PreModel
+    err := json.NewDecoder(req.Body).Decode(&pre)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if pre.Type != "logistic" || len(pre.Covariates) != 2 {
+      t.Errorf("unexpected model %+v", pre)
+    }
+    rw.Write([]byte(`{"id": "abc", "type": "logistic", "lambda": 0.1, "coefficients": [{"label": "age", "value": 0}, {"label": "intercept", "value": 0}]}`))
+  })
+  defer server.Close()
+
+  m, err := c.CreateModel(context.Background(), &PreModel{Type: "logistic", Covariates: []string{"age", "intercept"}, Lambda: 0.1})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if m.Id != "abc" || len(m.Coefficients) != 2 || m.Coefficients[0].Label != "age" {
+    t.Errorf("unexpected model %+v", m)
+  }
+}
+
+func TestErrorResponse(t *testing.T) {
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    rw.Header().Set("Content-Type", "application/json")
+    rw.WriteHeader(http.StatusUnprocessableEntity)
+    rw.Write([]byte(`{"error": {"code": "unprocessable", "message": "Unknown class \"c\"", "details": {"index": 3}, "request_id": "r1"}}`))
+  })
+  defer server.Close()
+
+  _, err := c.AddData(context.Background(), "abc", []*PreDatum{{Class: "c"}})
+  e, ok := err.(*Error)
+  if !ok {
+    t.Fatalf("expected *Error, got %v", err)
+  }
+  if e.StatusCode != http.StatusUnprocessableEntity || e.Code != "unprocessable" || e.Message != `Unknown class "c"` || e.RequestId != "r1" || string(e.Details) != `{"index": 3}` {
+    t.Errorf("unexpected error %+v", e)
+  }
+}
+
+func TestLegacyErrorResponse(t *testing.T) {
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    rw.Header().Set("Content-Type", "application/json")
+    rw.WriteHeader(http.StatusBadRequest)
+    rw.Write([]byte(`{"error": "Unknown model type \"foo\""}`))
+  })
+  defer server.Close()
+
+  _, err := c.CreateModel(context.Background(), &PreModel{Type: "foo"})
+  e, ok := err.(*Error)
+  if !ok {
+    t.Fatalf("expected *Error, got %v", err)
+  }
+  if e.StatusCode != http.StatusBadRequest || e.Message != `Unknown model type "foo"` {
+    t.Errorf("unexpected error %+v", e)
+  }
+}
+
+func TestPlainTextError(t *testing.T) {
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    http.Error(rw, "Not Found", http.StatusNotFound)
+  })
+  defer server.Close()
+
+  _, err := c.GetModel(context.Background(), "missing")
+  if !IsNotFound(err) {
+    t.Errorf("expected not found, got %v", err)
+  }
+}
+
+func TestRetriesTransientErrors(t *testing.T) {
+  attempts := 0
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    attempts++
+    if attempts < 3 {
+      http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+      return
+    }
+    rw.Write([]byte(`{"value": 0.25}`))
+  })
+  defer server.Close()
+
+  p, err := c.Predict(context.Background(), "abc", &PreDatum{Covariates: map[string]float64{"age": 1}})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if attempts != 3 || p.Value != 0.25 {
+    t.Errorf("unexpected prediction %+v after %v attempts", p, attempts)
+  }
+}
+
+func TestDoesNotRetryAddData(t *testing.T) {
+  attempts := 0
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    attempts++
+    http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+  })
+  defer server.Close()
+
+  _, err := c.AddData(context.Background(), "abc", []*PreDatum{&PreDatum{Value: 1}})
+  if err == nil || attempts != 1 {
+    t.Errorf("expected a single failed attempt, got %v after %v attempts", err, attempts)
+  }
+}
+
+func TestDoesNotRetryLearn(t *testing.T) {
+  attempts := 0
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    attempts++
+    http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+  })
+  defer server.Close()
+
+  _, err := c.Learn(context.Background(), "abc")
+  if err == nil || attempts != 1 {
+    t.Errorf("expected a single failed attempt, got %v after %v attempts", err, attempts)
+  }
+}
+
+func TestRetriesLearnWhenRateLimited(t *testing.T) {
+  attempts := 0
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    attempts++
+    if attempts < 2 {
+      http.Error(rw, "slow down", http.StatusTooManyRequests)
+      return
+    }
+    rw.Write([]byte(`{"id": "abc"}`))
+  })
+  defer server.Close()
+
+  m, err := c.Learn(context.Background(), "abc")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if attempts != 2 || m.Id != "abc" {
+    t.Errorf("unexpected model %+v after %v attempts", m, attempts)
+  }
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+  attempts := 0
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    attempts++
+    http.Error(rw, "bad", http.StatusBadRequest)
+  })
+  defer server.Close()
+
+  _, err := c.Learn(context.Background(), "abc")
+  if err == nil || attempts != 1 {
+    t.Errorf("expected a single failed attempt, got %v after %v attempts", err, attempts)
+  }
+}
+
+func TestContextCancelsRetries(t *testing.T) {
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    rw.Header().Set("Retry-After", "10")
+    http.Error(rw, "slow down", http.StatusTooManyRequests)
+  })
+  defer server.Close()
+
+  ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+  defer cancel()
+  start := time.Now()
+  _, err := c.GetModel(ctx, "abc")
+  if err != context.DeadlineExceeded {
+    t.Errorf("expected deadline exceeded, got %v", err)
+  }
+  if time.Since(start) > 5 * time.Second {
+    t.Errorf("waited for Retry-After despite the deadline")
+  }
+}
+
+func TestPredictionProbabilities(t *testing.T) {
+  responses := map[string]string{
+    "multinomial": `{"class": "b", "probabilities": {"a": 0.25, "b": 0.75}}`,
+    "ordinal": `{"level": 2, "probability": 0.6, "levels": [1, 2], "cumulative": [0.4, 1], "probabilities": [0.4, 0.6]}`,
+  }
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    rw.Write([]byte(responses[req.URL.Path[len("/api/models/"):len(req.URL.Path) - len("/predict")]]))
+  })
+  defer server.Close()
+
+  p, err := c.Predict(context.Background(), "multinomial", &PreDatum{})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if p.Class != "b" || p.ClassProbabilities["b"] != 0.75 {
+    t.Errorf("unexpected multinomial prediction %+v", p)
+  }
+  p, err = c.Predict(context.Background(), "ordinal", &PreDatum{})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if p.Level != 2 || len(p.LevelProbabilities) != 2 || p.LevelProbabilities[1] != 0.6 {
+    t.Errorf("unexpected ordinal prediction %+v", p)
+  }
+}
+
+func TestDelete(t *testing.T) {
+  deleted := ""
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    if req.Method == "DELETE" {
+      deleted = req.URL.Path
+    }
+    rw.Write([]byte("{}"))
+  })
+  defer server.Close()
+
+  err := c.Delete(context.Background(), "abc")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if deleted != "/api/models/abc" {
+    t.Errorf("unexpected path %q", deleted)
+  }
+}
+
+func TestSendsAPIKey(t *testing.T) {
+  c, server := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+    if req.Header.Get("Authorization") != "Bearer cml_secret" {
+      http.Error(rw, "unauthorized", http.StatusUnauthorized)
+      return
+    }
+    rw.Write([]byte("[]"))
+  })
+  defer server.Close()
+
+  c.APIKey = "cml_secret"
+  _, err := c.ListModels(context.Background())
+  if err != nil {
+    t.Error(err)
+  }
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+  "encoding/json"
+  "time"
+)
+
+// The types mirror the JSON of cloudml-server.
+
+type PreModel struct {
+  Type string `json:"type"`
+  Family string `json:"family,omitempty"`
+  Link string `json:"link,omitempty"`
+  Robust bool `json:"robust,omitempty"`
+  HuberK float64 `json:"huber_k,omitempty"`
+  Quantile float64 `json:"quantile,omitempty"`
+  PriorPrecision float64 `json:"prior_precision,omitempty"`
+  NoiseVariance float64 `json:"noise_variance,omitempty"`
+  EmpiricalBayes bool `json:"empirical_bayes,omitempty"`
+  Covariates []string `json:"covariates"`
+  Lambda float64 `json:"lambda"`
+  Classes []string `json:"classes,omitempty"`
+  Levels []float64 `json:"levels,omitempty"`
+}
+
+type PreDatum struct {
+  Value float64 `json:"value"`
+  Covariates map[string]float64 `json:"covariates"`
+  Weight *float64 `json:"weight,omitempty"`
+  Offset float64 `json:"offset,omitempty"`
+  Exposure *float64 `json:"exposure,omitempty"`
+  Class string `json:"class,omitempty"`
+  Duration float64 `json:"duration,omitempty"`
+  Event bool `json:"event,omitempty"`
+  Times []float64 `json:"times,omitempty"`
+}
+
+type Model struct {
+  Id string `json:"id"`
+  Tenant string `json:"tenant"`
+  Type string `json:"type"`
+  Family string `json:"family,omitempty"`
+  Link string `json:"link,omitempty"`
+  Robust bool `json:"robust,omitempty"`
+  HuberK float64 `json:"huber_k,omitempty"`
+  Quantile float64 `json:"quantile,omitempty"`
+  PriorPrecision float64 `json:"prior_precision,omitempty"`
+  NoiseVariance float64 `json:"noise_variance,omitempty"`
+  EmpiricalBayes bool `json:"empirical_bayes,omitempty"`
+  Lambda float64 `json:"lambda"`
+  NumTrainingData int `json:"num_training_data"`
+  SumWeights float64 `json:"sum_weights"`
+  NumCovariates int `json:"num_covariates"`
+  Version int `json:"version"`
+  NumVersions int `json:"num_versions"`
+  Intercept string `json:"intercept,omitempty"`
+  TrainRmse *float64 `json:"train_rmse,omitempty"`
+  CvRmse *float64 `json:"cv_rmse,omitempty"`
+  TrainPinball *float64 `json:"train_pinball,omitempty"`
+  CvPinball *float64 `json:"cv_pinball,omitempty"`
+  TrainConcordance *float64 `json:"train_concordance,omitempty"`
+  CvConcordance *float64 `json:"cv_concordance,omitempty"`
+  Coefficients []Coefficient `json:"coefficients"`
+  Classes []string `json:"classes,omitempty"`
+  ClassCoefficients []ClassCoefficient `json:"class_coefficients,omitempty"`
+  Levels []float64 `json:"levels,omitempty"`
+  Thresholds []Threshold `json:"thresholds,omitempty"`
+  Covariance [][]float64 `json:"covariance,omitempty"`
+}
+
+type Coefficient struct {
+  Id string `json:"id"`
+  Model string `json:"model"`
+  Label string `json:"label"`
+  Value float64 `json:"value"`
+  Source string `json:"source,omitempty"`
+}
+
+type ClassCoefficient struct {
+  Id string `json:"id"`
+  Model string `json:"model"`
+  Class string `json:"class"`
+  Label string `json:"label"`
+  Value float64 `json:"value"`
+}
+
+type Threshold struct {
+  Id string `json:"id"`
+  Model string `json:"model"`
+  Lower float64 `json:"lower"`
+  Upper float64 `json:"upper"`
+  Value float64 `json:"value"`
+}
+
+type Covariate struct {
+  Id string `json:"id"`
+  Datum string `json:"datum"`
+  Label string `json:"label"`
+  Value float64 `json:"value"`
+}
+
+type Datum struct {
+  Id string `json:"id"`
+  Model string `json:"model"`
+  Value float64 `json:"value"`
+  Weight float64 `json:"weight"`
+  Offset float64 `json:"offset"`
+  Class string `json:"class,omitempty"`
+  Duration float64 `json:"duration,omitempty"`
+  Event bool `json:"event,omitempty"`
+  Covariates []Covariate `json:"covariates"`
+}
+
+// Prediction holds the prediction of any type of model; only the fields of
+// the model's type are set. Multinomial models set Class and
+// ClassProbabilities, ordinal models Level, Probability, Levels, Cumulative
+// and LevelProbabilities, cox models RelativeHazard, Times and Survival, and
+// bayesian linear models Value along with its predictive distribution.
+type Prediction struct {
+  Value float64 `json:"value"`
+  Variance float64 `json:"variance,omitempty"`
+  StdDev float64 `json:"std_dev,omitempty"`
+  Lower float64 `json:"lower,omitempty"`
+  Upper float64 `json:"upper,omitempty"`
+  Class string `json:"class,omitempty"`
+  ClassProbabilities map[string]float64 `json:"-"`
+  Level float64 `json:"level,omitempty"`
+  Probability float64 `json:"probability,omitempty"`
+  Levels []float64 `json:"levels,omitempty"`
+  Cumulative []float64 `json:"cumulative,omitempty"`
+  LevelProbabilities []float64 `json:"-"`
+  RelativeHazard float64 `json:"relative_hazard,omitempty"`
+  Times []float64 `json:"times,omitempty"`
+  Survival []float64 `json:"survival,omitempty"`
+}
+
+// UnmarshalJSON decodes "probabilities", which is an object for multinomial
+// models and an array for ordinal models.
+func (p *Prediction) UnmarshalJSON(data []byte) error {
+  type prediction Prediction
+  aux := struct {
+    *prediction
+    Probabilities json.RawMessage `json:"probabilities"`
+  }{prediction: (*prediction)(p)}
+  err := json.Unmarshal(data, &aux)
+  if err != nil {
+    return err
+  }
+  if len(aux.Probabilities) == 0 {
+    return nil
+  }
+  if aux.Probabilities[0] == '[' {
+    return json.Unmarshal(aux.Probabilities, &p.LevelProbabilities)
+  }
+  return json.Unmarshal(aux.Probabilities, &p.ClassProbabilities)
+}
+
+// MarshalJSON writes "probabilities" back as the server does.
+func (p *Prediction) MarshalJSON() ([]byte, error) {
+  type prediction Prediction
+  aux := struct {
+    *prediction
+    Probabilities interface{} `json:"probabilities,omitempty"`
+  }{prediction: (*prediction)(p)}
+  if p.ClassProbabilities != nil {
+    aux.Probabilities = p.ClassProbabilities
+  } else if p.LevelProbabilities != nil {
+    aux.Probabilities = p.LevelProbabilities
+  }
+  return json.Marshal(aux)
+}
+
+// PreKey is a key to create. Its quotas are 0 for the server's defaults and
+// negative for no limit.
+type PreKey struct {
+  Tenant string `json:"tenant,omitempty"`
+  Role string `json:"role"`
+  RateLimit float64 `json:"rate_limit,omitempty"`
+  MaxModels int `json:"max_models,omitempty"`
+  MaxRowsPerModel int `json:"max_rows_per_model,omitempty"`
+  MaxTrainingJobs int `json:"max_training_jobs,omitempty"`
+}
+
+type Key struct {
+  Id string `json:"id"`
+  Tenant string `json:"tenant"`
+  Role string `json:"role"`
+  Created time.Time `json:"created"`
+  Key string `json:"key,omitempty"`
+  RateLimit float64 `json:"rate_limit"`
+  MaxModels int `json:"max_models"`
+  MaxRowsPerModel int `json:"max_rows_per_model"`
+  MaxTrainingJobs int `json:"max_training_jobs"`
+}
+
+// Usage is how much of its quotas a key uses. Limits of 0 are no limit.
+type Usage struct {
+  Tenant string `json:"tenant"`
+  Key string `json:"key"`
+  Limits struct {
+    RateLimit float64 `json:"rate_limit"`
+    RateBurst int `json:"rate_burst"`
+    MaxModels int `json:"max_models"`
+    MaxRowsPerModel int `json:"max_rows_per_model"`
+    MaxTrainingJobs int `json:"max_training_jobs"`
+  } `json:"limits"`
+  RemainingRequests *int `json:"remaining_requests"`
+  Models int `json:"models"`
+  TrainingJobs int `json:"training_jobs"`
+  Rows map[string]int `json:"rows"`
+}
+
+type ErrorResponse struct {
+  Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+  Code string `json:"code"`
+  Message string `json:"message"`
+  Details json.RawMessage `json:"details"`
+  RequestId string `json:"request_id"`
+}
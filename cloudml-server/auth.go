@@ -0,0 +1,85 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/db"
+  "github.com/gorilla/mux"
+  "context"
+  "fmt"
+  "net/http"
+  "strings"
+)
+
+type contextKey int
+
+const apiKeyContextKey contextKey = 0
+
+// Authorize lets through only requests with a valid API key, given as
+// "Authorization: Bearer KEY" or "X-API-Key: KEY", whose role allows role and
+// which is within its rate. Handlers find the key with RequestKey.
+func Authorize(role string, handler http.HandlerFunc) http.HandlerFunc {
+  return func(rw http.ResponseWriter, req *http.Request) {
+    key := req.Header.Get("X-API-Key")
+    auth := req.Header.Get("Authorization")
+    if key == "" && strings.HasPrefix(auth, "Bearer ") {
+      key = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+    }
+    if key == "" {
+      rw.Header().Set("WWW-Authenticate", "Bearer")
+      SendError(rw, "An API key is required", http.StatusUnauthorized)
+      return
+    }
+    k, err := lookupKey(req.Context(), key)
+    if db.IsNotFound(err) {
+      rw.Header().Set("WWW-Authenticate", "Bearer")
+      SendError(rw, "Invalid API key", http.StatusUnauthorized)
+      return
+    }
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    if !k.Allows(role) {
+      SendError(rw, fmt.Sprintf("The role %v of this key does not allow this request, which needs %v", k.Role, role), http.StatusForbidden)
+      return
+    }
+    l := KeyLimits(k)
+    ok, retryAfter := takeRequest(k, l)
+    if !ok {
+      SendTooMany(rw, fmt.Sprintf("This key may make %v requests a second", l.RateLimit), retryAfter, map[string]float64{"rate_limit": l.RateLimit})
+      return
+    }
+    ctx := context.WithValue(req.Context(), apiKeyContextKey, k)
+    handler(rw, req.WithContext(ctx))
+  }
+}
+
+// RequestKey returns the API key of a request let through by Authorize.
+func RequestKey(req *http.Request) *db.ApiKey {
+  k, _ := req.Context().Value(apiKeyContextKey).(*db.ApiKey)
+  return k
+}
+
+// lookupKey and lookupModel find the keys of Authorize and the models of
+// GetRequestModel; tests replace them.
+var (
+  lookupKey = db.GetApiKey
+  lookupModel = db.GetModelById
+)
+
+// GetRequestModel looks up the model named by the route, responding with an
+// error if it does not exist or the request's key may not use it. Models of
+// other tenants are not found, so as not to reveal their ids.
+func GetRequestModel(rw http.ResponseWriter, req *http.Request) (*db.Model, bool) {
+  id := mux.Vars(req)["id"]
+  m, err := lookupModel(req.Context(), id)
+  if err != nil {
+    SendDBError(rw, err)
+    return nil, false
+  }
+  k := RequestKey(req)
+  if k == nil || !k.CanAccess(m) {
+    SendError(rw, "Model " + id + " not found", http.StatusNotFound)
+    return nil, false
+  }
+  return m, true
+}
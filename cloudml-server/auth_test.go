@@ -0,0 +1,224 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/db"
+  "github.com/gorilla/mux"
+  "context"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "sort"
+  "strings"
+  "testing"
+)
+
+// getModelAs gets model "abc" of tenant "a" with key k.
+func getModelAs(k *db.ApiKey) *httptest.ResponseRecorder {
+  lookupModel = func(ctx context.Context, id string) (*db.Model, error) {
+    return &db.Model{Id: id, Tenant: "a"}, nil
+  }
+  defer func() {
+    lookupModel = db.GetModelById
+  }()
+  r := mux.NewRouter()
+  r.HandleFunc("/api/models/{id}", GetModelHandler).Methods("GET")
+
+  req := httptest.NewRequest("GET", "/api/models/abc", nil)
+  req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey, k))
+  rec := httptest.NewRecorder()
+  r.ServeHTTP(rec, req)
+  return rec
+}
+
+func TestGetModelOfOtherTenantIsNotFound(t *testing.T) {
+  rec := getModelAs(&db.ApiKey{Tenant: "b", Role: db.RoleReader})
+  if rec.Code != http.StatusNotFound {
+    t.Errorf("expected 404 for a model of another tenant, got %v: %v", rec.Code, rec.Body.String())
+  }
+}
+
+func TestAdminCannotGetModelOfOtherTenant(t *testing.T) {
+  rec := getModelAs(&db.ApiKey{Tenant: "b", Role: db.RoleAdmin})
+  if rec.Code != http.StatusNotFound {
+    t.Errorf("expected 404 for a model of another tenant, got %v: %v", rec.Code, rec.Body.String())
+  }
+}
+
+// testKeys are the keys of stubKeys by the key sent with requests.
+var testKeys = map[string]*db.ApiKey{
+  "reader-a": &db.ApiKey{Id: "1", Tenant: "a", Role: db.RoleReader, RateLimit: -1},
+  "writer-a": &db.ApiKey{Id: "2", Tenant: "a", Role: db.RoleWriter, RateLimit: -1},
+  "trainer-a": &db.ApiKey{Id: "3", Tenant: "a", Role: db.RoleTrainer, RateLimit: -1},
+  "admin-a": &db.ApiKey{Id: "4", Tenant: "a", Role: db.RoleAdmin, RateLimit: -1},
+  "superadmin-a": &db.ApiKey{Id: "5", Tenant: "a", Role: db.RoleSuperAdmin, RateLimit: -1},
+  "admin-b": &db.ApiKey{Id: "6", Tenant: "b", Role: db.RoleAdmin, RateLimit: -1},
+}
+
+// stubKeys serves testKeys in place of the database until the returned
+// function is called. Deleted key ids are added to deleted.
+func stubKeys(deleted *[]string) func() {
+  lookupKey = func(ctx context.Context, key string) (*db.ApiKey, error) {
+    k, ok := testKeys[key]
+    if !ok {
+      return nil, &db.Error{Kind: db.NotFound, Message: "Unknown API key"}
+    }
+    return k, nil
+  }
+  getApiKeys = func(ctx context.Context) ([]db.ApiKey, error) {
+    var ks []db.ApiKey
+    for _, k := range testKeys {
+      ks = append(ks, *k)
+    }
+    return ks, nil
+  }
+  getApiKeyById = func(ctx context.Context, id string) (*db.ApiKey, error) {
+    for _, k := range testKeys {
+      if k.Id == id {
+        return k, nil
+      }
+    }
+    return nil, &db.Error{Kind: db.NotFound, Message: "Key " + id + " not found"}
+  }
+  deleteApiKeyById = func(ctx context.Context, id string) error {
+    *deleted = append(*deleted, id)
+    return nil
+  }
+  createApiKey = func(ctx context.Context, k *db.ApiKey) (string, error) {
+    k.Id = "7"
+    return "cml_new", nil
+  }
+  return func() {
+    lookupKey = db.GetApiKey
+    getApiKeys = db.GetApiKeys
+    getApiKeyById = db.GetApiKeyById
+    deleteApiKeyById = db.DeleteApiKeyById
+    createApiKey = db.CreateApiKey
+  }
+}
+
+// serve sends the request with the key, if any, through the API's routes.
+func serve(method string, path string, key string, body string) *httptest.ResponseRecorder {
+  req := httptest.NewRequest(method, path, strings.NewReader(body))
+  if key != "" {
+    req.Header.Set("Authorization", "Bearer " + key)
+  }
+  rec := httptest.NewRecorder()
+  newRouter().ServeHTTP(rec, req)
+  return rec
+}
+
+func TestRolesAreEnforced(t *testing.T) {
+  var deleted []string
+  defer stubKeys(&deleted)()
+  tests := []struct {
+    method string
+    path string
+    key string
+  }{
+    {"POST", "/api/models/abc/datum", "reader-a"},
+    {"POST", "/api/models/abc/data", "reader-a"},
+    {"DELETE", "/api/models/abc/data/xyz", "reader-a"},
+    {"POST", "/api/models", "writer-a"},
+    {"DELETE", "/api/models/abc/data", "writer-a"},
+    {"POST", "/api/models/abc/learn", "writer-a"},
+    {"POST", "/api/models/abc/versions/1/promote", "writer-a"},
+    {"DELETE", "/api/models/abc", "trainer-a"},
+    {"POST", "/api/keys", "trainer-a"},
+    {"GET", "/api/keys", "trainer-a"},
+    {"DELETE", "/api/keys/1", "trainer-a"},
+  }
+  for _, test := range tests {
+    rec := serve(test.method, test.path, test.key, "{}")
+    if rec.Code != http.StatusForbidden {
+      t.Errorf("%v %v with %v: expected 403, got %v", test.method, test.path, test.key, rec.Code)
+    }
+  }
+  if len(deleted) > 0 {
+    t.Errorf("deleted keys %v without the role", deleted)
+  }
+  for _, key := range []string{"", "unknown"} {
+    rec := serve("GET", "/api/models", key, "")
+    if rec.Code != http.StatusUnauthorized {
+      t.Errorf("GET /api/models with key %q: expected 401, got %v", key, rec.Code)
+    }
+  }
+}
+
+func TestListKeys(t *testing.T) {
+  var deleted []string
+  defer stubKeys(&deleted)()
+  tests := []struct {
+    key string
+    ids []string
+  }{
+    // not the super admin key of its tenant, nor the keys of others
+    {"admin-a", []string{"1", "2", "3", "4"}},
+    {"admin-b", []string{"6"}},
+    {"superadmin-a", []string{"1", "2", "3", "4", "5", "6"}},
+  }
+  for _, test := range tests {
+    rec := serve("GET", "/api/keys", test.key, "")
+    var keys []ApiKey
+    err := json.Unmarshal(rec.Body.Bytes(), &keys)
+    if rec.Code != http.StatusOK || err != nil {
+      t.Errorf("listing keys with %v: got %v: %v", test.key, rec.Code, rec.Body.String())
+      continue
+    }
+    var ids []string
+    for _, k := range keys {
+      ids = append(ids, k.Id)
+    }
+    sort.Strings(ids)
+    if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+      t.Errorf("listing keys with %v: expected %v, got %v", test.key, test.ids, ids)
+    }
+  }
+}
+
+func TestDeleteKey(t *testing.T) {
+  tests := []struct {
+    key string
+    id string
+    code int
+  }{
+    {"admin-a", "2", http.StatusOK},
+    {"admin-a", "4", http.StatusConflict},
+    {"admin-a", "5", http.StatusNotFound},
+    {"admin-a", "6", http.StatusNotFound},
+    {"superadmin-a", "6", http.StatusOK},
+  }
+  for _, test := range tests {
+    var deleted []string
+    restore := stubKeys(&deleted)
+    rec := serve("DELETE", "/api/keys/" + test.id, test.key, "")
+    restore()
+    if rec.Code != test.code {
+      t.Errorf("deleting key %v with %v: expected %v, got %v: %v", test.id, test.key, test.code, rec.Code, rec.Body.String())
+    }
+    if (test.code == http.StatusOK) != (len(deleted) == 1) {
+      t.Errorf("deleting key %v with %v: deleted %v", test.id, test.key, deleted)
+    }
+  }
+}
+
+func TestCreateKey(t *testing.T) {
+  var deleted []string
+  defer stubKeys(&deleted)()
+  tests := []struct {
+    key string
+    body string
+    code int
+  }{
+    {"admin-a", `{"role": "writer"}`, http.StatusOK},
+    {"admin-a", `{"tenant": "a", "role": "admin"}`, http.StatusOK},
+    {"admin-a", `{"tenant": "b", "role": "reader"}`, http.StatusForbidden},
+    {"admin-a", `{"role": "superadmin"}`, http.StatusForbidden},
+    {"superadmin-a", `{"tenant": "b", "role": "superadmin"}`, http.StatusOK},
+  }
+  for _, test := range tests {
+    rec := serve("POST", "/api/keys", test.key, test.body)
+    if rec.Code != test.code {
+      t.Errorf("creating %v with %v: expected %v, got %v: %v", test.body, test.key, test.code, rec.Code, rec.Body.String())
+    }
+  }
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/db"
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "strings"
+  "sync/atomic"
+  "time"
+)
+
+// readyTimeout bounds the database checks of /readyz.
+const readyTimeout = 2 * time.Second
+
+// shuttingDown is 1 once the server is stopping.
+var shuttingDown int32
+
+type Health struct {
+  Status string `json:"status"`
+  Components map[string]*ComponentHealth `json:"components,omitempty"`
+}
+
+// ComponentHealth is "ok" or "error", with the error.
+type ComponentHealth struct {
+  Status string `json:"status"`
+  Error string `json:"error,omitempty"`
+}
+
+func componentHealth(err error) *ComponentHealth {
+  if err != nil {
+    return &ComponentHealth{Status: "error", Error: err.Error()}
+  }
+  return &ComponentHealth{Status: "ok"}
+}
+
+func sendHealth(rw http.ResponseWriter, health *Health, statusCode int) {
+  rw.Header().Set("Content-Type", "application/json")
+  rw.Header().Set("Cache-Control", "no-store")
+  rw.WriteHeader(statusCode)
+  json.NewEncoder(rw).Encode(health)
+}
+
+// HealthzHandler reports that the process is up, whatever the state of the
+// database.
+func HealthzHandler(rw http.ResponseWriter, req *http.Request) {
+  sendHealth(rw, &Health{Status: "ok"}, http.StatusOK)
+}
+
+// ReadyzHandler reports whether the server can handle requests: the
+// database is reachable, has every column and the learn workers are
+// running, and the server is not shutting down. It responds with a 503 if not, naming the failing components.
+func ReadyzHandler(rw http.ResponseWriter, req *http.Request) {
+  ctx, cancel := context.WithTimeout(req.Context(), readyTimeout)
+  defer cancel()
+  components := make(map[string]*ComponentHealth)
+  if atomic.LoadInt32(&shuttingDown) == 1 {
+    components["server"] = componentHealth(fmt.Errorf("Shutting down"))
+  }
+  err := db.Ping(ctx)
+  if err != nil {
+    logging.Warnf(ctx, "Readiness: database unreachable: %v", err)
+    components["database"] = componentHealth(fmt.Errorf("Database unreachable"))
+    components["schema"] = componentHealth(fmt.Errorf("Not checked"))
+  } else {
+    components["database"] = componentHealth(nil)
+    missing, err := db.MissingColumns(ctx)
+    if err != nil {
+      logging.Warnf(ctx, "Readiness: %v", err)
+      err = fmt.Errorf("Could not read the schema")
+    } else if len(missing) > 0 {
+      err = fmt.Errorf("Missing columns %v", strings.Join(missing, ", "))
+    }
+    components["schema"] = componentHealth(err)
+  }
+  running := int(atomic.LoadInt32(&learnWorkers))
+  err = nil
+  if running < conf.LearnWorkers {
+    err = fmt.Errorf("%v of %v learn workers running", running, conf.LearnWorkers)
+  }
+  components["workers"] = componentHealth(err)
+  health := &Health{Status: "ok", Components: components}
+  statusCode := http.StatusOK
+  for _, c := range components {
+    if c.Status != "ok" {
+      health.Status = "unavailable"
+      statusCode = http.StatusServiceUnavailable
+    }
+  }
+  sendHealth(rw, health, statusCode)
+}
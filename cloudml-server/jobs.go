@@ -0,0 +1,230 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/db"
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "fmt"
+  "runtime/debug"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// cancelWait is how long stopLearnWorkers waits for the training jobs it
+// cancels to roll back.
+const cancelWait = 5 * time.Second
+
+// learnChannel queues the ids of models for the learn workers.
+var learnChannel chan string
+
+// learnWorkers counts the running learnWorker goroutines.
+var learnWorkers int32
+
+// learnWaitGroup counts the learn workers, the goroutine queueing the resumed
+// jobs and the training jobs of requests.
+var learnWaitGroup sync.WaitGroup
+
+// resuming holds the ids of the resumed jobs not yet queued, which are saved
+// again if the server stops first.
+var resuming = struct {
+  sync.Mutex
+  ids []string
+}{}
+
+// stopLearning tells the learn workers to take no more jobs.
+var stopLearning = make(chan struct{})
+
+// learnContext is the context of the background training jobs, canceled when
+// the server stops waiting for them.
+var learnContext, cancelLearning = context.WithCancel(context.Background())
+
+// learning holds the ids of the models the workers and requests are training.
+var learning = struct {
+  sync.Mutex
+  ids map[string]int
+}{ids: make(map[string]int)}
+
+// startLearnWorkers starts the workers, which first train the models left
+// when the server last stopped.
+func startLearnWorkers(workers int, queue int) {
+  learnChannel = make(chan string, queue)
+  for i := 0; i < workers; i++ {
+    learnWaitGroup.Add(1)
+    atomic.AddInt32(&learnWorkers, 1)
+    go learnWorker(learnChannel)
+  }
+  modelIds, err := db.TakeLearnJobs(learnContext)
+  if err != nil {
+    logging.Errorf(learnContext, "Error resuming learn jobs: %v", err)
+    return
+  }
+  if len(modelIds) > 0 {
+    logging.Infof(learnContext, "Resuming %v learn jobs", len(modelIds))
+    resuming.Lock()
+    resuming.ids = modelIds
+    resuming.Unlock()
+    learnWaitGroup.Add(1)
+    go queueResumedJobs()
+  }
+}
+
+// queueResumedJobs queues the resumed jobs for the workers, one at a time so
+// that those left when told to stop stay in resuming.
+func queueResumedJobs() {
+  defer learnWaitGroup.Done()
+  for {
+    resuming.Lock()
+    if len(resuming.ids) == 0 {
+      resuming.Unlock()
+      return
+    }
+    id := resuming.ids[0]
+    resuming.Unlock()
+    select {
+    case learnChannel <- id:
+      resuming.Lock()
+      resuming.ids = resuming.ids[1:]
+      resuming.Unlock()
+    case <-stopLearning:
+      return
+    }
+  }
+}
+
+// learnWorker trains the models whose ids arrive on ch until told to stop.
+func learnWorker(ch <-chan string) {
+  defer learnWaitGroup.Done()
+  defer atomic.AddInt32(&learnWorkers, -1)
+  for {
+    select {
+    case <-stopLearning:
+      return
+    default:
+    }
+    select {
+    case <-stopLearning:
+      return
+    case id := <-ch:
+      learnInBackground(id)
+    }
+  }
+}
+
+// startLearning records that the model is being trained, until the returned
+// function is called.
+func startLearning(id string) func() {
+  learning.Lock()
+  learning.ids[id]++
+  learning.Unlock()
+  return func() {
+    learning.Lock()
+    learning.ids[id]--
+    if learning.ids[id] <= 0 {
+      delete(learning.ids, id)
+    }
+    learning.Unlock()
+  }
+}
+
+// learnInBackground trains the model for a worker, logging any failure.
+func learnInBackground(id string) {
+  defer startLearning(id)()
+  defer func() {
+    p := recover()
+    if p != nil {
+      logging.Log(learnContext, logging.Error, fmt.Sprintf("Panic: %v", p), logging.Fields{
+        "model": id,
+        "stack": string(debug.Stack()),
+      })
+    }
+  }()
+  ctx, cancel := learnTimeout(learnContext)
+  defer cancel()
+  m, err := db.GetModelById(ctx, id)
+  if err == nil {
+    err = m.Learn(ctx)
+  }
+  if db.IsCanceled(err) {
+    logging.Warnf(ctx, "Learning model %v canceled: %v", id, err)
+  } else if err != nil {
+    logging.Errorf(ctx, "Error learning model %v: %v", id, err)
+  }
+}
+
+// learnInForeground trains the model for a request. Like the workers' jobs,
+// shutting down waits for it, and cancels it and saves the model to be
+// trained again if it cannot wait any longer.
+func learnInForeground(ctx context.Context, m *db.Model) error {
+  learnWaitGroup.Add(1)
+  defer learnWaitGroup.Done()
+  defer startLearning(m.Id)()
+  ctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+  go func() {
+    select {
+    case <-learnContext.Done():
+      cancel()
+    case <-ctx.Done():
+    }
+  }()
+  return m.Learn(ctx)
+}
+
+// stopLearnWorkers stops the workers and waits until ctx is done for the
+// models they and requests are training, then cancels them. The models still
+// queued, training or not yet resumed are saved to be trained when the server
+// starts again.
+func stopLearnWorkers(ctx context.Context) {
+  close(stopLearning)
+  done := make(chan struct{})
+  go func() {
+    learnWaitGroup.Wait()
+    close(done)
+  }()
+  var left []string
+  select {
+  case <-done:
+  case <-ctx.Done():
+    learning.Lock()
+    for id := range learning.ids {
+      left = append(left, id)
+    }
+    learning.Unlock()
+    logging.Warnf(ctx, "Canceling %v learn jobs", len(left))
+    cancelLearning()
+    select {
+    case <-done:
+    case <-time.After(cancelWait):
+      logging.Warnf(ctx, "Stopped waiting for canceled learn jobs")
+    }
+  }
+  left = append(left, queuedLearnJobs()...)
+  resuming.Lock()
+  left = append(left, resuming.ids...)
+  resuming.ids = nil
+  resuming.Unlock()
+  if len(left) == 0 {
+    return
+  }
+  // ctx may be done, and the jobs must be saved anyway
+  err := db.SaveLearnJobs(context.Background(), left)
+  if err != nil {
+    logging.Errorf(ctx, "Error saving learn jobs: %v", err)
+    return
+  }
+  logging.Infof(ctx, "Saved %v learn jobs to resume", len(left))
+}
+
+// queuedLearnJobs empties the queue, returning the ids that were in it.
+func queuedLearnJobs() []string {
+  var ids []string
+  for {
+    select {
+    case id := <-learnChannel:
+      ids = append(ids, id)
+    default:
+      return ids
+    }
+  }
+}
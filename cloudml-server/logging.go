@@ -0,0 +1,41 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/logging"
+  "net/http"
+  "time"
+)
+
+// LogRequests logs a line for each request once it is handled, with its
+// route, model, status, latency and the size of the response. Server errors
+// are logged at the error level and the others at info.
+func LogRequests(handler http.Handler) http.Handler {
+  return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+    start := time.Now()
+    rec := &statusRecorder{ResponseWriter: rw}
+    defer func() {
+      status := rec.status
+      if status == 0 {
+        status = http.StatusOK
+      }
+      fields := logging.Fields{
+        "method": req.Method,
+        "route": RequestRoute(req),
+        "path": req.URL.Path,
+        "status": status,
+        "latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+        "bytes": rec.bytes,
+      }
+      modelId := RequestModelId(req)
+      if modelId != "" {
+        fields["model"] = modelId
+      }
+      level := logging.Info
+      if status >= 500 {
+        level = logging.Error
+      }
+      logging.Log(req.Context(), level, "request", fields)
+    }()
+    handler.ServeHTTP(rec, req)
+  })
+}
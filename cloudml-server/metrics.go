@@ -0,0 +1,75 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/metrics"
+  "github.com/prometheus/client_golang/prometheus"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// statusRecorder remembers the status and size of a response.
+type statusRecorder struct {
+  http.ResponseWriter
+  status int
+  bytes int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+  if rec.status == 0 {
+    rec.status = status
+  }
+  rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+  if rec.status == 0 {
+    rec.status = http.StatusOK
+  }
+  n, err := rec.ResponseWriter.Write(b)
+  rec.bytes += n
+  return n, err
+}
+
+// MeasureRequests counts the requests to each route and their latency.
+func MeasureRequests(handler http.Handler) http.Handler {
+  return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+    start := time.Now()
+    route := RequestRoute(req)
+    rec := &statusRecorder{ResponseWriter: rw}
+    defer func() {
+      status := rec.status
+      if status == 0 {
+        status = http.StatusOK
+      }
+      metrics.Requests.WithLabelValues(route, req.Method, strconv.Itoa(status)).Inc()
+      metrics.RequestDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+    }()
+    handler.ServeHTTP(rec, req)
+  })
+}
+
+// registerJobMetrics exports the depth of the queue of background training
+// jobs and how many training jobs requests are running.
+func registerJobMetrics() {
+  prometheus.MustRegister(
+    prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+      Name: "cloudml_learn_queue_depth",
+      Help: "Background training jobs waiting for a worker.",
+    }, func() float64 {
+      return float64(len(learnChannel))
+    }),
+    prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+      Name: "cloudml_training_jobs_running",
+      Help: "Training and cross-validation requests running.",
+    }, func() float64 {
+      trainingJobs.Lock()
+      defer trainingJobs.Unlock()
+      running := 0
+      for _, n := range trainingJobs.running {
+        running += n
+      }
+      return float64(running)
+    }),
+  )
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/config"
+  "github.com/aotimme/cloudml/db"
+  "context"
+  "fmt"
+  "math"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// The quotas and the handlers of data reach the database through these; tests
+// replace them.
+var (
+  countModelsByTenant = db.CountModelsByTenant
+  getModelIdsByTenant = db.GetModelIdsByTenant
+  createData = (*db.Model).CreateData
+)
+
+// trainingRetry is the Retry-After of requests over their key's training
+// jobs, about as long as a training job takes.
+const trainingRetry = 10 * time.Second
+
+// KeyLimits returns the quotas of the key, 0 meaning no limit: the server's
+// defaults, overridden by those of the key.
+func KeyLimits(k *db.ApiKey) config.Limits {
+  l := conf.Limits
+  override := func(limit *int, value int) {
+    if value < 0 {
+      *limit = 0
+    } else if value > 0 {
+      *limit = value
+    }
+  }
+  if k.RateLimit < 0 {
+    l.RateLimit = 0
+  } else if k.RateLimit > 0 {
+    l.RateLimit = k.RateLimit
+  }
+  override(&l.MaxModels, k.MaxModels)
+  override(&l.MaxRowsPerModel, k.MaxRowsPerModel)
+  override(&l.MaxTrainingJobs, k.MaxTrainingJobs)
+  if l.RateBurst < 1 {
+    l.RateBurst = 1
+  }
+  return l
+}
+
+// SendTooMany responds with a 429, with a Retry-After if waiting helps.
+func SendTooMany(rw http.ResponseWriter, message string, retryAfter time.Duration, details interface{}) {
+  if retryAfter > 0 {
+    rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+  }
+  SendErrorDetails(rw, message, http.StatusTooManyRequests, details)
+}
+
+// bucket is a token bucket of a key's requests.
+type bucket struct {
+  tokens float64
+  last time.Time
+}
+
+var rateLimiter = struct {
+  sync.Mutex
+  buckets map[string]*bucket
+}{buckets: make(map[string]*bucket)}
+
+// takeRequest counts a request of the key against its rate. If the key is
+// over its rate it returns false and how long until it may try again.
+func takeRequest(k *db.ApiKey, l config.Limits) (bool, time.Duration) {
+  if l.RateLimit <= 0 {
+    return true, 0
+  }
+  rateLimiter.Lock()
+  defer rateLimiter.Unlock()
+  now := time.Now()
+  b, ok := rateLimiter.buckets[k.Id]
+  if !ok {
+    b = &bucket{tokens: float64(l.RateBurst), last: now}
+    rateLimiter.buckets[k.Id] = b
+  }
+  b.tokens = math.Min(float64(l.RateBurst), b.tokens + now.Sub(b.last).Seconds() * l.RateLimit)
+  b.last = now
+  if b.tokens < 1 {
+    return false, time.Duration((1 - b.tokens) / l.RateLimit * float64(time.Second))
+  }
+  b.tokens--
+  return true, 0
+}
+
+// remainingRequests returns how many requests the key may make right away.
+func remainingRequests(k *db.ApiKey, l config.Limits) int {
+  rateLimiter.Lock()
+  defer rateLimiter.Unlock()
+  b, ok := rateLimiter.buckets[k.Id]
+  if !ok {
+    return l.RateBurst
+  }
+  tokens := math.Min(float64(l.RateBurst), b.tokens + time.Since(b.last).Seconds() * l.RateLimit)
+  return int(tokens)
+}
+
+var trainingJobs = struct {
+  sync.Mutex
+  running map[string]int
+}{running: make(map[string]int)}
+
+// StartTraining takes one of the key's training jobs, responding with a 429
+// if it has none left. The job is given back with FinishTraining.
+func StartTraining(rw http.ResponseWriter, k *db.ApiKey) bool {
+  limit := KeyLimits(k).MaxTrainingJobs
+  trainingJobs.Lock()
+  defer trainingJobs.Unlock()
+  running := trainingJobs.running[k.Id]
+  if limit > 0 && running >= limit {
+    SendTooMany(rw, fmt.Sprintf("This key already has %v training jobs running", running), trainingRetry, map[string]int{"max_training_jobs": limit})
+    return false
+  }
+  trainingJobs.running[k.Id] = running + 1
+  return true
+}
+
+func FinishTraining(k *db.ApiKey) {
+  trainingJobs.Lock()
+  defer trainingJobs.Unlock()
+  trainingJobs.running[k.Id]--
+  if trainingJobs.running[k.Id] <= 0 {
+    delete(trainingJobs.running, k.Id)
+  }
+}
+
+func runningTrainingJobs(k *db.ApiKey) int {
+  trainingJobs.Lock()
+  defer trainingJobs.Unlock()
+  return trainingJobs.running[k.Id]
+}
+
+// CheckModelQuota responds with a 429 if the tenant of the key may not have
+// another model. Only deleting models frees the quota, so there is no
+// Retry-After.
+func CheckModelQuota(ctx context.Context, rw http.ResponseWriter, k *db.ApiKey) bool {
+  limit := KeyLimits(k).MaxModels
+  if limit <= 0 {
+    return true
+  }
+  n, err := countModelsByTenant(ctx, k.Tenant)
+  if err != nil {
+    SendDBError(rw, err)
+    return false
+  }
+  if n >= limit {
+    SendTooMany(rw, fmt.Sprintf("Tenant %v already has %v models", k.Tenant, n), 0, map[string]int{"max_models": limit})
+    return false
+  }
+  return true
+}
+
+// SendDataError responds to an error adding data, which are beyond the
+// key's limit of rows per model if it is of kind Quota.
+func SendDataError(rw http.ResponseWriter, err error, limit int) {
+  if db.KindOf(err) == db.Quota {
+    SendDBErrorDetails(rw, err, map[string]int{"max_rows_per_model": limit})
+    return
+  }
+  SendDBError(rw, err)
+}
+
+type Usage struct {
+  Tenant string `json:"tenant"`
+  Key string `json:"key"`
+  Limits UsageLimits `json:"limits"`
+  RemainingRequests *int `json:"remaining_requests,omitempty"`
+  Models int `json:"models"`
+  TrainingJobs int `json:"training_jobs"`
+  Rows map[string]int `json:"rows"`
+}
+
+// UsageLimits are the quotas of a key, 0 meaning no limit.
+type UsageLimits struct {
+  RateLimit float64 `json:"rate_limit"`
+  RateBurst int `json:"rate_burst"`
+  MaxModels int `json:"max_models"`
+  MaxRowsPerModel int `json:"max_rows_per_model"`
+  MaxTrainingJobs int `json:"max_training_jobs"`
+}
+
+// GetUsageHandler sends the quotas of the request's key and how much of them
+// is used, with the number of data of each model of its tenant.
+func GetUsageHandler(rw http.ResponseWriter, req *http.Request) {
+  k := RequestKey(req)
+  l := KeyLimits(k)
+  modelIds, err := getModelIdsByTenant(req.Context(), k.Tenant)
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  usage := &Usage{
+    Tenant: k.Tenant,
+    Key: k.Id,
+    Limits: UsageLimits(l),
+    Models: len(modelIds),
+    TrainingJobs: runningTrainingJobs(k),
+    Rows: make(map[string]int),
+  }
+  if l.RateLimit > 0 {
+    remaining := remainingRequests(k, l)
+    usage.RemainingRequests = &remaining
+  }
+  for _, id := range modelIds {
+    m, err := lookupModel(req.Context(), id)
+    if db.IsNotFound(err) {
+      continue
+    }
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    usage.Rows[id] = m.NumTrainingData
+  }
+  SendJSON(rw, usage)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/db"
+  "context"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+// stubModels serves the models of tenant "a", with their numbers of data, in
+// place of the database until the returned function is called.
+func stubModels(rows map[string]int) func() {
+  lookupModel = func(ctx context.Context, id string) (*db.Model, error) {
+    n, ok := rows[id]
+    if !ok {
+      return nil, &db.Error{Kind: db.NotFound, Message: "Model " + id + " not found"}
+    }
+    return &db.Model{Id: id, Tenant: "a", NumTrainingData: n}, nil
+  }
+  getModelIdsByTenant = func(ctx context.Context, tenant string) ([]string, error) {
+    var ids []string
+    for id := range rows {
+      ids = append(ids, id)
+    }
+    return ids, nil
+  }
+  countModelsByTenant = func(ctx context.Context, tenant string) (int, error) {
+    return len(rows), nil
+  }
+  return func() {
+    lookupModel = db.GetModelById
+    getModelIdsByTenant = db.GetModelIdsByTenant
+    countModelsByTenant = db.CountModelsByTenant
+  }
+}
+
+// errorDetails returns the details of an error response.
+func errorDetails(t *testing.T, rec *httptest.ResponseRecorder) map[string]float64 {
+  var response struct {
+    Error struct {
+      Details map[string]float64 `json:"details"`
+    } `json:"error"`
+  }
+  err := json.Unmarshal(rec.Body.Bytes(), &response)
+  if err != nil {
+    t.Fatalf("decoding error %v: %v", rec.Body.String(), err)
+  }
+  return response.Error.Details
+}
+
+func TestRateLimit(t *testing.T) {
+  var deleted []string
+  defer stubKeys(&deleted)()
+  defer stubModels(map[string]int{})()
+  testKeys["limited-a"] = &db.ApiKey{Id: "8", Tenant: "a", Role: db.RoleReader, RateLimit: 1}
+  defer delete(testKeys, "limited-a")
+  burst := conf.Limits.RateBurst
+  conf.Limits.RateBurst = 2
+  defer func() {
+    conf.Limits.RateBurst = burst
+  }()
+
+  for i := 0; i < 2; i++ {
+    rec := serve("GET", "/api/usage", "limited-a", "")
+    if rec.Code != http.StatusOK {
+      t.Fatalf("request %v within the burst: expected 200, got %v: %v", i, rec.Code, rec.Body.String())
+    }
+  }
+  rec := serve("GET", "/api/usage", "limited-a", "")
+  if rec.Code != http.StatusTooManyRequests {
+    t.Fatalf("request beyond the burst: expected 429, got %v: %v", rec.Code, rec.Body.String())
+  }
+  if rec.Header().Get("Retry-After") != "1" {
+    t.Errorf("expected a Retry-After of 1, got %q", rec.Header().Get("Retry-After"))
+  }
+  if errorDetails(t, rec)["rate_limit"] != 1 {
+    t.Errorf("expected the rate limit in the details, got %v", rec.Body.String())
+  }
+  // other keys have their own rate
+  rec = serve("GET", "/api/usage", "reader-a", "")
+  if rec.Code != http.StatusOK {
+    t.Errorf("request of another key: expected 200, got %v", rec.Code)
+  }
+}
+
+func TestModelQuota(t *testing.T) {
+  defer stubModels(map[string]int{"m1": 0, "m2": 0})()
+  tests := []struct {
+    maxModels int
+    ok bool
+  }{
+    {3, true},
+    {2, false},
+    {-1, true},
+  }
+  for _, test := range tests {
+    k := &db.ApiKey{Tenant: "a", Role: db.RoleTrainer, MaxModels: test.maxModels}
+    rec := httptest.NewRecorder()
+    ok := CheckModelQuota(context.Background(), rec, k)
+    if ok != test.ok {
+      t.Errorf("2 models with a limit of %v: expected %v, got %v", test.maxModels, test.ok, ok)
+    }
+    if !ok && (rec.Code != http.StatusTooManyRequests || errorDetails(t, rec)["max_models"] != 2) {
+      t.Errorf("2 models with a limit of %v: expected 429, got %v: %v", test.maxModels, rec.Code, rec.Body.String())
+    }
+  }
+}
+
+func TestRowQuota(t *testing.T) {
+  var deleted []string
+  defer stubKeys(&deleted)()
+  defer stubModels(map[string]int{"abc": 3})()
+  testKeys["rows-a"] = &db.ApiKey{Id: "9", Tenant: "a", Role: db.RoleWriter, RateLimit: -1, MaxRowsPerModel: 4}
+  defer delete(testKeys, "rows-a")
+  var limits []int
+  createData = func(m *db.Model, ctx context.Context, covMaps []map[string]float64, data []*db.Datum, maxRows int) error {
+    limits = append(limits, maxRows)
+    if m.NumTrainingData + len(data) > maxRows {
+      return &db.Error{Kind: db.Quota, Message: fmt.Sprintf("Model %v is full", m.Id)}
+    }
+    return nil
+  }
+  defer func() {
+    createData = (*db.Model).CreateData
+  }()
+
+  rec := serve("POST", "/api/models/abc/data", "rows-a", `[{"value": 1}, {"value": 2}]`)
+  if rec.Code != http.StatusTooManyRequests {
+    t.Fatalf("data beyond the quota: expected 429, got %v: %v", rec.Code, rec.Body.String())
+  }
+  if errorDetails(t, rec)["max_rows_per_model"] != 4 {
+    t.Errorf("expected the rows limit in the details, got %v", rec.Body.String())
+  }
+  if len(limits) != 1 || limits[0] != 4 {
+    t.Errorf("expected the key's limit of 4 to be enforced when saving, got %v", limits)
+  }
+}
+
+func TestUsage(t *testing.T) {
+  var deleted []string
+  defer stubKeys(&deleted)()
+  defer stubModels(map[string]int{"m1": 5, "m2": 7})()
+  testKeys["usage-a"] = &db.ApiKey{Id: "10", Tenant: "a", Role: db.RoleReader, RateLimit: 10, MaxModels: 3, MaxRowsPerModel: -1}
+  defer delete(testKeys, "usage-a")
+
+  rec := serve("GET", "/api/usage", "usage-a", "")
+  if rec.Code != http.StatusOK {
+    t.Fatalf("expected 200, got %v: %v", rec.Code, rec.Body.String())
+  }
+  var usage Usage
+  err := json.Unmarshal(rec.Body.Bytes(), &usage)
+  if err != nil {
+    t.Fatalf("decoding usage %v: %v", rec.Body.String(), err)
+  }
+  if usage.Tenant != "a" || usage.Key != "10" {
+    t.Errorf("expected the usage of key 10 of tenant a, got %+v", usage)
+  }
+  if usage.Limits.RateLimit != 10 || usage.Limits.MaxModels != 3 || usage.Limits.MaxRowsPerModel != 0 {
+    t.Errorf("expected the key's limits, got %+v", usage.Limits)
+  }
+  if usage.RemainingRequests == nil || *usage.RemainingRequests != conf.Limits.RateBurst - 1 {
+    t.Errorf("expected %v remaining requests, got %v", conf.Limits.RateBurst - 1, usage.RemainingRequests)
+  }
+  if usage.Models != 2 || usage.Rows["m1"] != 5 || usage.Rows["m2"] != 7 {
+    t.Errorf("expected 2 models of 5 and 7 data, got %v and %v", usage.Models, usage.Rows)
+  }
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+  "github.com/gorilla/mux"
+  "context"
+  "net/http"
+  "strings"
+)
+
+const routeContextKey contextKey = 1
+
+// learnRoutes are the routes that train or cross-validate, which get
+// learn-timeout rather than request-timeout.
+var learnRoutes = map[string]bool{
+  "/api/models/{id}/learn": true,
+  "/api/models/{id}/cv": true,
+}
+
+// route is the template of the route a request matches and the variables
+// of its path.
+type route struct {
+  template string
+  vars map[string]string
+}
+
+// matchRoute returns the route of r matching req, with the template
+// "unmatched" if there is none.
+func matchRoute(r *mux.Router, req *http.Request) *route {
+  var match mux.RouteMatch
+  if r.Match(req, &match) && match.Route != nil {
+    template, err := match.Route.GetPathTemplate()
+    if err == nil {
+      return &route{template: template, vars: match.Vars}
+    }
+  }
+  return &route{template: "unmatched"}
+}
+
+// SetRoute finds the route of r that each request matches, for RequestRoute
+// and RequestModelId.
+func SetRoute(r *mux.Router, handler http.Handler) http.Handler {
+  return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+    ctx := context.WithValue(req.Context(), routeContextKey, matchRoute(r, req))
+    handler.ServeHTTP(rw, req.WithContext(ctx))
+  })
+}
+
+// RequestRoute returns the template of the route of a request passed through
+// SetRoute, such as "/api/models/{id}".
+func RequestRoute(req *http.Request) string {
+  rt, ok := req.Context().Value(routeContextKey).(*route)
+  if !ok {
+    return "unmatched"
+  }
+  return rt.template
+}
+
+// RequestModelId returns the id of the model in the path of a request passed
+// through SetRoute, or "" if its route is not that of a model.
+func RequestModelId(req *http.Request) string {
+  rt, ok := req.Context().Value(routeContextKey).(*route)
+  if !ok || !strings.HasPrefix(rt.template, "/api/models/{id}") {
+    return ""
+  }
+  return rt.vars["id"]
+}
+
+// LimitRequestTime cancels the context of requests after request-timeout, or
+// learn-timeout for those that train. The database queries and training of
+// the request then stop and it fails with a 503.
+func LimitRequestTime(handler http.Handler) http.Handler {
+  return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+    timeout := conf.RequestTimeout
+    if learnRoutes[RequestRoute(req)] {
+      timeout = conf.LearnTimeout
+    }
+    if timeout <= 0 {
+      handler.ServeHTTP(rw, req)
+      return
+    }
+    ctx, cancel := context.WithTimeout(req.Context(), timeout)
+    defer cancel()
+    handler.ServeHTTP(rw, req.WithContext(ctx))
+  })
+}
+
+// learnTimeout bounds ctx by learn-timeout, if set, for background training.
+func learnTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+  if conf.LearnTimeout <= 0 {
+    return context.WithCancel(ctx)
+  }
+  return context.WithTimeout(ctx, conf.LearnTimeout)
+}
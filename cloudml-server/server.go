@@ -1,49 +1,185 @@
 package main
 
 import (
+  "github.com/aotimme/cloudml/config"
   "github.com/aotimme/cloudml/db"
+  "github.com/aotimme/cloudml/export"
+  "github.com/aotimme/cloudml/logging"
+  "github.com/aotimme/cloudml/metrics"
   "net/http"
   "github.com/gorilla/mux"
-  "log"
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+  "context"
+  "crypto/rand"
+  "encoding/hex"
   "encoding/json"
+  "errors"
+  "flag"
   "fmt"
+  "math"
+  "os"
+  "runtime/debug"
+  "strconv"
+  "strings"
+  "sync/atomic"
+  "syscall"
+  "time"
+  "io/ioutil"
+  "os/signal"
 )
 
-var learnChannel chan string = make(chan string, 1000)
+// conf holds the settings the server was started with.
+var conf = config.Default()
 
+// ErrorResponse is the body of every error response. Code names the status
+// (see errorCodes), Details holds anything more specific, such as the index
+// of the failing datum of a batch, and RequestId matches the X-Request-ID
+// header.
 type ErrorResponse struct {
-  Error string `json:"error"`
+  Error ErrorBody `json:"error"`
+}
+type ErrorBody struct {
+  Code string `json:"code"`
+  Message string `json:"message"`
+  Details interface{} `json:"details,omitempty"`
+  RequestId string `json:"request_id"`
 }
 type PreModel struct {
   Type string `json:"type"`
+  Family string `json:"family"`
+  Link string `json:"link"`
+  Robust bool `json:"robust"`
+  HuberK float64 `json:"huber_k"`
+  Quantile float64 `json:"quantile"`
+  PriorPrecision float64 `json:"prior_precision"`
+  NoiseVariance float64 `json:"noise_variance"`
+  EmpiricalBayes bool `json:"empirical_bayes"`
   Covariates []string `json:"covariates"`
   Lambda float64 `json:"lambda"`
+  Classes []string `json:"classes"`
+  Levels []float64 `json:"levels"`
 }
 type PreDatum struct {
   Value float64 `json:"value"`
   Covariates map[string]float64 `json:"covariates"`
+  Weight *float64 `json:"weight"`
+  Offset float64 `json:"offset"`
+  Exposure *float64 `json:"exposure"`
+  Class string `json:"class"`
+  Duration float64 `json:"duration"`
+  Event bool `json:"event"`
+  Times []float64 `json:"times"`
 }
 
+// GetDBDatum converts pre into a datum ready for db.Model.CreateDatum.
+func GetDBDatum(pre PreDatum) (*db.Datum, error) {
+  weight, offset, err := GetWeightAndOffset(pre)
+  if err != nil {
+    return nil, err
+  }
+  return &db.Datum{
+    Value: pre.Value,
+    Weight: weight,
+    Offset: offset,
+    Class: pre.Class,
+    Duration: pre.Duration,
+    Event: pre.Event,
+  }, nil
+}
+
+// GetWeightAndOffset returns the datum's weight (1 if unset) and offset. An
+// exposure is added to the offset on the log scale.
+func GetWeightAndOffset(pre PreDatum) (float64, float64, error) {
+  return db.GetWeightAndOffset(pre.Weight, pre.Offset, pre.Exposure)
+}
+var errorCodes = map[int]string{
+  http.StatusBadRequest: "bad_request",
+  http.StatusUnauthorized: "unauthorized",
+  http.StatusForbidden: "forbidden",
+  http.StatusNotFound: "not_found",
+  http.StatusConflict: "conflict",
+  http.StatusRequestEntityTooLarge: "request_too_large",
+  http.StatusUnprocessableEntity: "unprocessable",
+  http.StatusTooManyRequests: "too_many_requests",
+  http.StatusInternalServerError: "internal",
+  http.StatusServiceUnavailable: "timeout",
+}
+
+// kindStatus is the status of each kind of db error.
+var kindStatus = map[db.Kind]int{
+  db.Internal: http.StatusInternalServerError,
+  db.Invalid: http.StatusBadRequest,
+  db.NotFound: http.StatusNotFound,
+  db.Conflict: http.StatusConflict,
+  db.Unprocessable: http.StatusUnprocessableEntity,
+  db.Canceled: http.StatusServiceUnavailable,
+  db.Quota: http.StatusTooManyRequests,
+}
 
 func SendError(rw http.ResponseWriter, message string, statusCode int) {
-  response := &ErrorResponse{Error: message}
+  SendErrorDetails(rw, message, statusCode, nil)
+}
+
+func SendErrorDetails(rw http.ResponseWriter, message string, statusCode int, details interface{}) {
+  code, ok := errorCodes[statusCode]
+  if !ok {
+    code = strings.Replace(strings.ToLower(http.StatusText(statusCode)), " ", "_", -1)
+  }
+  response := &ErrorResponse{Error: ErrorBody{
+    Code: code,
+    Message: message,
+    Details: details,
+    RequestId: rw.Header().Get("X-Request-ID"),
+  }}
   jsonData, err := json.Marshal(response)
   if err != nil {
     http.Error(rw, err.Error(), http.StatusInternalServerError)
     return
   }
-  log.Printf("sending error %v", string(jsonData))
+  ctx := logging.WithRequestId(context.Background(), response.Error.RequestId)
+  logging.Debugf(ctx, "Sending error %v", string(jsonData))
   rw.Header().Set("Content-Type", "application/json")
   rw.WriteHeader(statusCode)
   rw.Write(jsonData)
 }
 
-func GetDatumById(datumId string) (*Datum, error) {
-  datum, err := db.GetDatumById(datumId)
+// SendDBError responds with the status of the kind of err. The messages of
+// internal and canceled errors are logged rather than sent.
+func SendDBError(rw http.ResponseWriter, err error) {
+  SendDBErrorDetails(rw, err, nil)
+}
+
+func SendDBErrorDetails(rw http.ResponseWriter, err error, details interface{}) {
+  statusCode := kindStatus[db.KindOf(err)]
+  message := err.Error()
+  ctx := logging.WithRequestId(context.Background(), rw.Header().Get("X-Request-ID"))
+  if statusCode == http.StatusInternalServerError {
+    logging.Errorf(ctx, "Internal error: %v", err)
+    message = "Internal server error"
+  } else if statusCode == http.StatusServiceUnavailable {
+    logging.Warnf(ctx, "Canceled: %v", err)
+    message = "Request timed out or was canceled"
+  }
+  SendErrorDetails(rw, message, statusCode, details)
+}
+
+// SendDecodeError responds to a request body that could not be decoded,
+// which is too large if LimitRequestSize cut it short.
+func SendDecodeError(rw http.ResponseWriter, err error, what string) {
+  if err.Error() == "http: request body too large" {
+    SendError(rw, fmt.Sprintf("Request body exceeds %v bytes", conf.MaxRequestBytes), http.StatusRequestEntityTooLarge)
+    return
+  }
+  SendError(rw, fmt.Sprintf("Malformed %v: %v", what, err), http.StatusBadRequest)
+}
+
+func GetDatumById(ctx context.Context, datumId string) (*Datum, error) {
+  datum, err := db.GetDatumById(ctx, datumId)
   if err != nil {
     return nil, err
   }
-  covariates, err := datum.GetCovariates()
+  covariates, err := datum.GetCovariates(ctx)
   if err != nil {
     return nil, err
   }
@@ -60,26 +196,31 @@ func GetDatumById(datumId string) (*Datum, error) {
     Id: datum.Id,
     Model: datum.Model,
     Value: datum.Value,
+    Weight: datum.Weight,
+    Offset: datum.Offset,
+    Class: datum.Class,
+    Duration: datum.Duration,
+    Event: datum.Event,
     Covariates: covs,
   }
   return d, nil
 }
-func SendDatumById(rw http.ResponseWriter, datumId string) {
-  d, err := GetDatumById(datumId)
+func SendDatumById(rw http.ResponseWriter, req *http.Request, datumId string) {
+  d, err := GetDatumById(req.Context(), datumId)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
   jsonData, err := json.Marshal(d)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
   rw.Header().Set("Content-Type", "application/json")
   rw.Write(jsonData)
 }
 
-func GetModelFromDBModelAndCoefficients(m *db.Model, cs []db.Coefficient) (*Model) {
+func GetModelFromDBModelAndCoefficients(m *db.Model, cs []db.Coefficient, params *db.Parameters) (*Model) {
   coefficients := make([]Coefficient, len(cs))
   for i, c := range cs {
     coefficients[i] = Coefficient{
@@ -87,61 +228,110 @@ func GetModelFromDBModelAndCoefficients(m *db.Model, cs []db.Coefficient) (*Mode
       Model: c.Model,
       Label: c.Label,
       Value: c.Value,
+      Source: c.Source,
     }
   }
-  return &Model{
+  var classCoefficients []ClassCoefficient
+  for _, c := range params.ClassCoefficients {
+    classCoefficients = append(classCoefficients, ClassCoefficient{
+      Id: c.Id,
+      Model: c.Model,
+      Class: c.Class,
+      Label: c.Label,
+      Value: c.Value,
+    })
+  }
+  var thresholds []Threshold
+  for _, t := range params.Thresholds {
+    thresholds = append(thresholds, Threshold{
+      Id: t.Id,
+      Model: t.Model,
+      Lower: t.Lower,
+      Upper: t.Upper,
+      Value: t.Value,
+    })
+  }
+  model := &Model{
     Id: m.Id,
+    Tenant: m.Tenant,
     Type: m.Type,
+    Family: m.Family,
+    Link: m.Link,
+    Robust: m.Robust,
+    HuberK: m.HuberK,
     Lambda: m.Lambda,
     NumTrainingData: m.NumTrainingData,
+    SumWeights: m.SumWeights,
     NumCovariates: m.NumCovariates,
-    TrainRmse: m.TrainRmse,
-    CvRmse: m.CvRmse,
+    Version: m.Version,
+    NumVersions: m.NumVersions,
+    Intercept: m.Intercept,
     Coefficients: coefficients,
+    Classes: db.GetClasses(params.ClassCoefficients),
+    ClassCoefficients: classCoefficients,
+    Levels: db.GetLevels(params.Thresholds),
+    Thresholds: thresholds,
   }
+  if m.Type == "bayesian_linear" {
+    model.PriorPrecision = m.PriorPrecision
+    model.NoiseVariance = m.NoiseVariance
+    model.EmpiricalBayes = m.EmpiricalBayes
+    model.Covariance = db.GetPosteriorCovarianceArray(m, params.PosteriorCovariances)
+  }
+  // quantile models report the pinball loss and cox models the concordance
+  // in place of the RMSE
+  if m.Type == "quantile" {
+    model.Quantile = m.Quantile
+    model.TrainPinball = &m.TrainPinball
+    model.CvPinball = &m.CvPinball
+  } else if m.Type == "cox" {
+    model.TrainConcordance = &m.TrainConcordance
+    model.CvConcordance = &m.CvConcordance
+  } else {
+    model.TrainRmse = &m.TrainRmse
+    model.CvRmse = &m.CvRmse
+  }
+  return model
 }
-func GetModelById(modelId string) (*Model, error) {
-  model, coefficients, err := db.GetModelAndCoefficientsById(modelId)
+func GetModelById(ctx context.Context, modelId string) (*Model, error) {
+  model, coefficients, err := db.GetModelAndCoefficientsById(ctx, modelId)
   if err != nil {
     return nil, err
   }
-  if model == nil {
-    return nil, nil
+  params, err := model.GetParameters(ctx)
+  if err != nil {
+    return nil, err
   }
-  m := GetModelFromDBModelAndCoefficients(model, coefficients)
+  m := GetModelFromDBModelAndCoefficients(model, coefficients, params)
   return m, nil
 }
-func SendModelById(rw http.ResponseWriter, modelId string) {
-  m, err := GetModelById(modelId)
+func SendModelById(rw http.ResponseWriter, req *http.Request, modelId string) {
+  m, err := GetModelById(req.Context(), modelId)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
-    return
-  }
-  if m == nil {
-    http.Error(rw, "Not Found", http.StatusNotFound)
+    SendDBError(rw, err)
     return
   }
   jsonData, err := json.Marshal(m)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
   rw.Header().Set("Content-Type", "application/json")
   rw.Write(jsonData)
 }
-func SendAllModelsByIds(rw http.ResponseWriter, modelIds []string) {
+func SendAllModelsByIds(rw http.ResponseWriter, req *http.Request, modelIds []string) {
   models := make([]*Model, len(modelIds))
   for i, modelId := range modelIds {
-    m, err := GetModelById(modelId)
+    m, err := GetModelById(req.Context(), modelId)
     if err != nil {
-      http.Error(rw, err.Error(), http.StatusInternalServerError)
+      SendDBError(rw, err)
       return
     }
     models[i] = m
   }
   jsonData, err := json.Marshal(models)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
   rw.Header().Set("Content-Type", "application/json")
@@ -151,7 +341,7 @@ func SendAllModelsByIds(rw http.ResponseWriter, modelIds []string) {
 func SendDatumJSON(rw http.ResponseWriter, d *db.Datum) {
   jsonData, err := json.Marshal(d)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
   rw.Header().Set("Content-Type", "application/json")
@@ -160,80 +350,136 @@ func SendDatumJSON(rw http.ResponseWriter, d *db.Datum) {
 func SendDataJSON(rw http.ResponseWriter, ds []*Datum) {
   jsonData, err := json.Marshal(ds)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
   rw.Header().Set("Content-Type", "application/json")
   rw.Write(jsonData)
 }
 
+func NotFoundHandler(rw http.ResponseWriter, req *http.Request) {
+  SendError(rw, fmt.Sprintf("No route for %v %v", req.Method, req.URL.Path), http.StatusNotFound)
+}
+
 func IndexHandler(rw http.ResponseWriter, req *http.Request) {
-  log.Println("Handling GET \"/\"")
   rw.Write([]byte("OK"))
 }
 
 func CreateModelHandler(rw http.ResponseWriter, req *http.Request) {
-  log.Printf("Handling POST \"/api/models\"\n")
   decoder := json.NewDecoder(req.Body)
   var pre PreModel
   err := decoder.Decode(&pre)
   if err != nil {
-    log.Printf(err.Error());
-    SendError(rw, "Malformed model data", http.StatusBadRequest);
-    //http.Error(rw, err.Error(), http.StatusBadRequest)
+    SendDecodeError(rw, err, "model data")
+    return
+  }
+  if !CheckModelQuota(req.Context(), rw, RequestKey(req)) {
     return
   }
   m := &db.Model{
+    Tenant: RequestKey(req).Tenant,
     Type: pre.Type,
+    Family: pre.Family,
+    Link: pre.Link,
+    Robust: pre.Robust,
+    HuberK: pre.HuberK,
+    Quantile: pre.Quantile,
+    PriorPrecision: pre.PriorPrecision,
+    NoiseVariance: pre.NoiseVariance,
+    EmpiricalBayes: pre.EmpiricalBayes,
     Lambda: pre.Lambda,
   }
-  coefficients := make([]db.Coefficient, len(pre.Covariates))
-  for i, covariate := range pre.Covariates {
-    coefficients[i].Label = covariate
-    coefficients[i].Value = 0.0
-  }
+  fit, err := db.NewFit(m, pre.Covariates, pre.Classes, pre.Levels)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusBadRequest)
+    SendDBError(rw, err)
     return
   }
-  log.Printf("Creating model: %v\n", m)
-  err = m.SaveWithCoefficients(coefficients)
+  logging.Debugf(req.Context(), "Creating model: %v", m)
+  err = m.SaveWithParameters(req.Context(), fit.Coefficients, fit.Parameters)
   if err == nil {
-    log.Printf("Successfully created model: %v\n", m)
+    logging.Infof(req.Context(), "Created model %v", m.Id)
   } else {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
 
-  SendModelById(rw, m.Id)
+  SendModelById(rw, req, m.Id)
+}
+
+// ImportModelHandler creates a model from coefficients fitted elsewhere, sent
+// in the export JSON format or, with an XML content type, as PMML.
+func ImportModelHandler(rw http.ResponseWriter, req *http.Request) {
+  if !CheckModelQuota(req.Context(), rw, RequestKey(req)) {
+    return
+  }
+  body, err := ioutil.ReadAll(req.Body)
+  if err != nil {
+    SendDecodeError(rw, err, "model")
+    return
+  }
+  var e *export.Model
+  contentType := req.Header.Get("Content-Type")
+  if strings.Contains(contentType, "xml") || strings.HasPrefix(strings.TrimSpace(string(body)), "<") {
+    e, err = export.ParsePMML(body)
+  } else {
+    e = &export.Model{}
+    err = json.Unmarshal(body, e)
+  }
+  if err != nil {
+    SendError(rw, fmt.Sprintf("Malformed model: %v", err), http.StatusBadRequest)
+    return
+  }
+  m, coefficients, params, err := e.ToDB()
+  if err != nil {
+    SendError(rw, err.Error(), http.StatusBadRequest)
+    return
+  }
+  m.Tenant = RequestKey(req).Tenant
+  err = m.Import(req.Context(), coefficients, params)
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  logging.Infof(req.Context(), "Imported model %v", m.Id)
+  SendModelById(rw, req, m.Id)
 }
 
 func GetModelsHandler(rw http.ResponseWriter, req *http.Request) {
-  log.Printf("Handling GET \"/api/models\"\n")
-  modelIds, err := db.GetAllModelIds()
+  // super admin keys list every model
+  k := RequestKey(req)
+  var modelIds []string
+  var err error
+  if k.IsSuperAdmin() {
+    modelIds, err = db.GetAllModelIds(req.Context())
+  } else {
+    modelIds, err = db.GetModelIdsByTenant(req.Context(), k.Tenant)
+  }
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusNotFound)
+    SendDBError(rw, err)
     return
   }
-  SendAllModelsByIds(rw, modelIds)
+  SendAllModelsByIds(rw, req, modelIds)
 }
 
 
 func GetModelHandler(rw http.ResponseWriter, req *http.Request) {
-  vars := mux.Vars(req)
-  id := vars["id"]
-  log.Printf("Handling GET \"/api/models/%v\"\n", id)
-  SendModelById(rw, id)
-  //SendError(rw, fmt.Sprintf("Could not find model with id %v", id), http.StatusNotFound)
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
+    return
+  }
+  SendModelById(rw, req, m.Id)
 }
 
 func DeleteModelHandler(rw http.ResponseWriter, req *http.Request) {
   vars := mux.Vars(req)
   id := vars["id"]
-  log.Printf("Handling DELETE \"/api/models/%v\"\n", id)
-  err := db.DeleteModelById(id)
+  _, ok := GetRequestModel(rw, req)
+  if !ok {
+    return
+  }
+  err := db.DeleteModelById(req.Context(), id)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
   rw.Header().Set("Content-Type", "application/json")
@@ -241,64 +487,78 @@ func DeleteModelHandler(rw http.ResponseWriter, req *http.Request) {
 }
 
 func CreateDatumHandler(rw http.ResponseWriter, req *http.Request) {
-  vars := mux.Vars(req)
-  id := vars["id"]
-  log.Printf("Handling POST \"/api/models/%v/datum\"\n", id)
-  m, err := db.GetModelById(id)
-  if err != nil {
-    http.Error(rw, err.Error(), http.StatusNotFound)
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
     return
   }
   decoder := json.NewDecoder(req.Body)
   var pre PreDatum
-  err = decoder.Decode(&pre)
+  err := decoder.Decode(&pre)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusBadRequest)
+    SendDecodeError(rw, err, "datum")
     return
   }
-  d, err := m.CreateDatum(pre.Covariates, pre.Value)
+  d, err := GetDBDatum(pre)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
+    return
+  }
+  limit := KeyLimits(RequestKey(req)).MaxRowsPerModel
+  d, err = m.CreateDatum(req.Context(), pre.Covariates, d, limit)
+  if err != nil {
+    SendDataError(rw, err, limit)
     return
   }
   //XXX(Alden): enable async learning?
   //learnChannel <- m.Id
-  SendDatumById(rw, d.Id)
+  SendDatumById(rw, req, d.Id)
 }
 
 func CreateDataHandler(rw http.ResponseWriter, req *http.Request) {
-  vars := mux.Vars(req)
-  id := vars["id"]
-  log.Printf("Handling POST \"/api/models/%v/data\"\n", id)
-  m, err := db.GetModelById(id)
-  if err != nil {
-    http.Error(rw, err.Error(), http.StatusNotFound)
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
     return
   }
   decoder := json.NewDecoder(req.Body)
   var pres []PreDatum
-  err = decoder.Decode(&pres)
+  err := decoder.Decode(&pres)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusBadRequest)
+    SendDecodeError(rw, err, "data")
+    return
+  }
+  if len(pres) > conf.MaxBatchRows {
+    SendError(rw, fmt.Sprintf("At most %v data may be sent at once", conf.MaxBatchRows), http.StatusRequestEntityTooLarge)
     return
   }
   ds := make([]*db.Datum, len(pres))
+  covMaps := make([]map[string]float64, len(pres))
   for i, pre := range pres {
-    d, err := m.CreateDatum(pre.Covariates, pre.Value)
+    ds[i], err = GetDBDatum(pre)
     if err != nil {
-      http.Error(rw, err.Error(), http.StatusBadRequest)
+      SendDBErrorDetails(rw, err, map[string]int{"index": i})
       return
     }
-    ds[i] = d
+    covMaps[i] = pre.Covariates
+  }
+  limit := KeyLimits(RequestKey(req)).MaxRowsPerModel
+  err = createData(m, req.Context(), covMaps, ds, limit)
+  var datumErr *db.DatumError
+  if errors.As(err, &datumErr) {
+    SendDBErrorDetails(rw, err, map[string]int{"index": datumErr.Index})
+    return
+  }
+  if err != nil {
+    SendDataError(rw, err, limit)
+    return
   }
   //XXX(Alden): enable async learning?
   //learnChannel <- m.Id
   // TODO: Actually get data (with covariates) and send
   data := make([]*Datum, len(ds))
   for i, datum := range ds {
-    data[i], err = GetDatumById(datum.Id)
+    data[i], err = GetDatumById(req.Context(), datum.Id)
     if err != nil {
-      http.Error(rw, err.Error(), http.StatusInternalServerError)
+      SendDBError(rw, err)
       return
     }
   }
@@ -306,94 +566,335 @@ func CreateDataHandler(rw http.ResponseWriter, req *http.Request) {
 }
 
 func LearnModelHandler(rw http.ResponseWriter, req *http.Request) {
-  vars := mux.Vars(req)
-  id := vars["id"]
-  log.Printf("Handling POST \"/api/models/%v/learn\"\n", id)
-  m, err := db.GetModelById(id)
-  if err != nil {
-    http.Error(rw, err.Error(), http.StatusNotFound)
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
     return
   }
-  err = m.Learn()
+  k := RequestKey(req)
+  if !StartTraining(rw, k) {
+    return
+  }
+  defer FinishTraining(k)
+  err := learnInForeground(req.Context(), m)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
-  SendModelById(rw, m.Id)
+  SendModelById(rw, req, m.Id)
 }
 
 func CVModelHandler(rw http.ResponseWriter, req *http.Request) {
-  vars := mux.Vars(req)
-  id := vars["id"]
-  log.Printf("Handling POST \"/api/models/%v/cv\"\n", id)
-  m, err := db.GetModelById(id)
-  if err != nil {
-    http.Error(rw, err.Error(), http.StatusNotFound)
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
+    return
+  }
+  k := RequestKey(req)
+  if !StartTraining(rw, k) {
     return
   }
-  err = m.CV()
+  defer FinishTraining(k)
+  err := m.CV(req.Context())
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
-  SendModelById(rw, m.Id)
+  SendModelById(rw, req, m.Id)
 }
 
 
 func PredictModelHandler(rw http.ResponseWriter, req *http.Request) {
-  vars := mux.Vars(req)
-  id := vars["id"]
-  log.Printf("Handling PUT \"/api/models/%v/learn\"\n", id)
-  m, err := db.GetModelById(id)
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
+    return
+  }
+  fit, err := m.GetFit(req.Context())
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusNotFound)
+    SendDBError(rw, err)
     return
   }
+  SendPrediction(rw, req, fit)
+}
+
+// SendPrediction responds with the prediction of fit for the datum in the
+// request body.
+func SendPrediction(rw http.ResponseWriter, req *http.Request, fit *db.Fit) {
   decoder := json.NewDecoder(req.Body)
   var pre PreDatum
-  err = decoder.Decode(&pre)
+  err := decoder.Decode(&pre)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusBadRequest)
+    SendDecodeError(rw, err, "datum")
     return
   }
 
-  prediction, err := m.Predict(pre.Covariates)
-  if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
-    return
+  m := fit.Model
+  var resp interface{}
+  if m.Type == "multinomial" {
+    probabilities, class, err := fit.PredictClasses(pre.Covariates)
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    resp = &ClassPrediction{
+      Class: class,
+      Probabilities: probabilities,
+    }
+  } else if m.Type == "ordinal" {
+    _, offset, err := GetWeightAndOffset(pre)
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    levels, cumulative, probabilities, err := fit.PredictLevels(pre.Covariates, offset)
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    prediction := &LevelPrediction{
+      Levels: levels,
+      Cumulative: cumulative,
+      Probabilities: probabilities,
+    }
+    for k, prob := range probabilities {
+      if k == 0 || prob > prediction.Probability {
+        prediction.Level = levels[k]
+        prediction.Probability = prob
+      }
+    }
+    resp = prediction
+  } else if m.Type == "bayesian_linear" {
+    _, offset, err := GetWeightAndOffset(pre)
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    value, variance, err := fit.PredictPosterior(pre.Covariates, offset)
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    stdDev := math.Sqrt(variance)
+    resp = &PosteriorPrediction{
+      Value: value,
+      Variance: variance,
+      StdDev: stdDev,
+      Lower: value - 1.96 * stdDev,
+      Upper: value + 1.96 * stdDev,
+    }
+  } else if m.Type == "cox" {
+    _, offset, err := GetWeightAndOffset(pre)
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    relativeHazard, survival, err := fit.PredictSurvival(pre.Covariates, offset, pre.Times)
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    resp = &SurvivalPrediction{
+      RelativeHazard: relativeHazard,
+      Times: pre.Times,
+      Survival: survival,
+    }
+  } else {
+    _, offset, err := GetWeightAndOffset(pre)
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    prediction, err := fit.Predict(pre.Covariates, offset)
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    resp = map[string]float64{"value": prediction}
   }
-  resp := make(map[string]float64)
-  resp["value"] = prediction
+  metrics.Predictions.WithLabelValues(m.Type).Inc()
 
   jsonData, err := json.Marshal(resp)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
   rw.Header().Set("Content-Type", "application/json")
   rw.Write(jsonData)
 }
 
-func GetDataHandler(rw http.ResponseWriter, req *http.Request) {
+// ExportModelHandler sends the model (or, given ?version=, one of its
+// versions) in the portable JSON format or as PMML.
+func ExportModelHandler(rw http.ResponseWriter, req *http.Request) {
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
+    return
+  }
+  query := req.URL.Query()
+  var fit *db.Fit
+  var err error
+  if query.Get("version") != "" {
+    var version int
+    version, err = strconv.Atoi(query.Get("version"))
+    if err != nil {
+      SendError(rw, fmt.Sprintf("Invalid version %q", query.Get("version")), http.StatusBadRequest)
+      return
+    }
+    var v *db.ModelVersion
+    v, err = m.GetVersion(req.Context(), version)
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+    fit, err = v.GetFit(req.Context(), m)
+  } else {
+    fit, err = m.GetFit(req.Context())
+  }
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  intercept, err := m.GetIntercept(req.Context())
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  e := export.FromFit(fit, intercept)
+  switch query.Get("format") {
+  case "", "json":
+    rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v.json", m.Id))
+    SendJSON(rw, e)
+  case "pmml":
+    data, err := export.PMML(e)
+    if err != nil {
+      SendError(rw, err.Error(), http.StatusBadRequest)
+      return
+    }
+    rw.Header().Set("Content-Type", "application/xml")
+    rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v.pmml", m.Id))
+    rw.Write(data)
+  default:
+    SendError(rw, fmt.Sprintf("Unknown format %q", query.Get("format")), http.StatusBadRequest)
+  }
+}
+
+// GetModelAndVersion looks up the model and version named by the route,
+// responding with an error if either does not exist.
+func GetModelAndVersion(rw http.ResponseWriter, req *http.Request) (*db.Model, *db.ModelVersion, bool) {
   vars := mux.Vars(req)
-  id := vars["id"]
-  log.Printf("Handling GET \"/api/models/%v/data\"\n", id)
-  m, err := db.GetModelById(id)
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
+    return nil, nil, false
+  }
+  version, err := strconv.Atoi(vars["version"])
+  if err != nil {
+    SendError(rw, fmt.Sprintf("Invalid version %q", vars["version"]), http.StatusBadRequest)
+    return nil, nil, false
+  }
+  v, err := m.GetVersion(req.Context(), version)
+  if err != nil {
+    SendDBError(rw, err)
+    return nil, nil, false
+  }
+  return m, v, true
+}
+
+func GetModelVersion(ctx context.Context, m *db.Model, v *db.ModelVersion) (*ModelVersion, error) {
+  fit, err := v.GetFit(ctx, m)
+  if err != nil {
+    return nil, err
+  }
+  return &ModelVersion{
+    Version: v.Version,
+    Created: v.Created,
+    Current: v.Version == m.Version,
+    Model: GetModelFromDBModelAndCoefficients(fit.Model, fit.Coefficients, fit.Parameters),
+  }, nil
+}
+
+func SendJSON(rw http.ResponseWriter, v interface{}) {
+  jsonData, err := json.Marshal(v)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusNotFound)
+    SendDBError(rw, err)
     return
   }
-  ds, err := m.GetData()
+  rw.Header().Set("Content-Type", "application/json")
+  rw.Write(jsonData)
+}
+
+func GetVersionsHandler(rw http.ResponseWriter, req *http.Request) {
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
+    return
+  }
+  vs, err := m.GetVersions(req.Context())
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
+    return
+  }
+  versions := make([]*ModelVersion, len(vs))
+  for i := range vs {
+    versions[i], err = GetModelVersion(req.Context(), m, &vs[i])
+    if err != nil {
+      SendDBError(rw, err)
+      return
+    }
+  }
+  SendJSON(rw, versions)
+}
+
+func GetVersionHandler(rw http.ResponseWriter, req *http.Request) {
+  m, v, ok := GetModelAndVersion(rw, req)
+  if !ok {
+    return
+  }
+  version, err := GetModelVersion(req.Context(), m, v)
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  SendJSON(rw, version)
+}
+
+func PredictVersionHandler(rw http.ResponseWriter, req *http.Request) {
+  m, v, ok := GetModelAndVersion(rw, req)
+  if !ok {
+    return
+  }
+  fit, err := v.GetFit(req.Context(), m)
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  SendPrediction(rw, req, fit)
+}
+
+func PromoteVersionHandler(rw http.ResponseWriter, req *http.Request) {
+  m, v, ok := GetModelAndVersion(rw, req)
+  if !ok {
+    return
+  }
+  err := m.Promote(req.Context(), v)
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  SendModelById(rw, req, m.Id)
+}
+
+func GetDataHandler(rw http.ResponseWriter, req *http.Request) {
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
+    return
+  }
+  ds, err := m.GetData(req.Context())
+  if err != nil {
+    SendDBError(rw, err)
     return
   }
   // TODO: Send data with covariates
   data := make([]*Datum, len(ds))
   for i, datum := range ds {
-    data[i], err = GetDatumById(datum.Id)
+    data[i], err = GetDatumById(req.Context(), datum.Id)
     if err != nil {
-      http.Error(rw, err.Error(), http.StatusInternalServerError)
+      SendDBError(rw, err)
       return
     }
   }
@@ -401,52 +902,345 @@ func GetDataHandler(rw http.ResponseWriter, req *http.Request) {
 }
 
 func RemoveDataHandler(rw http.ResponseWriter, req *http.Request) {
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
+    return
+  }
+  err := m.DeleteData(req.Context())
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  rw.Header().Set("Content-Type", "application/json")
+  rw.Write([]byte("{}"))
+}
+
+func RemoveDatumHandler(rw http.ResponseWriter, req *http.Request) {
   vars := mux.Vars(req)
-  id := vars["id"]
-  log.Printf("Handling DELETE \"/api/models/%v/data\"\n", id)
-  m, err := db.GetModelById(id)
+  datumId := vars["datum"]
+  m, ok := GetRequestModel(rw, req)
+  if !ok {
+    return
+  }
+  d, err := db.GetDatumById(req.Context(), datumId)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusNotFound)
+    SendDBError(rw, err)
+    return
+  }
+  if d.Model != m.Id {
+    SendError(rw, fmt.Sprintf("Datum %v not found in model %v", datumId, m.Id), http.StatusNotFound)
     return
   }
-  err = m.DeleteData()
+  err = m.DeleteDatum(req.Context(), d)
   if err != nil {
-    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    SendDBError(rw, err)
     return
   }
   rw.Header().Set("Content-Type", "application/json")
   rw.Write([]byte("{}"))
 }
 
-func main() {
-  // TODO(Alden): if we really enable this, we should debounce the calls to `Learn`
-  go func(ch <-chan string) {
-    for id := range ch {
-      m, err := db.GetModelById(id)
-      if err != nil {
-        log.Printf("Learn error: %v\n", err)
-      } else {
-        m.Learn()
+type PreApiKey struct {
+  Tenant string `json:"tenant"`
+  Role string `json:"role"`
+  RateLimit float64 `json:"rate_limit"`
+  MaxModels int `json:"max_models"`
+  MaxRowsPerModel int `json:"max_rows_per_model"`
+  MaxTrainingJobs int `json:"max_training_jobs"`
+}
+
+func GetApiKey(k *db.ApiKey) *ApiKey {
+  return &ApiKey{
+    Id: k.Id,
+    Tenant: k.Tenant,
+    Role: k.Role,
+    Created: k.Created,
+    RateLimit: k.RateLimit,
+    MaxModels: k.MaxModels,
+    MaxRowsPerModel: k.MaxRowsPerModel,
+    MaxTrainingJobs: k.MaxTrainingJobs,
+  }
+}
+
+// The key handlers reach the database through these; tests replace them.
+var (
+  createApiKey = db.CreateApiKey
+  getApiKeys = db.GetApiKeys
+  getApiKeyById = db.GetApiKeyById
+  deleteApiKeyById = db.DeleteApiKeyById
+)
+
+// CreateKeyHandler creates a key of the tenant, by default that of the
+// request's key, with a role no greater than its own. Only super admin keys
+// create keys of other tenants. The response is the only time the key is
+// sent.
+func CreateKeyHandler(rw http.ResponseWriter, req *http.Request) {
+  decoder := json.NewDecoder(req.Body)
+  var pre PreApiKey
+  err := decoder.Decode(&pre)
+  if err != nil {
+    SendDecodeError(rw, err, "key")
+    return
+  }
+  admin := RequestKey(req)
+  if pre.Tenant == "" {
+    pre.Tenant = admin.Tenant
+  }
+  if !admin.IsSuperAdmin() && pre.Tenant != admin.Tenant {
+    SendError(rw, "Only super admin keys create keys of other tenants", http.StatusForbidden)
+    return
+  }
+  if db.IsRole(pre.Role) && !admin.Allows(pre.Role) {
+    SendError(rw, fmt.Sprintf("The role %v of this key cannot create %v keys", admin.Role, pre.Role), http.StatusForbidden)
+    return
+  }
+  k := &db.ApiKey{
+    Tenant: pre.Tenant,
+    Role: pre.Role,
+    RateLimit: pre.RateLimit,
+    MaxModels: pre.MaxModels,
+    MaxRowsPerModel: pre.MaxRowsPerModel,
+    MaxTrainingJobs: pre.MaxTrainingJobs,
+  }
+  key, err := createApiKey(req.Context(), k)
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  logging.Infof(req.Context(), "Created key %v of tenant %v with role %v", k.Id, k.Tenant, k.Role)
+  resp := GetApiKey(k)
+  resp.Key = key
+  SendJSON(rw, resp)
+}
+
+// GetKeysHandler lists the keys the request's key may manage.
+func GetKeysHandler(rw http.ResponseWriter, req *http.Request) {
+  ks, err := getApiKeys(req.Context())
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  admin := RequestKey(req)
+  keys := []*ApiKey{}
+  for i := range ks {
+    if admin.CanManage(&ks[i]) {
+      keys = append(keys, GetApiKey(&ks[i]))
+    }
+  }
+  SendJSON(rw, keys)
+}
+
+func DeleteKeyHandler(rw http.ResponseWriter, req *http.Request) {
+  vars := mux.Vars(req)
+  id := vars["id"]
+  admin := RequestKey(req)
+  if id == admin.Id {
+    SendError(rw, "A key cannot delete itself", http.StatusConflict)
+    return
+  }
+  // keys it may not manage are not found, as models of other tenants are not
+  k, err := getApiKeyById(req.Context(), id)
+  if err == nil && !admin.CanManage(k) {
+    SendError(rw, "Key " + id + " not found", http.StatusNotFound)
+    return
+  }
+  if err == nil {
+    err = deleteApiKeyById(req.Context(), id)
+  }
+  if err != nil {
+    SendDBError(rw, err)
+    return
+  }
+  rw.Header().Set("Content-Type", "application/json")
+  rw.Write([]byte("{}"))
+}
+
+// LimitRequestSize caps the size of request bodies. Reading past the limit
+// fails, so handlers respond as for any malformed body.
+func LimitRequestSize(handler http.Handler, maxBytes int64) http.Handler {
+  return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+    req.Body = http.MaxBytesReader(rw, req.Body, maxBytes)
+    handler.ServeHTTP(rw, req)
+  })
+}
+
+// RecoverPanics turns a panicking request into a 500 so that the server
+// carries on with the others.
+func RecoverPanics(handler http.Handler) http.Handler {
+  return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+    defer func() {
+      p := recover()
+      if p == nil {
+        return
+      }
+      if p == http.ErrAbortHandler {
+        panic(p)
       }
+      logging.Log(req.Context(), logging.Error, fmt.Sprintf("Panic: %v", p), logging.Fields{
+        "method": req.Method,
+        "path": req.URL.Path,
+        "stack": string(debug.Stack()),
+      })
+      SendError(rw, "Internal server error", http.StatusInternalServerError)
+    }()
+    handler.ServeHTTP(rw, req)
+  })
+}
+
+// SetRequestId gives each request an id, which error responses include. A
+// client may choose the id with an X-Request-ID header; it is echoed in the
+// response either way.
+func SetRequestId(handler http.Handler) http.Handler {
+  return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+    id := req.Header.Get("X-Request-ID")
+    if id == "" || len(id) > 128 {
+      id = newRequestId()
     }
-  }(learnChannel)
+    rw.Header().Set("X-Request-ID", id)
+    handler.ServeHTTP(rw, req.WithContext(logging.WithRequestId(req.Context(), id)))
+  })
+}
 
+func newRequestId() string {
+  b := make([]byte, 12)
+  _, err := rand.Read(b)
+  if err != nil {
+    logging.Errorf(context.Background(), "Error creating request id: %v", err)
+  }
+  return hex.EncodeToString(b)
+}
+
+// setup loads the settings in args and connects to the database.
+func setup(args []string) *config.Config {
+  c, err := config.Load(args)
+  if err == flag.ErrHelp {
+    os.Exit(0)
+  }
+  if err != nil {
+    logging.Fatalf(context.Background(), "Config error: %v", err)
+  }
+  conf = c
+  level, _ := logging.ParseLevel(c.LogLevel)
+  logging.SetLevel(level)
+  err = db.Init(c.Database.DataSourceName(), c.Database.MaxOpenConns, c.Database.MaxIdleConns)
+  if err != nil {
+    logging.Fatalf(context.Background(), "Database error: %v", err)
+  }
+  return c
+}
+
+// CreateKey runs "cloudml-server create-key [-role ROLE] TENANT [settings]",
+// which prints a new API key of the tenant. The key is only shown this once.
+// It is how the first admin (or super admin) key is made; the others can be
+// created with POST /api/keys.
+func CreateKey(args []string) {
+  fs := flag.NewFlagSet("cloudml-server create-key", flag.ExitOnError)
+  role := fs.String("role", db.RoleReader, "Role of the key: reader, writer, trainer, admin or superadmin")
+  fs.Usage = func() {
+    fmt.Fprintf(os.Stderr, "Usage: cloudml-server create-key [-role ROLE] TENANT [settings]\n")
+    fs.PrintDefaults()
+  }
+  fs.Parse(args)
+  if fs.NArg() == 0 {
+    fs.Usage()
+    os.Exit(2)
+  }
+  setup(fs.Args()[1:])
+  k := &db.ApiKey{Tenant: fs.Arg(0), Role: *role}
+  key, err := db.CreateApiKey(context.Background(), k)
+  if err != nil {
+    logging.Fatalf(context.Background(), "Error creating key: %v", err)
+  }
+  logging.Infof(context.Background(), "Created key %v of tenant %v with role %v", k.Id, k.Tenant, k.Role)
+  fmt.Println(key)
+}
+
+// newRouter routes the API, each route of it behind the role it needs.
+func newRouter() *mux.Router {
   r := mux.NewRouter()
-  r.HandleFunc("/api/models", CreateModelHandler).Methods("POST")
-  r.HandleFunc("/api/models", GetModelsHandler).Methods("GET")
-  r.HandleFunc("/api/models/{id}", GetModelHandler).Methods("GET")
-  r.HandleFunc("/api/models/{id}", DeleteModelHandler).Methods("DELETE")
-  r.HandleFunc("/api/models/{id}/datum", CreateDatumHandler).Methods("POST")
-  r.HandleFunc("/api/models/{id}/data", CreateDataHandler).Methods("POST")
-  r.HandleFunc("/api/models/{id}/data", GetDataHandler).Methods("GET")
-  r.HandleFunc("/api/models/{id}/data", RemoveDataHandler).Methods("DELETE")
+  r.HandleFunc("/api/models", Authorize(db.RoleTrainer, CreateModelHandler)).Methods("POST")
+  r.HandleFunc("/api/models", Authorize(db.RoleReader, GetModelsHandler)).Methods("GET")
+  r.HandleFunc("/api/models/import", Authorize(db.RoleTrainer, ImportModelHandler)).Methods("POST")
+  r.HandleFunc("/api/models/{id}", Authorize(db.RoleReader, GetModelHandler)).Methods("GET")
+  r.HandleFunc("/api/models/{id}", Authorize(db.RoleAdmin, DeleteModelHandler)).Methods("DELETE")
+  r.HandleFunc("/api/models/{id}/datum", Authorize(db.RoleWriter, CreateDatumHandler)).Methods("POST")
+  r.HandleFunc("/api/models/{id}/data", Authorize(db.RoleWriter, CreateDataHandler)).Methods("POST")
+  r.HandleFunc("/api/models/{id}/data", Authorize(db.RoleReader, GetDataHandler)).Methods("GET")
+  r.HandleFunc("/api/models/{id}/data", Authorize(db.RoleTrainer, RemoveDataHandler)).Methods("DELETE")
+  r.HandleFunc("/api/models/{id}/data/{datum}", Authorize(db.RoleWriter, RemoveDatumHandler)).Methods("DELETE")
   // XXX(Alden): Remove and do learning async?
-  r.HandleFunc("/api/models/{id}/learn", LearnModelHandler).Methods("POST")
-  r.HandleFunc("/api/models/{id}/predict", PredictModelHandler).Methods("POST")
-  r.HandleFunc("/api/models/{id}/cv", CVModelHandler).Methods("POST")
+  r.HandleFunc("/api/models/{id}/learn", Authorize(db.RoleTrainer, LearnModelHandler)).Methods("POST")
+  r.HandleFunc("/api/models/{id}/predict", Authorize(db.RoleReader, PredictModelHandler)).Methods("POST")
+  r.HandleFunc("/api/models/{id}/cv", Authorize(db.RoleTrainer, CVModelHandler)).Methods("POST")
+  r.HandleFunc("/api/models/{id}/export", Authorize(db.RoleReader, ExportModelHandler)).Methods("GET")
+  r.HandleFunc("/api/models/{id}/versions", Authorize(db.RoleReader, GetVersionsHandler)).Methods("GET")
+  r.HandleFunc("/api/models/{id}/versions/{version}", Authorize(db.RoleReader, GetVersionHandler)).Methods("GET")
+  r.HandleFunc("/api/models/{id}/versions/{version}/predict", Authorize(db.RoleReader, PredictVersionHandler)).Methods("POST")
+  r.HandleFunc("/api/models/{id}/versions/{version}/promote", Authorize(db.RoleTrainer, PromoteVersionHandler)).Methods("POST")
+  r.HandleFunc("/api/usage", Authorize(db.RoleReader, GetUsageHandler)).Methods("GET")
+  r.HandleFunc("/api/keys", Authorize(db.RoleAdmin, CreateKeyHandler)).Methods("POST")
+  r.HandleFunc("/api/keys", Authorize(db.RoleAdmin, GetKeysHandler)).Methods("GET")
+  r.HandleFunc("/api/keys/{id}", Authorize(db.RoleAdmin, DeleteKeyHandler)).Methods("DELETE")
+  r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+  r.HandleFunc("/healthz", HealthzHandler).Methods("GET")
+  r.HandleFunc("/readyz", ReadyzHandler).Methods("GET")
   r.HandleFunc("/", IndexHandler).Methods("GET")
-  http.Handle("/", r)
-  port := "6060"
-  log.Printf("CloudML: port %v\n", port)
-  log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port), nil))
+  r.NotFoundHandler = http.HandlerFunc(NotFoundHandler)
+  return r
+}
+
+func main() {
+  if len(os.Args) > 1 && os.Args[1] == "create-key" {
+    CreateKey(os.Args[2:])
+    return
+  }
+  c := setup(os.Args[1:])
+  err := metrics.Register(prometheus.DefaultRegisterer)
+  if err != nil {
+    logging.Fatalf(context.Background(), "Error registering metrics: %v", err)
+  }
+
+  // TODO(Alden): if we really enable this, we should debounce the calls to `Learn`
+  startLearnWorkers(c.LearnWorkers, c.LearnQueue)
+
+  r := newRouter()
+  registerJobMetrics()
+  http.Handle("/", SetRequestId(SetRoute(r, LogRequests(MeasureRequests(RecoverPanics(LimitRequestTime(LimitRequestSize(r, c.MaxRequestBytes))))))))
+  server := &http.Server{
+    Addr: c.Listen,
+    ReadTimeout: c.ReadTimeout,
+    WriteTimeout: c.WriteTimeout,
+    IdleTimeout: c.IdleTimeout,
+  }
+  go func() {
+    err := server.ListenAndServe()
+    if err != http.ErrServerClosed {
+      logging.Fatalf(context.Background(), "Server error: %v", err)
+    }
+  }()
+  logging.Infof(context.Background(), "CloudML: listening on %v", c.Listen)
+  stop := make(chan os.Signal, 1)
+  signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+  sig := <-stop
+  logging.Infof(context.Background(), "CloudML: %v, shutting down", sig)
+  shutdown(server, c.ShutdownTimeout)
+}
+
+// shutdown stops the server within timeout: it stops accepting requests and
+// waits for those in flight, then for the background training jobs, saving
+// those it cannot wait for, and closes the database.
+func shutdown(server *http.Server, timeout time.Duration) {
+  atomic.StoreInt32(&shuttingDown, 1)
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  err := server.Shutdown(ctx)
+  if err != nil {
+    logging.Warnf(ctx, "Stopped waiting for requests: %v", err)
+  }
+  stopLearnWorkers(ctx)
+  err = db.Close()
+  if err != nil {
+    logging.Errorf(ctx, "Error closing database: %v", err)
+  }
+  logging.Infof(ctx, "CloudML: stopped")
 }
@@ -1,14 +1,48 @@
 package main
 
+import (
+  "time"
+)
+
 type Model struct {
   Id string `json:"id"`
+  Tenant string `json:"tenant"`
   Type string `json:"type"`
+  Family string `json:"family,omitempty"`
+  Link string `json:"link,omitempty"`
+  Robust bool `json:"robust,omitempty"`
+  HuberK float64 `json:"huber_k,omitempty"`
+  Quantile float64 `json:"quantile,omitempty"`
+  PriorPrecision float64 `json:"prior_precision,omitempty"`
+  NoiseVariance float64 `json:"noise_variance,omitempty"`
+  EmpiricalBayes bool `json:"empirical_bayes,omitempty"`
   Lambda float64 `json:"lambda"`
   NumTrainingData int `json:"num_training_data"`
+  SumWeights float64 `json:"sum_weights"`
   NumCovariates int `json:"num_covariates"`
-  TrainRmse float64 `json:"train_rmse"`
-  CvRmse float64 `json:"cv_rmse"`
+  Version int `json:"version"`
+  NumVersions int `json:"num_versions"`
+  Intercept string `json:"intercept,omitempty"`
+  TrainRmse *float64 `json:"train_rmse,omitempty"`
+  CvRmse *float64 `json:"cv_rmse,omitempty"`
+  TrainPinball *float64 `json:"train_pinball,omitempty"`
+  CvPinball *float64 `json:"cv_pinball,omitempty"`
+  TrainConcordance *float64 `json:"train_concordance,omitempty"`
+  CvConcordance *float64 `json:"cv_concordance,omitempty"`
   Coefficients []Coefficient `json:"coefficients"`
+  Classes []string `json:"classes,omitempty"`
+  ClassCoefficients []ClassCoefficient `json:"class_coefficients,omitempty"`
+  Levels []float64 `json:"levels,omitempty"`
+  Thresholds []Threshold `json:"thresholds,omitempty"`
+  Covariance [][]float64 `json:"covariance,omitempty"`
+}
+
+// ModelVersion is a model as it was after one of its training runs.
+type ModelVersion struct {
+  Version int `json:"version"`
+  Created time.Time `json:"created"`
+  Current bool `json:"current"`
+  Model *Model `json:"model"`
 }
 
 type Coefficient struct {
@@ -16,6 +50,23 @@ type Coefficient struct {
   Model string `json:"model"`
   Label string `json:"label"`
   Value float64 `json:"value"`
+  Source string `json:"source,omitempty"`
+}
+
+type ClassCoefficient struct {
+  Id string `json:"id"`
+  Model string `json:"model"`
+  Class string `json:"class"`
+  Label string `json:"label"`
+  Value float64 `json:"value"`
+}
+
+type Threshold struct {
+  Id string `json:"id"`
+  Model string `json:"model"`
+  Lower float64 `json:"lower"`
+  Upper float64 `json:"upper"`
+  Value float64 `json:"value"`
 }
 
 type Covariate struct {
@@ -29,6 +80,55 @@ type Datum struct {
   Id string `json:"id"`
   Model string `json:"model"`
   Value float64 `json:"value"`
+  Weight float64 `json:"weight"`
+  Offset float64 `json:"offset"`
+  Class string `json:"class,omitempty"`
+  Duration float64 `json:"duration,omitempty"`
+  Event bool `json:"event,omitempty"`
   Covariates []Covariate `json:"covariates"`
 }
 
+
+type ClassPrediction struct {
+  Class string `json:"class"`
+  Probabilities map[string]float64 `json:"probabilities"`
+}
+
+type LevelPrediction struct {
+  Level float64 `json:"level"`
+  Probability float64 `json:"probability"`
+  Levels []float64 `json:"levels"`
+  Cumulative []float64 `json:"cumulative"`
+  Probabilities []float64 `json:"probabilities"`
+}
+
+// PosteriorPrediction is the normal posterior predictive distribution, with
+// its central 95% interval.
+type PosteriorPrediction struct {
+  Value float64 `json:"value"`
+  Variance float64 `json:"variance"`
+  StdDev float64 `json:"std_dev"`
+  Lower float64 `json:"lower"`
+  Upper float64 `json:"upper"`
+}
+
+type SurvivalPrediction struct {
+  RelativeHazard float64 `json:"relative_hazard"`
+  Times []float64 `json:"times"`
+  Survival []float64 `json:"survival"`
+}
+
+// ApiKey describes a key without the key itself, which is only sent as Key
+// when the key is created.
+type ApiKey struct {
+  Id string `json:"id"`
+  Tenant string `json:"tenant"`
+  Role string `json:"role"`
+  Created time.Time `json:"created"`
+  Key string `json:"key,omitempty"`
+  // Quotas of the key, 0 for the server's default and negative for no limit.
+  RateLimit float64 `json:"rate_limit"`
+  MaxModels int `json:"max_models"`
+  MaxRowsPerModel int `json:"max_rows_per_model"`
+  MaxTrainingJobs int `json:"max_training_jobs"`
+}
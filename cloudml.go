@@ -0,0 +1,308 @@
+// Package cloudml trains models and predicts with them in-process, with the
+// same model types as cloudml-server but without the HTTP server or a
+// database:
+//
+//   m, err := cloudml.New(&cloudml.Spec{Type: "logistic", Covariates: []string{"age", "intercept"}})
+//   err = m.Add(&cloudml.Datum{Value: 1, Covariates: map[string]float64{"age": 40, "intercept": 1}})
+//   err = m.Learn()
+//   p, err := m.Predict(&cloudml.Datum{Covariates: map[string]float64{"age": 40, "intercept": 1}})
+//
+// Models can be saved with Save and read back with Load, or exported for
+// POST /api/models/import.
+package cloudml
+
+import (
+  "github.com/aotimme/cloudml/db"
+  "github.com/aotimme/cloudml/export"
+  "context"
+  "encoding/json"
+  "errors"
+  "io"
+  "math"
+  "sync"
+)
+
+// Spec describes a new model, as the body of POST /api/models.
+type Spec struct {
+  Type string
+  Family string
+  Link string
+  Robust bool
+  HuberK float64
+  Quantile float64
+  PriorPrecision float64
+  NoiseVariance float64
+  EmpiricalBayes bool
+  Covariates []string
+  Lambda float64
+  Classes []string
+  Levels []float64
+}
+
+// Datum is a datum to add or, ignoring its Value and Class, to predict.
+// Times are the times at which to predict the survival of cox models.
+type Datum struct {
+  Value float64
+  Covariates map[string]float64
+  Weight *float64
+  Offset float64
+  Exposure *float64
+  Class string
+  Duration float64
+  Event bool
+  Times []float64
+}
+
+// Prediction holds the prediction of any type of model; only the fields of
+// the model's type are set, as in the responses of the server.
+type Prediction struct {
+  Value float64
+  Variance float64
+  StdDev float64
+  Lower float64
+  Upper float64
+  Class string
+  ClassProbabilities map[string]float64
+  Level float64
+  Probability float64
+  Levels []float64
+  Cumulative []float64
+  LevelProbabilities []float64
+  RelativeHazard float64
+  Times []float64
+  Survival []float64
+}
+
+// Model is a model with its data, held in memory. It is safe for concurrent
+// use.
+type Model struct {
+  mu sync.RWMutex
+  fit *db.Fit
+  data *db.DataArray
+}
+
+func New(spec *Spec) (*Model, error) {
+  m := &db.Model{
+    Type: spec.Type,
+    Family: spec.Family,
+    Link: spec.Link,
+    Robust: spec.Robust,
+    HuberK: spec.HuberK,
+    Quantile: spec.Quantile,
+    PriorPrecision: spec.PriorPrecision,
+    NoiseVariance: spec.NoiseVariance,
+    EmpiricalBayes: spec.EmpiricalBayes,
+    Lambda: spec.Lambda,
+  }
+  fit, err := db.NewFit(m, spec.Covariates, spec.Classes, spec.Levels)
+  if err != nil {
+    return nil, err
+  }
+  return &Model{fit: fit, data: &db.DataArray{}}, nil
+}
+
+// Info returns the model's settings, data counts and metrics.
+func (m *Model) Info() db.Model {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  return *m.fit.Model
+}
+
+// Coefficients returns the value of each covariate's coefficient.
+func (m *Model) Coefficients() map[string]float64 {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  coefficients := make(map[string]float64)
+  for _, c := range m.fit.Coefficients {
+    coefficients[c.Label] = c.Value
+  }
+  return coefficients
+}
+
+// Add adds the data to the model. Either all of them are added or, if one
+// is invalid, none. Like the server, bayesian linear models update their
+// posterior right away.
+func (m *Model) Add(data ...*Datum) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  rows := make([]*db.Datum, len(data))
+  for i, datum := range data {
+    weight, offset, err := db.GetWeightAndOffset(datum.Weight, datum.Offset, datum.Exposure)
+    if err != nil {
+      return err
+    }
+    rows[i] = &db.Datum{
+      Value: datum.Value,
+      Weight: weight,
+      Offset: offset,
+      Class: datum.Class,
+      Duration: datum.Duration,
+      Event: datum.Event,
+    }
+    err = m.fit.CheckDatum(rows[i])
+    if err != nil {
+      return err
+    }
+  }
+  d := m.data
+  n := len(d.Values)
+  model := *m.fit.Model
+  for i, row := range rows {
+    covariates := make([]float64, len(m.fit.Coefficients))
+    for j, c := range m.fit.Coefficients {
+      covariates[j] = data[i].Covariates[c.Label]
+    }
+    d.Covariates = append(d.Covariates, covariates)
+    d.Values = append(d.Values, row.Value)
+    d.Weights = append(d.Weights, row.Weight)
+    d.Offsets = append(d.Offsets, row.Offset)
+    d.Classes = append(d.Classes, row.Class)
+    d.Durations = append(d.Durations, row.Duration)
+    d.Events = append(d.Events, row.Event)
+    m.fit.Model.NumTrainingData++
+    m.fit.Model.SumWeights += row.Weight
+  }
+  if m.fit.Model.Type == "bayesian_linear" {
+    err := m.fit.Train(context.Background(), d)
+    if err != nil {
+      // take the data back out; the posterior is only set on success
+      truncate(d, n)
+      *m.fit.Model = model
+      return err
+    }
+  }
+  return nil
+}
+
+// truncate keeps the first n data of d.
+func truncate(d *db.DataArray, n int) {
+  d.Covariates = d.Covariates[:n]
+  d.Values = d.Values[:n]
+  d.Weights = d.Weights[:n]
+  d.Offsets = d.Offsets[:n]
+  d.Classes = d.Classes[:n]
+  d.Durations = d.Durations[:n]
+  d.Events = d.Events[:n]
+}
+
+// Learn trains the model on all of its data.
+func (m *Model) Learn() error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if m.fit.Model.NumTrainingData == 0 {
+    return errors.New("Model has no data")
+  }
+  err := m.fit.Train(context.Background(), m.data)
+  if err != nil {
+    return err
+  }
+  for j := range m.fit.Coefficients {
+    m.fit.Coefficients[j].Source = "trained"
+  }
+  return nil
+}
+
+// CV cross-validates the model, setting its CV metric.
+func (m *Model) CV() error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if m.fit.Model.NumTrainingData == 0 {
+    return errors.New("Model has no data")
+  }
+  return m.fit.CV(context.Background(), m.data)
+}
+
+func (m *Model) Predict(datum *Datum) (*Prediction, error) {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  fit := m.fit
+  _, offset, err := db.GetWeightAndOffset(nil, datum.Offset, datum.Exposure)
+  if err != nil {
+    return nil, err
+  }
+  p := &Prediction{}
+  switch fit.Model.Type {
+  case "multinomial":
+    p.ClassProbabilities, p.Class, err = fit.PredictClasses(datum.Covariates)
+  case "ordinal":
+    p.Levels, p.Cumulative, p.LevelProbabilities, err = fit.PredictLevels(datum.Covariates, offset)
+    for k, prob := range p.LevelProbabilities {
+      if k == 0 || prob > p.Probability {
+        p.Level = p.Levels[k]
+        p.Probability = prob
+      }
+    }
+  case "bayesian_linear":
+    p.Value, p.Variance, err = fit.PredictPosterior(datum.Covariates, offset)
+    p.StdDev = math.Sqrt(p.Variance)
+    p.Lower = p.Value - 1.96 * p.StdDev
+    p.Upper = p.Value + 1.96 * p.StdDev
+  case "cox":
+    p.Times = datum.Times
+    p.RelativeHazard, p.Survival, err = fit.PredictSurvival(datum.Covariates, offset, datum.Times)
+  default:
+    p.Value, err = fit.Predict(datum.Covariates, offset)
+  }
+  if err != nil {
+    return nil, err
+  }
+  return p, nil
+}
+
+// Export returns the model in the portable JSON format of the server's
+// export, which can also be imported into the server.
+func (m *Model) Export(intercept string) *export.Model {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  return export.FromFit(m.fit, intercept)
+}
+
+// saved is the format of Save: everything needed to carry on, including the
+// data.
+type saved struct {
+  Model *db.Model `json:"model"`
+  Coefficients []db.Coefficient `json:"coefficients"`
+  Parameters *db.Parameters `json:"parameters"`
+  Data *db.DataArray `json:"data"`
+}
+
+// Save writes the model and its data as JSON, for Load.
+func (m *Model) Save(w io.Writer) error {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  return json.NewEncoder(w).Encode(&saved{
+    Model: m.fit.Model,
+    Coefficients: m.fit.Coefficients,
+    Parameters: m.fit.Parameters,
+    Data: m.data,
+  })
+}
+
+// Load reads a model saved with Save.
+func Load(r io.Reader) (*Model, error) {
+  var s saved
+  err := json.NewDecoder(r).Decode(&s)
+  if err != nil {
+    return nil, err
+  }
+  if s.Model == nil || !db.IsModelType(s.Model.Type) || len(s.Coefficients) != s.Model.NumCovariates {
+    return nil, errors.New("Malformed saved model")
+  }
+  if s.Parameters == nil {
+    s.Parameters = &db.Parameters{}
+  }
+  if s.Data == nil {
+    s.Data = &db.DataArray{}
+  }
+  d, n := s.Data, s.Model.NumTrainingData
+  if len(d.Covariates) != n || len(d.Values) != n || len(d.Weights) != n || len(d.Offsets) != n || len(d.Classes) != n || len(d.Durations) != n || len(d.Events) != n {
+    return nil, errors.New("Malformed saved data")
+  }
+  for _, covariates := range d.Covariates {
+    if len(covariates) != len(s.Coefficients) {
+      return nil, errors.New("Malformed saved data")
+    }
+  }
+  fit := &db.Fit{Model: s.Model, Coefficients: s.Coefficients, Parameters: s.Parameters}
+  return &Model{fit: fit, data: s.Data}, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/client"
+  "context"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "strconv"
+  "strings"
+)
+
+func CreateModelCommand(ctx context.Context, c *client.Client, args []string) error {
+  fs := newFlagSet("models create")
+  pre := &client.PreModel{}
+  fs.StringVar(&pre.Type, "type", "linear", "Model type")
+  covariates := fs.String("covariates", "", "Comma separated covariate labels")
+  fs.Float64Var(&pre.Lambda, "lambda", 0, "Regularization")
+  fs.StringVar(&pre.Family, "family", "", "GLM family")
+  fs.StringVar(&pre.Link, "link", "", "GLM link")
+  fs.BoolVar(&pre.Robust, "robust", false, "Use the Huber loss")
+  fs.Float64Var(&pre.HuberK, "huber-k", 0, "Huber loss threshold")
+  fs.Float64Var(&pre.Quantile, "quantile", 0, "Quantile of quantile models")
+  fs.Float64Var(&pre.PriorPrecision, "prior-precision", 0, "Prior precision of bayesian linear models")
+  fs.Float64Var(&pre.NoiseVariance, "noise-variance", 0, "Noise variance of bayesian linear models")
+  fs.BoolVar(&pre.EmpiricalBayes, "empirical-bayes", false, "Fit the prior precision and noise variance")
+  classes := fs.String("classes", "", "Comma separated classes of multinomial models")
+  levels := fs.String("levels", "", "Comma separated levels of ordinal models")
+  _, err := parseFlags(fs, args, 0)
+  if err != nil {
+    return err
+  }
+  if *covariates == "" {
+    return errors.New("--covariates is required")
+  }
+  pre.Covariates = splitList(*covariates)
+  if *classes != "" {
+    pre.Classes = splitList(*classes)
+  }
+  if *levels != "" {
+    pre.Levels, err = parseFloats(splitList(*levels))
+    if err != nil {
+      return err
+    }
+  }
+  m, err := c.CreateModel(ctx, pre)
+  if err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(m)
+  }
+  printModel(m)
+  return nil
+}
+
+func GetModelCommand(ctx context.Context, c *client.Client, args []string) error {
+  positional, err := parseFlags(newFlagSet("models get"), args, 1)
+  if err != nil {
+    return err
+  }
+  m, err := c.GetModel(ctx, positional[0])
+  if err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(m)
+  }
+  printModel(m)
+  return nil
+}
+
+func DeleteModelCommand(ctx context.Context, c *client.Client, args []string) error {
+  positional, err := parseFlags(newFlagSet("models delete"), args, 1)
+  if err != nil {
+    return err
+  }
+  return c.Delete(ctx, positional[0])
+}
+
+func ListModelsCommand(ctx context.Context, c *client.Client, args []string) error {
+  _, err := parseFlags(newFlagSet("ls"), args, 0)
+  if err != nil {
+    return err
+  }
+  models, err := c.ListModels(ctx)
+  if err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(models)
+  }
+  printModels(models)
+  return nil
+}
+
+func LoadDataCommand(ctx context.Context, c *client.Client, args []string) error {
+  fs := newFlagSet("data load")
+  columns := &Columns{}
+  fs.StringVar(&columns.Value, "value", "", "Column of the values (default the first column, unless --class or --duration is given)")
+  fs.StringVar(&columns.Weight, "weight", "", "Column of the weights")
+  fs.StringVar(&columns.Offset, "offset", "", "Column of the offsets")
+  fs.StringVar(&columns.Exposure, "exposure", "", "Column of the exposures")
+  fs.StringVar(&columns.Class, "class", "", "Column of the classes of multinomial models")
+  fs.StringVar(&columns.Duration, "duration", "", "Column of the durations of cox models")
+  fs.StringVar(&columns.Event, "event", "", "Column of the events of cox models")
+  fs.StringVar(&columns.Intercept, "intercept", "", "Label of a covariate to add with value 1")
+  batchSize := fs.Int("batch", 1000, "Number of rows to send at a time")
+  positional, err := parseFlags(fs, args, 2)
+  if err != nil {
+    return err
+  }
+  if *batchSize <= 0 {
+    return errors.New("--batch must be positive")
+  }
+  file, err := os.Open(positional[1])
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  pres, err := ReadData(file, columns)
+  if err != nil {
+    return err
+  }
+  var data []*client.Datum
+  for start := 0; start < len(pres); start += *batchSize {
+    end := start + *batchSize
+    if end > len(pres) {
+      end = len(pres)
+    }
+    batch, err := c.AddData(ctx, positional[0], pres[start:end])
+    if err != nil {
+      return fmt.Errorf("after %v of %v rows: %v", start, len(pres), err)
+    }
+    data = append(data, batch...)
+  }
+  if *jsonOutput {
+    return printJSON(data)
+  }
+  fmt.Printf("Loaded %v rows into %v\n", len(data), positional[0])
+  return nil
+}
+
+func LearnCommand(ctx context.Context, c *client.Client, args []string) error {
+  positional, err := parseFlags(newFlagSet("learn"), args, 1)
+  if err != nil {
+    return err
+  }
+  m, err := c.Learn(ctx, positional[0])
+  if err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(m)
+  }
+  printModel(m)
+  return nil
+}
+
+func CVCommand(ctx context.Context, c *client.Client, args []string) error {
+  positional, err := parseFlags(newFlagSet("cv"), args, 1)
+  if err != nil {
+    return err
+  }
+  m, err := c.CV(ctx, positional[0])
+  if err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(m)
+  }
+  printModels([]*client.Model{m})
+  return nil
+}
+
+func PredictCommand(ctx context.Context, c *client.Client, args []string) error {
+  fs := newFlagSet("predict")
+  pre := &client.PreDatum{Covariates: make(map[string]float64)}
+  fs.Float64Var(&pre.Offset, "offset", 0, "Offset of the linear predictor")
+  exposure := fs.Float64("exposure", 0, "Exposure of poisson models")
+  times := fs.String("times", "", "Comma separated times of cox model survival")
+  positional, err := parseFlags(fs, args, -1)
+  if err != nil {
+    return err
+  }
+  if len(positional) == 0 {
+    return errors.New("expected a model")
+  }
+  for _, arg := range positional[1:] {
+    parts := strings.SplitN(arg, "=", 2)
+    if len(parts) != 2 {
+      return fmt.Errorf("expected LABEL=VALUE, got %q", arg)
+    }
+    pre.Covariates[parts[0]], err = strconv.ParseFloat(parts[1], 64)
+    if err != nil {
+      return fmt.Errorf("invalid value for %q: %v", parts[0], err)
+    }
+  }
+  if *exposure != 0 {
+    pre.Exposure = exposure
+  }
+  if *times != "" {
+    pre.Times, err = parseFloats(splitList(*times))
+    if err != nil {
+      return err
+    }
+  }
+  p, err := c.Predict(ctx, positional[0], pre)
+  if err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(p)
+  }
+  printPrediction(p)
+  return nil
+}
+
+func ExportCommand(ctx context.Context, c *client.Client, args []string) error {
+  fs := newFlagSet("export")
+  format := fs.String("format", "json", "Format: json or pmml")
+  out := fs.String("out", "", "File to write (default standard output)")
+  positional, err := parseFlags(fs, args, 1)
+  if err != nil {
+    return err
+  }
+  data, err := c.Export(ctx, positional[0], *format)
+  if err != nil {
+    return err
+  }
+  if *out == "" {
+    _, err = os.Stdout.Write(data)
+    return err
+  }
+  return ioutil.WriteFile(*out, data, 0644)
+}
+
+func CreateKeyCommand(ctx context.Context, c *client.Client, args []string) error {
+  fs := newFlagSet("keys create")
+  pre := &client.PreKey{}
+  fs.StringVar(&pre.Role, "role", "reader", "Role: reader, writer, trainer, admin or superadmin")
+  fs.StringVar(&pre.Tenant, "tenant", "", "Tenant of the key (default that of --api-key)")
+  fs.Float64Var(&pre.RateLimit, "rate-limit", 0, "Requests a second (default the server's, negative for no limit)")
+  fs.IntVar(&pre.MaxModels, "max-models", 0, "Models of the tenant (default the server's, negative for no limit)")
+  fs.IntVar(&pre.MaxRowsPerModel, "max-rows-per-model", 0, "Data per model (default the server's, negative for no limit)")
+  fs.IntVar(&pre.MaxTrainingJobs, "max-training-jobs", 0, "Training jobs at once (default the server's, negative for no limit)")
+  _, err := parseFlags(fs, args, 0)
+  if err != nil {
+    return err
+  }
+  k, err := c.CreateKey(ctx, pre)
+  if err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(k)
+  }
+  printKeys([]*client.Key{k})
+  fmt.Printf("\nKey (shown only this once): %v\n", k.Key)
+  return nil
+}
+
+func ListKeysCommand(ctx context.Context, c *client.Client, args []string) error {
+  _, err := parseFlags(newFlagSet("keys ls"), args, 0)
+  if err != nil {
+    return err
+  }
+  keys, err := c.ListKeys(ctx)
+  if err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(keys)
+  }
+  printKeys(keys)
+  return nil
+}
+
+func DeleteKeyCommand(ctx context.Context, c *client.Client, args []string) error {
+  positional, err := parseFlags(newFlagSet("keys delete"), args, 1)
+  if err != nil {
+    return err
+  }
+  return c.DeleteKey(ctx, positional[0])
+}
+
+func UsageCommand(ctx context.Context, c *client.Client, args []string) error {
+  _, err := parseFlags(newFlagSet("usage"), args, 0)
+  if err != nil {
+    return err
+  }
+  u, err := c.Usage(ctx)
+  if err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(u)
+  }
+  printUsage(u)
+  return nil
+}
+
+func splitList(s string) []string {
+  var items []string
+  for _, item := range strings.Split(s, ",") {
+    item = strings.TrimSpace(item)
+    if item != "" {
+      items = append(items, item)
+    }
+  }
+  return items
+}
+
+func parseFloats(items []string) ([]float64, error) {
+  values := make([]float64, len(items))
+  for i, item := range items {
+    value, err := strconv.ParseFloat(item, 64)
+    if err != nil {
+      return nil, err
+    }
+    values[i] = value
+  }
+  return values, nil
+}
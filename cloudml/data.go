@@ -0,0 +1,125 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/client"
+  "encoding/csv"
+  "fmt"
+  "io"
+  "strconv"
+  "strings"
+)
+
+// Columns names the CSV columns that are not covariates. Every other column
+// is a covariate labelled by its header.
+type Columns struct {
+  Value string
+  Weight string
+  Offset string
+  Exposure string
+  Class string
+  Duration string
+  Event string
+  Intercept string
+}
+
+// ReadData reads a CSV file with a header row into data.
+func ReadData(r io.Reader, columns *Columns) ([]*client.PreDatum, error) {
+  reader := csv.NewReader(r)
+  reader.TrimLeadingSpace = true
+  header, err := reader.Read()
+  if err != nil {
+    return nil, fmt.Errorf("reading header: %v", err)
+  }
+  index := make(map[string]int)
+  for i, label := range header {
+    index[strings.TrimSpace(label)] = i
+  }
+  // multinomial and cox models have a class or a duration instead of a value
+  value := columns.Value
+  if value == "" && columns.Class == "" && columns.Duration == "" {
+    value = strings.TrimSpace(header[0])
+  }
+  special := make(map[int]bool)
+  find := func(name string) (int, error) {
+    if name == "" {
+      return -1, nil
+    }
+    i, ok := index[name]
+    if !ok {
+      return -1, fmt.Errorf("no column %q", name)
+    }
+    special[i] = true
+    return i, nil
+  }
+  var cols [7]int
+  for k, name := range []string{value, columns.Weight, columns.Offset, columns.Exposure, columns.Class, columns.Duration, columns.Event} {
+    cols[k], err = find(name)
+    if err != nil {
+      return nil, err
+    }
+  }
+  valueCol, weightCol, offsetCol, exposureCol, classCol, durationCol, eventCol := cols[0], cols[1], cols[2], cols[3], cols[4], cols[5], cols[6]
+
+  var pres []*client.PreDatum
+  for line := 2; ; line++ {
+    record, err := reader.Read()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, err
+    }
+    number := func(i int) (float64, error) {
+      v, err := strconv.ParseFloat(strings.TrimSpace(record[i]), 64)
+      if err != nil {
+        return 0, fmt.Errorf("line %v, column %q: %v", line, header[i], err)
+      }
+      return v, nil
+    }
+    pre := &client.PreDatum{Covariates: make(map[string]float64)}
+    for i, label := range header {
+      if special[i] {
+        continue
+      }
+      pre.Covariates[strings.TrimSpace(label)], err = number(i)
+      if err != nil {
+        return nil, err
+      }
+    }
+    if columns.Intercept != "" {
+      pre.Covariates[columns.Intercept] = 1
+    }
+    if valueCol >= 0 {
+      pre.Value, err = number(valueCol)
+    }
+    if err == nil && weightCol >= 0 {
+      var weight float64
+      weight, err = number(weightCol)
+      pre.Weight = &weight
+    }
+    if err == nil && offsetCol >= 0 {
+      pre.Offset, err = number(offsetCol)
+    }
+    if err == nil && exposureCol >= 0 {
+      var exposure float64
+      exposure, err = number(exposureCol)
+      pre.Exposure = &exposure
+    }
+    if err == nil && durationCol >= 0 {
+      pre.Duration, err = number(durationCol)
+    }
+    if err == nil && eventCol >= 0 {
+      var event float64
+      event, err = number(eventCol)
+      pre.Event = event != 0
+    }
+    if err != nil {
+      return nil, err
+    }
+    if classCol >= 0 {
+      pre.Class = strings.TrimSpace(record[classCol])
+    }
+    pres = append(pres, pre)
+  }
+  return pres, nil
+}
@@ -0,0 +1,126 @@
+// Command cloudml drives a cloudml server from the command line.
+//
+//   cloudml models create --type logistic --covariates intercept,age,gpa
+//   cloudml data load <model> data.csv
+//   cloudml learn <model>
+//   cloudml predict <model> intercept=1 age=40 gpa=3.1
+package main
+
+import (
+  "github.com/aotimme/cloudml/client"
+  "context"
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+)
+
+type Command struct {
+  Name string
+  Args string
+  Help string
+  Run func(ctx context.Context, c *client.Client, args []string) error
+}
+
+var commands = []*Command{
+  &Command{"models create", "--type TYPE --covariates A,B,...", "Create a model", CreateModelCommand},
+  &Command{"models get", "MODEL", "Show a model and its coefficients", GetModelCommand},
+  &Command{"models delete", "MODEL", "Delete a model and its data", DeleteModelCommand},
+  &Command{"ls", "", "List the models", ListModelsCommand},
+  &Command{"data load", "MODEL FILE.csv", "Add the rows of a CSV file as data", LoadDataCommand},
+  &Command{"learn", "MODEL", "Train a model on its data", LearnCommand},
+  &Command{"cv", "MODEL", "Cross-validate a model", CVCommand},
+  &Command{"predict", "MODEL LABEL=VALUE ...", "Predict from covariate values", PredictCommand},
+  &Command{"export", "MODEL [--format json|pmml] [--out FILE]", "Export a trained model", ExportCommand},
+  &Command{"usage", "", "Show the quotas of the API key and their use", UsageCommand},
+  &Command{"keys create", "--role ROLE [--tenant TENANT]", "Create an API key (admin)", CreateKeyCommand},
+  &Command{"keys ls", "", "List the API keys (admin)", ListKeysCommand},
+  &Command{"keys delete", "KEY", "Delete an API key (admin)", DeleteKeyCommand},
+}
+
+var (
+  serverURL = flag.String("url", defaultURL(), "URL of the cloudml server (or $CLOUDML_URL)")
+  apiKey = flag.String("api-key", os.Getenv("CLOUDML_API_KEY"), "API key (or $CLOUDML_API_KEY)")
+  jsonOutput = flag.Bool("json", false, "Print the JSON of the server instead of tables")
+)
+
+func defaultURL() string {
+  if url := os.Getenv("CLOUDML_URL"); url != "" {
+    return url
+  }
+  return "http://localhost:6060"
+}
+
+func usage() {
+  fmt.Fprintf(os.Stderr, "Usage: cloudml [--url URL] [--api-key KEY] [--json] COMMAND ...\n\nCommands:\n")
+  for _, cmd := range commands {
+    fmt.Fprintf(os.Stderr, "  %v\n        %v\n", strings.TrimSpace(cmd.Name + " " + cmd.Args), cmd.Help)
+  }
+  fmt.Fprintf(os.Stderr, "\nFlags:\n")
+  flag.PrintDefaults()
+}
+
+// findCommand matches the leading arguments against the command names, so
+// that "models ls" works as well as "ls".
+func findCommand(args []string) (*Command, []string) {
+  if len(args) >= 2 && args[0] == "models" && args[1] == "ls" {
+    return findCommand(args[1:])
+  }
+  for _, cmd := range commands {
+    words := strings.Fields(cmd.Name)
+    if len(args) < len(words) {
+      continue
+    }
+    if strings.Join(args[:len(words)], " ") == cmd.Name {
+      return cmd, args[len(words):]
+    }
+  }
+  return nil, nil
+}
+
+func main() {
+  flag.Usage = usage
+  flag.Parse()
+  cmd, args := findCommand(flag.Args())
+  if cmd == nil {
+    usage()
+    os.Exit(2)
+  }
+  c := client.New(*serverURL)
+  c.APIKey = *apiKey
+  err := cmd.Run(context.Background(), c, args)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "cloudml %v: %v\n", cmd.Name, err)
+    os.Exit(1)
+  }
+}
+
+// parseFlags parses the flags of a command, which may come before or after
+// its positional arguments, and checks the number of positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string, numArgs int) ([]string, error) {
+  var positional []string
+  for {
+    err := fs.Parse(args)
+    if err != nil {
+      return nil, err
+    }
+    args = fs.Args()
+    if len(args) == 0 {
+      break
+    }
+    positional = append(positional, args[0])
+    args = args[1:]
+  }
+  if numArgs >= 0 && len(positional) != numArgs {
+    return nil, fmt.Errorf("expected %v arguments, got %v", numArgs, len(positional))
+  }
+  return positional, nil
+}
+
+// newFlagSet returns the flags of a command, which include --json so that it
+// can also follow the command.
+func newFlagSet(name string) *flag.FlagSet {
+  fs := flag.NewFlagSet("cloudml " + name, flag.ContinueOnError)
+  fs.BoolVar(jsonOutput, "json", *jsonOutput, "Print the JSON of the server instead of tables")
+  return fs
+}
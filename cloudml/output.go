@@ -0,0 +1,146 @@
+package main
+
+import (
+  "github.com/aotimme/cloudml/client"
+  "encoding/json"
+  "fmt"
+  "os"
+  "sort"
+  "text/tabwriter"
+)
+
+func printJSON(v interface{}) error {
+  data, err := json.MarshalIndent(v, "", "  ")
+  if err != nil {
+    return err
+  }
+  fmt.Println(string(data))
+  return nil
+}
+
+func newTable() *tabwriter.Writer {
+  return tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+}
+
+func formatMetric(v *float64) string {
+  if v == nil {
+    return "-"
+  }
+  return fmt.Sprintf("%.4g", *v)
+}
+
+// metrics returns the training and CV metric of the model's type.
+func metrics(m *client.Model) (string, *float64, *float64) {
+  switch {
+  case m.TrainConcordance != nil || m.CvConcordance != nil:
+    return "concordance", m.TrainConcordance, m.CvConcordance
+  case m.TrainPinball != nil || m.CvPinball != nil:
+    return "pinball", m.TrainPinball, m.CvPinball
+  }
+  return "rmse", m.TrainRmse, m.CvRmse
+}
+
+func printModels(models []*client.Model) {
+  w := newTable()
+  fmt.Fprintln(w, "ID\tTYPE\tDATA\tCOVARIATES\tVERSION\tMETRIC\tTRAIN\tCV")
+  for _, m := range models {
+    name, train, cv := metrics(m)
+    fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", m.Id, m.Type, m.NumTrainingData, m.NumCovariates, m.Version, name, formatMetric(train), formatMetric(cv))
+  }
+  w.Flush()
+}
+
+func printModel(m *client.Model) {
+  printModels([]*client.Model{m})
+  fmt.Println()
+  w := newTable()
+  if len(m.ClassCoefficients) > 0 {
+    fmt.Fprintln(w, "CLASS\tLABEL\tVALUE")
+    for _, c := range m.ClassCoefficients {
+      fmt.Fprintf(w, "%v\t%v\t%g\n", c.Class, c.Label, c.Value)
+    }
+  } else {
+    fmt.Fprintln(w, "LABEL\tVALUE")
+    for _, c := range m.Coefficients {
+      fmt.Fprintf(w, "%v\t%g\n", c.Label, c.Value)
+    }
+  }
+  for _, t := range m.Thresholds {
+    fmt.Fprintf(w, "threshold %g|%g\t%g\n", t.Lower, t.Upper, t.Value)
+  }
+  w.Flush()
+}
+
+func printPrediction(p *client.Prediction) {
+  w := newTable()
+  switch {
+  case p.ClassProbabilities != nil:
+    fmt.Fprintf(w, "class\t%v\n", p.Class)
+    classes := make([]string, 0, len(p.ClassProbabilities))
+    for class := range p.ClassProbabilities {
+      classes = append(classes, class)
+    }
+    sort.Strings(classes)
+    for _, class := range classes {
+      fmt.Fprintf(w, "P(%v)\t%.4g\n", class, p.ClassProbabilities[class])
+    }
+  case p.LevelProbabilities != nil:
+    fmt.Fprintf(w, "level\t%g\n", p.Level)
+    for k, level := range p.Levels {
+      fmt.Fprintf(w, "P(%g)\t%.4g\n", level, p.LevelProbabilities[k])
+    }
+  case p.Survival != nil || p.RelativeHazard != 0:
+    fmt.Fprintf(w, "relative_hazard\t%g\n", p.RelativeHazard)
+    for k, t := range p.Times {
+      fmt.Fprintf(w, "S(%g)\t%.4g\n", t, p.Survival[k])
+    }
+  default:
+    fmt.Fprintf(w, "value\t%g\n", p.Value)
+    if p.StdDev != 0 {
+      fmt.Fprintf(w, "std_dev\t%g\n", p.StdDev)
+      fmt.Fprintf(w, "interval\t%g - %g\n", p.Lower, p.Upper)
+    }
+  }
+  w.Flush()
+}
+
+func printKeys(keys []*client.Key) {
+  w := newTable()
+  fmt.Fprintln(w, "ID\tTENANT\tROLE\tCREATED")
+  for _, k := range keys {
+    fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", k.Id, k.Tenant, k.Role, k.Created.Format("2006-01-02 15:04"))
+  }
+  w.Flush()
+}
+
+// formatLimit formats the used and limit columns; a limit of 0 is none.
+func formatLimit(used int, limit int) string {
+  if limit == 0 {
+    return fmt.Sprintf("%v\t-", used)
+  }
+  return fmt.Sprintf("%v\t%v", used, limit)
+}
+
+func printUsage(u *client.Usage) {
+  l := u.Limits
+  w := newTable()
+  fmt.Fprintf(w, "tenant\t%v\n", u.Tenant)
+  fmt.Fprintf(w, "key\t%v\n", u.Key)
+  fmt.Fprintln(w, "\nQUOTA\tUSED\tLIMIT")
+  if u.RemainingRequests != nil {
+    fmt.Fprintf(w, "requests/s\t%v left\t%g (burst %v)\n", *u.RemainingRequests, l.RateLimit, l.RateBurst)
+  } else {
+    fmt.Fprintf(w, "requests/s\t-\t-\n")
+  }
+  fmt.Fprintf(w, "models\t%v\n", formatLimit(u.Models, l.MaxModels))
+  fmt.Fprintf(w, "training jobs\t%v\n", formatLimit(u.TrainingJobs, l.MaxTrainingJobs))
+  ids := make([]string, 0, len(u.Rows))
+  for id := range u.Rows {
+    ids = append(ids, id)
+  }
+  sort.Strings(ids)
+  for _, id := range ids {
+    fmt.Fprintf(w, "rows of %v\t%v\n", id, formatLimit(u.Rows[id], l.MaxRowsPerModel))
+  }
+  w.Flush()
+}
@@ -0,0 +1,331 @@
+// Package config holds the settings of cloudml-server. Each setting has a
+// default and can be set, in increasing order of precedence, in a YAML or
+// TOML file (-config or $CLOUDML_CONFIG), by a CLOUDML_* environment variable
+// or by a flag. The setting "db-host", for instance, is the flag -db-host,
+// the variable CLOUDML_DB_HOST and the file key db.host (or db_host).
+package config
+
+import (
+  "github.com/aotimme/cloudml/logging"
+  "github.com/BurntSushi/toml"
+  "gopkg.in/yaml.v2"
+  "errors"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+)
+
+type Config struct {
+  Listen string
+  Database Database
+  // LearnWorkers is the number of background training jobs run at once, and
+  // LearnQueue how many more may wait.
+  LearnWorkers int
+  LearnQueue int
+  ReadTimeout time.Duration
+  WriteTimeout time.Duration
+  IdleTimeout time.Duration
+  // RequestTimeout bounds the work of a request, and LearnTimeout that of
+  // training and cross-validation, 0 meaning no limit.
+  RequestTimeout time.Duration
+  LearnTimeout time.Duration
+  // ShutdownTimeout is how long a stopping server waits for requests and
+  // training jobs to finish.
+  ShutdownTimeout time.Duration
+  // MaxRequestBytes limits the size of request bodies and MaxBatchRows the
+  // number of data in one POST to /data.
+  MaxRequestBytes int64
+  MaxBatchRows int
+  // Limits are the default quotas of API keys, which a key may override.
+  Limits Limits
+  // LogLevel is the least level logged: debug, info, warn or error.
+  LogLevel string
+}
+
+// Limits are quotas of API keys, 0 meaning no limit: RateLimit requests a
+// second with bursts of RateBurst, MaxModels models of the key's tenant,
+// MaxRowsPerModel data in each of them and MaxTrainingJobs requests to learn
+// or cross-validate at once.
+type Limits struct {
+  RateLimit float64
+  RateBurst int
+  MaxModels int
+  MaxRowsPerModel int
+  MaxTrainingJobs int
+}
+
+// Database is where models are stored. DSN, if given, is used as is instead
+// of the other connection settings.
+type Database struct {
+  DSN string
+  Host string
+  Port int
+  User string
+  Password string
+  Name string
+  SSLMode string
+  MaxOpenConns int
+  MaxIdleConns int
+}
+
+func Default() *Config {
+  return &Config{
+    Listen: ":6060",
+    Database: Database{
+      SSLMode: "disable",
+      MaxIdleConns: 2,
+    },
+    LearnWorkers: 1,
+    LearnQueue: 1000,
+    ReadTimeout: 30 * time.Second,
+    WriteTimeout: 5 * time.Minute,
+    IdleTimeout: 2 * time.Minute,
+    RequestTimeout: 30 * time.Second,
+    LearnTimeout: 4 * time.Minute,
+    ShutdownTimeout: 30 * time.Second,
+    MaxRequestBytes: 32 << 20,
+    MaxBatchRows: 10000,
+    Limits: Limits{
+      RateLimit: 50,
+      RateBurst: 100,
+      MaxModels: 1000,
+      MaxRowsPerModel: 10000000,
+      MaxTrainingJobs: 2,
+    },
+    LogLevel: "info",
+  }
+}
+
+func (c *Config) flagSet() *flag.FlagSet {
+  fs := flag.NewFlagSet("cloudml-server", flag.ContinueOnError)
+  fs.StringVar(&c.Listen, "listen", c.Listen, "Address to listen on")
+  fs.StringVar(&c.Database.DSN, "db-dsn", c.Database.DSN, "Database connection string, instead of the other db settings")
+  fs.StringVar(&c.Database.Host, "db-host", c.Database.Host, "Database host")
+  fs.IntVar(&c.Database.Port, "db-port", c.Database.Port, "Database port")
+  fs.StringVar(&c.Database.User, "db-user", c.Database.User, "Database user")
+  fs.StringVar(&c.Database.Password, "db-password", c.Database.Password, "Database password")
+  fs.StringVar(&c.Database.Name, "db-name", c.Database.Name, "Database name")
+  fs.StringVar(&c.Database.SSLMode, "db-sslmode", c.Database.SSLMode, "Database SSL mode")
+  fs.IntVar(&c.Database.MaxOpenConns, "db-max-open-conns", c.Database.MaxOpenConns, "Maximum open database connections (0 for no limit)")
+  fs.IntVar(&c.Database.MaxIdleConns, "db-max-idle-conns", c.Database.MaxIdleConns, "Maximum idle database connections")
+  fs.IntVar(&c.LearnWorkers, "learn-workers", c.LearnWorkers, "Number of background training jobs run at once")
+  fs.IntVar(&c.LearnQueue, "learn-queue", c.LearnQueue, "Number of background training jobs that may wait")
+  fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "Time to read a request")
+  fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "Time to handle a request and write the response")
+  fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "Time to keep idle connections open")
+  fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "Time to handle a request other than learning (0 for no limit)")
+  fs.DurationVar(&c.LearnTimeout, "learn-timeout", c.LearnTimeout, "Time to train or cross-validate a model (0 for no limit)")
+  fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "Time to wait for requests and training jobs when stopping")
+  fs.Int64Var(&c.MaxRequestBytes, "max-request-bytes", c.MaxRequestBytes, "Maximum size of a request body")
+  fs.IntVar(&c.MaxBatchRows, "max-batch-rows", c.MaxBatchRows, "Maximum number of data in one request")
+  fs.Float64Var(&c.Limits.RateLimit, "limits-rate", c.Limits.RateLimit, "Requests a second per API key (0 for no limit)")
+  fs.IntVar(&c.Limits.RateBurst, "limits-rate-burst", c.Limits.RateBurst, "Requests an API key may make at once within its rate")
+  fs.IntVar(&c.Limits.MaxModels, "limits-max-models", c.Limits.MaxModels, "Models per tenant (0 for no limit)")
+  fs.IntVar(&c.Limits.MaxRowsPerModel, "limits-max-rows-per-model", c.Limits.MaxRowsPerModel, "Data per model (0 for no limit)")
+  fs.IntVar(&c.Limits.MaxTrainingJobs, "limits-max-training-jobs", c.Limits.MaxTrainingJobs, "Training jobs per API key at once (0 for no limit)")
+  fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Least level logged: debug, info, warn or error")
+  return fs
+}
+
+// Load reads the settings from the file, the environment and the flags in
+// args, and validates them.
+func Load(args []string) (*Config, error) {
+  c := Default()
+  fs := c.flagSet()
+  path := fs.String("config", os.Getenv("CLOUDML_CONFIG"), "YAML or TOML file of settings")
+  err := fs.Parse(args)
+  if err != nil {
+    return nil, err
+  }
+  if fs.NArg() > 0 {
+    return nil, fmt.Errorf("Unexpected argument %q", fs.Arg(0))
+  }
+  // the file and environment are applied over the flags, which are then
+  // applied again so that they take precedence
+  flags := make(map[string]string)
+  fs.Visit(func(f *flag.Flag) {
+    flags[f.Name] = f.Value.String()
+  })
+  if *path != "" {
+    err = loadFile(fs, *path)
+    if err != nil {
+      return nil, err
+    }
+  }
+  var envErr error
+  fs.VisitAll(func(f *flag.Flag) {
+    if f.Name == "config" {
+      return
+    }
+    name := "CLOUDML_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+    value, ok := os.LookupEnv(name)
+    if ok && envErr == nil {
+      err := f.Value.Set(value)
+      if err != nil {
+        envErr = fmt.Errorf("Invalid %v: %v", name, err)
+      }
+    }
+  })
+  if envErr != nil {
+    return nil, envErr
+  }
+  for name, value := range flags {
+    fs.Set(name, value)
+  }
+  err = c.Validate()
+  if err != nil {
+    return nil, err
+  }
+  return c, nil
+}
+
+// loadFile sets the flags named by the keys of the file, nested keys being
+// joined with "-".
+func loadFile(fs *flag.FlagSet, path string) error {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return err
+  }
+  values := make(map[string]interface{})
+  switch strings.ToLower(filepath.Ext(path)) {
+  case ".yaml", ".yml":
+    err = yaml.Unmarshal(data, &values)
+  case ".toml":
+    _, err = toml.Decode(string(data), &values)
+  default:
+    return fmt.Errorf("Config file %v is neither .yaml, .yml nor .toml", path)
+  }
+  if err != nil {
+    return fmt.Errorf("Reading %v: %v", path, err)
+  }
+  settings := make(map[string]string)
+  flatten("", values, settings)
+  names := make([]string, 0, len(settings))
+  for name := range settings {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    if name == "config" || fs.Lookup(name) == nil {
+      return fmt.Errorf("Reading %v: unknown setting %q", path, name)
+    }
+    err = fs.Set(name, settings[name])
+    if err != nil {
+      return fmt.Errorf("Reading %v: invalid %v: %v", path, name, err)
+    }
+  }
+  return nil
+}
+
+// flatten turns the nested maps of a decoded file into settings. YAML maps
+// have interface{} keys and TOML maps string keys.
+func flatten(prefix string, value interface{}, settings map[string]string) {
+  var m map[string]interface{}
+  switch v := value.(type) {
+  case map[string]interface{}:
+    m = v
+  case map[interface{}]interface{}:
+    m = make(map[string]interface{})
+    for key, val := range v {
+      m[fmt.Sprint(key)] = val
+    }
+  default:
+    settings[prefix] = fmt.Sprint(value)
+    return
+  }
+  for key, val := range m {
+    name := strings.Replace(strings.ToLower(key), "_", "-", -1)
+    if prefix != "" {
+      name = prefix + "-" + name
+    }
+    flatten(name, val, settings)
+  }
+}
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+func (c *Config) Validate() error {
+  if c.Listen == "" {
+    return errors.New("listen must be set")
+  }
+  d := c.Database
+  if d.Port < 0 || d.Port > 65535 {
+    return fmt.Errorf("db-port %v is out of range", d.Port)
+  }
+  validSSLMode := false
+  for _, mode := range sslModes {
+    validSSLMode = validSSLMode || d.SSLMode == mode
+  }
+  if !validSSLMode {
+    return fmt.Errorf("db-sslmode must be one of %v", strings.Join(sslModes, ", "))
+  }
+  if d.MaxOpenConns < 0 || d.MaxIdleConns < 0 {
+    return errors.New("db-max-open-conns and db-max-idle-conns must not be negative")
+  }
+  if c.LearnWorkers < 1 {
+    return errors.New("learn-workers must be at least 1")
+  }
+  if c.LearnQueue < 0 {
+    return errors.New("learn-queue must not be negative")
+  }
+  if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 || c.RequestTimeout < 0 || c.LearnTimeout < 0 || c.ShutdownTimeout < 0 {
+    return errors.New("Timeouts must not be negative")
+  }
+  if c.MaxRequestBytes <= 0 {
+    return errors.New("max-request-bytes must be positive")
+  }
+  if c.MaxBatchRows <= 0 {
+    return errors.New("max-batch-rows must be positive")
+  }
+  l := c.Limits
+  if l.RateLimit < 0 || l.RateBurst < 0 || l.MaxModels < 0 || l.MaxRowsPerModel < 0 || l.MaxTrainingJobs < 0 {
+    return errors.New("Limits must not be negative")
+  }
+  if l.RateLimit > 0 && l.RateBurst < 1 {
+    return errors.New("limits-rate-burst must be at least 1 with a limits-rate")
+  }
+  _, err := logging.ParseLevel(c.LogLevel)
+  if err != nil {
+    return errors.New("log-level must be one of debug, info, warn or error")
+  }
+  return nil
+}
+
+// DataSourceName returns the connection string for lib/pq.
+func (d *Database) DataSourceName() string {
+  if d.DSN != "" {
+    return d.DSN
+  }
+  options := []string{"sslmode=" + quote(d.SSLMode)}
+  if d.Host != "" {
+    options = append(options, "host=" + quote(d.Host))
+  }
+  if d.Port != 0 {
+    options = append(options, fmt.Sprintf("port=%v", d.Port))
+  }
+  if d.Name != "" {
+    options = append(options, "dbname=" + quote(d.Name))
+  }
+  if d.User != "" {
+    options = append(options, "user=" + quote(d.User))
+  }
+  if d.Password != "" {
+    options = append(options, "password=" + quote(d.Password))
+  }
+  return strings.Join(options, " ")
+}
+
+// quote quotes a connection string value if it needs to be.
+func quote(value string) string {
+  if value != "" && !strings.ContainsAny(value, " '\\") {
+    return value
+  }
+  value = strings.Replace(value, "\\", "\\\\", -1)
+  value = strings.Replace(value, "'", "\\'", -1)
+  return "'" + value + "'"
+}
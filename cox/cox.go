@@ -0,0 +1,324 @@
+package cox
+
+import (
+  "github.com/aotimme/cloudml/glm"
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "fmt"
+  "math"
+  "math/rand"
+  "sort"
+  "github.com/skelterjohn/go.matrix"
+)
+
+func dot(vec1, vec2 []float64) (val float64) {
+  for i, v := range vec1 {
+    val += v * vec2[i]
+  }
+  return
+}
+
+// Predict returns the relative hazard exp(x·β + offset).
+func Predict(beta []float64, covariates []float64, offset float64) float64 {
+  return math.Exp(dot(beta, covariates) + offset)
+}
+
+// Survival returns S(t) = exp(-H₀(t) · relativeHazard), where the cumulative
+// baseline hazard H₀ is the step function given by times and cumulative.
+func Survival(times []float64, cumulative []float64, relativeHazard float64, t float64) float64 {
+  // index of the first event time after t
+  k := sort.Search(len(times), func(k int) bool { return times[k] > t })
+  if k == 0 {
+    return 1.0
+  }
+  return math.Exp(-cumulative[k - 1] * relativeHazard)
+}
+
+// byDuration returns the indices of the data ordered by decreasing duration,
+// so that the risk set of a datum is everything up to and including its
+// group of tied durations.
+func byDuration(durations []float64) []int {
+  order := make([]int, len(durations))
+  for i := range order {
+    order[i] = i
+  }
+  sort.Slice(order, func(a, b int) bool { return durations[order[a]] > durations[order[b]] })
+  return order
+}
+
+// objective is the weighted Breslow partial log likelihood less the ridge
+// penalty.
+func objective(beta []float64, data [][]float64, durations []float64, events []bool, weights []float64, offsets []float64, lambda float64) float64 {
+  obj := -0.5 * lambda * dot(beta, beta)
+  order := byDuration(durations)
+  s0 := 0.0
+  for start := 0; start < len(order); {
+    end := start
+    for end < len(order) && durations[order[end]] == durations[order[start]] {
+      i := order[end]
+      s0 += weights[i] * math.Exp(dot(beta, data[i]) + offsets[i])
+      end++
+    }
+    for _, i := range order[start:end] {
+      if events[i] {
+        obj += weights[i] * (dot(beta, data[i]) + offsets[i] - math.Log(s0))
+      }
+    }
+    start = end
+  }
+  if math.IsNaN(obj) {
+    return math.Inf(-1)
+  }
+  return obj
+}
+
+// Learn fits the coefficients by Newton-Raphson on the weighted Breslow
+// partial likelihood, halving steps that would decrease it. It also returns
+// the number of iterations run. Once ctx is done it stops with ctx.Err().
+// Without a penalty it needs more data than covariates.
+func Learn(ctx context.Context, data [][]float64, durations []float64, events []bool, weights []float64, offsets []float64, lambda float64, betaStart []float64, iterations int) ([]float64, int, error) {
+  n := len(data)
+  p := len(betaStart)
+  beta := make([]float64, p)
+  copy(beta, betaStart)
+  if p >= n && lambda == 0 {
+    return nil, 0, glm.ErrTooFewData
+  }
+  order := byDuration(durations)
+  obj := objective(beta, data, durations, events, weights, offsets, lambda)
+  iter := 0
+  for {
+    if ctx.Err() != nil {
+      return nil, iter, ctx.Err()
+    }
+    iter++
+    gradient := matrix.Zeros(p, 1)
+    hessian := matrix.Eye(p)
+    hessian.Scale(lambda)
+    for j := 0; j < p; j++ {
+      gradient.Set(j, 0, -lambda * beta[j])
+    }
+    s0 := 0.0
+    s1 := make([]float64, p)
+    s2 := make([][]float64, p)
+    for j := range s2 {
+      s2[j] = make([]float64, p)
+    }
+    for start := 0; start < n; {
+      end := start
+      for end < n && durations[order[end]] == durations[order[start]] {
+        i := order[end]
+        x := data[i]
+        r := weights[i] * math.Exp(dot(beta, x) + offsets[i])
+        s0 += r
+        for j := 0; j < p; j++ {
+          s1[j] += r * x[j]
+          for k := 0; k < p; k++ {
+            s2[j][k] += r * x[j] * x[k]
+          }
+        }
+        end++
+      }
+      d := 0.0
+      for _, i := range order[start:end] {
+        if events[i] {
+          d += weights[i]
+          for j := 0; j < p; j++ {
+            gradient.Set(j, 0, gradient.Get(j, 0) + weights[i] * data[i][j])
+          }
+        }
+      }
+      if d > 0.0 {
+        for j := 0; j < p; j++ {
+          gradient.Set(j, 0, gradient.Get(j, 0) - d * s1[j] / s0)
+          for k := 0; k < p; k++ {
+            hessian.Set(j, k, hessian.Get(j, k) + d * (s2[j][k] / s0 - s1[j] * s1[k] / (s0 * s0)))
+          }
+        }
+      }
+      start = end
+    }
+    hessInv, err := hessian.Inverse()
+    if err != nil {
+      return nil, iter, err
+    }
+    diff, err := hessInv.TimesDense(gradient)
+    if err != nil {
+      return nil, iter, err
+    }
+    step := 1.0
+    newBeta := make([]float64, p)
+    for halvings := 0; ; halvings++ {
+      for j := range newBeta {
+        newBeta[j] = beta[j] + step * diff.Get(j, 0)
+      }
+      newObj := objective(newBeta, data, durations, events, weights, offsets, lambda)
+      if newObj >= obj || halvings >= 30 {
+        obj = newObj
+        break
+      }
+      step /= 2.0
+    }
+    beta = newBeta
+    if step * diff.TwoNorm() < 1e-6 {
+      logging.Debugf(ctx, "Converged after %v iterations", iter)
+      break
+    }
+    if iter >= iterations {
+      logging.Warnf(ctx, "Did not converge after %v iterations", iter)
+      break
+    }
+  }
+  return beta, iter, nil
+}
+
+// BaselineHazard returns the Breslow estimate of the cumulative baseline
+// hazard H₀ at each distinct event time, in increasing order of time.
+func BaselineHazard(beta []float64, data [][]float64, durations []float64, events []bool, weights []float64, offsets []float64) ([]float64, []float64) {
+  order := byDuration(durations)
+  var times, hazards []float64
+  s0 := 0.0
+  for start := 0; start < len(order); {
+    end := start
+    for end < len(order) && durations[order[end]] == durations[order[start]] {
+      i := order[end]
+      s0 += weights[i] * Predict(beta, data[i], offsets[i])
+      end++
+    }
+    d := 0.0
+    for _, i := range order[start:end] {
+      if events[i] {
+        d += weights[i]
+      }
+    }
+    if d > 0.0 {
+      times = append(times, durations[order[start]])
+      hazards = append(hazards, d / s0)
+    }
+    start = end
+  }
+  // times were collected in decreasing order
+  cumulative := make([]float64, len(times))
+  total := 0.0
+  for k := len(times) - 1; k >= 0; k-- {
+    total += hazards[k]
+    cumulative[len(times) - 1 - k] = total
+  }
+  for a, b := 0, len(times) - 1; a < b; a, b = a + 1, b - 1 {
+    times[a], times[b] = times[b], times[a]
+  }
+  return times, cumulative
+}
+
+// Concordance is Harrell's C index: the fraction of comparable pairs whose
+// predicted hazards are ordered consistently with their event times.
+func Concordance(beta []float64, data [][]float64, durations []float64, events []bool, offsets []float64) float64 {
+  risks := make([]float64, len(data))
+  for i, datum := range data {
+    risks[i] = dot(beta, datum) + offsets[i]
+  }
+  concordant := 0.0
+  comparable := 0.0
+  for i := range data {
+    if !events[i] {
+      continue
+    }
+    for j := range data {
+      if durations[j] <= durations[i] {
+        continue
+      }
+      comparable++
+      if risks[i] > risks[j] {
+        concordant++
+      } else if risks[i] == risks[j] {
+        concordant += 0.5
+      }
+    }
+  }
+  if comparable == 0.0 {
+    return 0.5
+  }
+  return concordant / comparable
+}
+
+func CV(ctx context.Context, data [][]float64, durations []float64, events []bool, weights []float64, offsets []float64, lambda float64) (float64, error) {
+  fold := 5
+  n := len(data)
+  p := len(data[0])
+  // NOTE: stop if p > fold*n
+  perm := rand.Perm(n)
+  for i, j := range perm {
+    data[i], data[j] = data[j], data[i]
+    durations[i], durations[j] = durations[j], durations[i]
+    events[i], events[j] = events[j], events[i]
+    weights[i], weights[j] = weights[j], weights[i]
+    offsets[i], offsets[j] = offsets[j], offsets[i]
+  }
+  numPer := n / fold
+  mod := n % fold
+  cv := 0.0
+  numRun := 0
+  var foldErr error
+  for i := 0; i < fold; i++ {
+    minBreakVal := 0
+    for j := 0; j < i; j++ {
+      minBreakVal += numPer
+      if j < mod {
+        minBreakVal++
+      }
+    }
+    maxBreakVal := 0
+    for j := 0; j < i + 1; j++ {
+      maxBreakVal += numPer
+      if j < mod {
+        maxBreakVal++
+      }
+    }
+    num := maxBreakVal - minBreakVal
+    trainDurations := make([]float64, n - num)
+    trainEvents := make([]bool, n - num)
+    trainWeights := make([]float64, n - num)
+    trainOffsets := make([]float64, n - num)
+    trainData := make([][]float64, n - num)
+    testDurations := make([]float64, num)
+    testEvents := make([]bool, num)
+    testOffsets := make([]float64, num)
+    testData := make([][]float64, num)
+    for j := 0; j < n; j++ {
+      if j < minBreakVal {
+        trainData[j] = data[j]
+        trainDurations[j] = durations[j]
+        trainEvents[j] = events[j]
+        trainWeights[j] = weights[j]
+        trainOffsets[j] = offsets[j]
+      } else if j < maxBreakVal {
+        testData[j - minBreakVal] = data[j]
+        testDurations[j - minBreakVal] = durations[j]
+        testEvents[j - minBreakVal] = events[j]
+        testOffsets[j - minBreakVal] = offsets[j]
+      } else {
+        trainData[j - num] = data[j]
+        trainDurations[j - num] = durations[j]
+        trainEvents[j - num] = events[j]
+        trainWeights[j - num] = weights[j]
+        trainOffsets[j - num] = offsets[j]
+      }
+    }
+    betas, _, err := Learn(ctx, trainData, trainDurations, trainEvents, trainWeights, trainOffsets, lambda, make([]float64, p), 100)
+    if err != nil {
+      if ctx.Err() != nil {
+        return 0.0, ctx.Err()
+      }
+      logging.Warnf(ctx, "CV error: %v", err)
+      foldErr = err
+      continue
+    }
+    numRun++
+    cv += Concordance(betas, testData, testDurations, testEvents, testOffsets)
+  }
+  if numRun == 0 {
+    return 0.0, fmt.Errorf("Cross-validation failed on every fold: %w", foldErr)
+  }
+  cv /= float64(numRun)
+  return cv, nil
+}
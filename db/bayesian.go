@@ -0,0 +1,115 @@
+package db
+
+import (
+  "github.com/aotimme/cloudml/bayesian"
+  "github.com/aotimme/cloudml/linear"
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "errors"
+)
+
+// ConfigureBayesian checks the prior of a new bayesian linear model and fills
+// in the defaults. With empirical Bayes they are only the starting point of
+// the estimates.
+func (m *Model) ConfigureBayesian() error {
+  if m.PriorPrecision == 0.0 {
+    m.PriorPrecision = 1.0
+  }
+  if m.NoiseVariance == 0.0 {
+    m.NoiseVariance = 1.0
+  }
+  if m.PriorPrecision < 0.0 || m.NoiseVariance < 0.0 {
+    return errors.New("prior_precision and noise_variance must be positive")
+  }
+  return nil
+}
+
+func (m *Model) GetPosteriorCovariances(ctx context.Context) ([]PosteriorCovariance, error) {
+  var posteriorCovariances []PosteriorCovariance
+  _, err := withContext(ctx).Select(&posteriorCovariances, "select * from posterior_covariances where model=:model", map[string]interface{} {"model": m.Id})
+  if err != nil {
+    return nil, err
+  }
+  return posteriorCovariances, nil
+}
+
+// updatePosterior refits a bayesian_linear model once its data have changed.
+// The change is already saved, so a failure is only logged; the posterior is
+// brought up to date by the next change or learn.
+func (m *Model) updatePosterior(ctx context.Context) {
+  if m.Type != "bayesian_linear" {
+    return
+  }
+  err := m.learn(ctx)
+  if err != nil {
+    logging.Errorf(ctx, "Updating the posterior of model %v: %v", m.Id, err)
+  }
+}
+
+// GetPosteriorCovarianceArray returns the posterior covariance of the
+// coefficients (ordered by label), which is the prior covariance until the
+// model has been updated.
+func GetPosteriorCovarianceArray(m *Model, posteriorCovariances []PosteriorCovariance) [][]float64 {
+  p := m.NumCovariates
+  covariance := make([][]float64, p)
+  for j := range covariance {
+    covariance[j] = make([]float64, p)
+  }
+  if len(posteriorCovariances) != p * (p + 1) / 2 {
+    for j := range covariance {
+      covariance[j][j] = 1.0 / m.PriorPrecision
+    }
+    return covariance
+  }
+  for _, c := range posteriorCovariances {
+    covariance[c.Row][c.Col] = c.Value
+    covariance[c.Col][c.Row] = c.Value
+  }
+  return covariance
+}
+
+// trainBayesian updates the posterior from the sufficient statistics. As they
+// already include every datum, this is also how the posterior is updated
+// sequentially as data arrive.
+func (f *Fit) trainBayesian(ctx context.Context, xtx [][]float64, xty []float64, yty float64) error {
+  m := f.Model
+  var err error
+  if m.EmpiricalBayes {
+    m.PriorPrecision, m.NoiseVariance, f.Iterations, err = bayesian.EmpiricalBayes(ctx, xtx, xty, yty, m.SumWeights, m.PriorPrecision, m.NoiseVariance, 100)
+    if err != nil {
+      logging.Errorf(ctx, "Error estimating prior: %v", err)
+      return err
+    }
+  }
+  mean, covariance, err := bayesian.Posterior(xtx, xty, m.PriorPrecision, m.NoiseVariance)
+  if err != nil {
+    logging.Errorf(ctx, "Error computing posterior: %v", err)
+    return err
+  }
+  m.TrainRmse = linear.RMSEFromStatistics(mean, xtx, xty, yty, m.SumWeights)
+  f.setCoefficients(mean)
+  var posteriorCovariances []PosteriorCovariance
+  for j := range covariance {
+    for k := j; k < len(covariance); k++ {
+      posteriorCovariances = append(posteriorCovariances, PosteriorCovariance{
+        Row: j,
+        Col: k,
+        Value: covariance[j][k],
+      })
+    }
+  }
+  f.Parameters.PosteriorCovariances = posteriorCovariances
+  return nil
+}
+
+// PredictPosterior returns the mean and variance of the posterior predictive
+// distribution of a bayesian linear model.
+func (f *Fit) PredictPosterior(covariates map[string]float64, offset float64) (float64, float64, error) {
+  m := f.Model
+  if m.Type != "bayesian_linear" {
+    return 0.0, 0.0, errors.New("Model has no posterior")
+  }
+  covariance := GetPosteriorCovarianceArray(m, f.Parameters.PosteriorCovariances)
+  mean, variance := bayesian.Predict(GetCoefficientsArrayFromCoefficients(f.Coefficients), covariance, f.covariateArray(covariates), offset, m.NoiseVariance)
+  return mean, variance, nil
+}
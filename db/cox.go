@@ -0,0 +1,56 @@
+package db
+
+import (
+  "github.com/aotimme/cloudml/cox"
+  "context"
+  "errors"
+)
+
+func (m *Model) GetBaselineHazards(ctx context.Context) ([]BaselineHazard, error) {
+  var baselineHazards []BaselineHazard
+  _, err := withContext(ctx).Select(&baselineHazards, "select * from baseline_hazards where model=:model order by time", map[string]interface{} {"model": m.Id})
+  if err != nil {
+    return nil, err
+  }
+  return baselineHazards, nil
+}
+
+func (f *Fit) trainCox(ctx context.Context, d *DataArray) error {
+  m := f.Model
+  beta, iterations, err := cox.Learn(ctx, d.Covariates, d.Durations, d.Events, d.Weights, d.Offsets, m.Lambda, GetCoefficientsArrayFromCoefficients(f.Coefficients), 100)
+  if err != nil {
+    return err
+  }
+  f.Iterations = iterations
+  m.TrainConcordance = cox.Concordance(beta, d.Covariates, d.Durations, d.Events, d.Offsets)
+  f.setCoefficients(beta)
+  times, cumulative := cox.BaselineHazard(beta, d.Covariates, d.Durations, d.Events, d.Weights, d.Offsets)
+  baselineHazards := make([]BaselineHazard, len(times))
+  for k, t := range times {
+    baselineHazards[k].Time = t
+    baselineHazards[k].Value = cumulative[k]
+  }
+  f.Parameters.BaselineHazards = baselineHazards
+  return nil
+}
+
+// PredictSurvival returns the relative hazard of a Cox model and the
+// survival probability at each of the given times.
+func (f *Fit) PredictSurvival(covariates map[string]float64, offset float64, times []float64) (float64, []float64, error) {
+  if f.Model.Type != "cox" {
+    return 0.0, nil, errors.New("Model does not predict survival")
+  }
+  baselineHazards := f.Parameters.BaselineHazards
+  relativeHazard := cox.Predict(GetCoefficientsArrayFromCoefficients(f.Coefficients), f.covariateArray(covariates), offset)
+  hazardTimes := make([]float64, len(baselineHazards))
+  cumulative := make([]float64, len(baselineHazards))
+  for k, baselineHazard := range baselineHazards {
+    hazardTimes[k] = baselineHazard.Time
+    cumulative[k] = baselineHazard.Value
+  }
+  survival := make([]float64, len(times))
+  for k, t := range times {
+    survival[k] = cox.Survival(hazardTimes, cumulative, relativeHazard, t)
+  }
+  return relativeHazard, survival, nil
+}
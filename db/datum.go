@@ -1,109 +1,356 @@
 package db
 
 import (
-  "log"
+  "github.com/aotimme/cloudml/logging"
+  "github.com/aotimme/cloudml/metrics"
+  "github.com/coopernurse/gorp"
+  "context"
+  "fmt"
+  "math"
 )
 
-func (m *Model) CreateDatum(covMap map[string]float64, value float64) (*Datum, error) {
-  datumId, err := newUUID()
+// GetWeightAndOffset returns a datum's weight (1 if unset) and offset. An
+// exposure is added to the offset on the log scale.
+func GetWeightAndOffset(weight *float64, offset float64, exposure *float64) (float64, float64, error) {
+  w := 1.0
+  if weight != nil {
+    w = *weight
+    if w < 0.0 {
+      return 0.0, 0.0, newError(Invalid, "Weight must be non-negative")
+    }
+  }
+  if exposure != nil {
+    if *exposure <= 0.0 {
+      return 0.0, 0.0, newError(Invalid, "Exposure must be positive")
+    }
+    offset += math.Log(*exposure)
+  }
+  return w, offset, nil
+}
+
+// checkDatum checks the value and duration of d for models that need no
+// lookup of their classes or levels.
+func (m *Model) checkDatum(d *Datum) error {
+  if m.IsGLM() {
+    g, err := m.GetGLM()
+    if err != nil {
+      return err
+    }
+    if !g.Family.Valid(d.Value) {
+      return newError(Unprocessable, "Value %v is outside the support of the %v family", d.Value, g.Family.Name())
+    }
+  } else if m.Type == "cox" {
+    if d.Duration < 0.0 {
+      return newError(Unprocessable, "Duration %v is negative", d.Duration)
+    }
+  }
+  return nil
+}
+
+// CheckDatum checks d as CreateDatum would before adding it to the model of
+// f.
+func (f *Fit) CheckDatum(d *Datum) error {
+  m := f.Model
+  if m.Type == "multinomial" {
+    for _, class := range GetClasses(f.Parameters.ClassCoefficients) {
+      if class == d.Class {
+        return nil
+      }
+    }
+    return newError(Unprocessable, "Unknown class %q", d.Class)
+  } else if m.Type == "ordinal" {
+    for _, level := range GetLevels(f.Parameters.Thresholds) {
+      if level == d.Value {
+        return nil
+      }
+    }
+    return newError(Unprocessable, "Unknown level %v", d.Value)
+  }
+  return m.checkDatum(d)
+}
+
+// CreateDatum saves d, whose Value, Weight, Offset, Class, Duration and Event
+// are set by the caller, along with its covariates.
+func (m *Model) CreateDatum(ctx context.Context, covMap map[string]float64, d *Datum, maxRows int) (*Datum, error) {
+  err := m.CreateData(ctx, []map[string]float64{covMap}, []*Datum{d}, maxRows)
   if err != nil {
-    log.Printf("Error creating UUID: %v\n", err)
     return nil, err
   }
-  coefficients, err := m.GetCoefficients()
+  return d, nil
+}
+
+// CreateData saves a batch of data with their covariates, covMaps[i] being
+// those of data[i], in one transaction: either all of them are saved or none
+// is. The error of an invalid datum is a *DatumError with its index. If the
+// model would have more than maxRows data (0 for no limit) the error is of
+// kind Quota; the count is locked first, so concurrent batches cannot
+// together exceed it.
+func (m *Model) CreateData(ctx context.Context, covMaps []map[string]float64, data []*Datum, maxRows int) error {
+  fit, err := m.GetFit(ctx)
   if err != nil {
-    return nil, err
+    return err
+  }
+  for i, d := range data {
+    err = fit.CheckDatum(d)
+    if err != nil {
+      return &DatumError{Index: i, Err: err}
+    }
+  }
+  var delta statisticsDelta
+  if m.HasStatistics() {
+    delta = newStatisticsDelta(len(fit.Coefficients))
   }
-  covariates := make([]Covariate, len(coefficients))
-  for i, coefficient := range coefficients {
-    covId, err := newUUID()
+  covariates := make([][]Covariate, len(data))
+  sumWeights := 0.0
+  for i, d := range data {
+    datumId, err := newUUID()
     if err != nil {
-      log.Printf("Error creating UUID: %v\n", err)
-      return nil, err
+      logging.Errorf(ctx, "Error creating UUID: %v", err)
+      return err
+    }
+    covariates[i] = make([]Covariate, len(fit.Coefficients))
+    for j, coefficient := range fit.Coefficients {
+      covId, err := newUUID()
+      if err != nil {
+        logging.Errorf(ctx, "Error creating UUID: %v", err)
+        return err
+      }
+      covariates[i][j] = Covariate{
+        Id: covId,
+        Datum: datumId,
+        Label: coefficient.Label,
+        Value: covMaps[i][coefficient.Label],
+      }
+    }
+    d.Id = datumId
+    d.Model = m.Id
+    sumWeights += d.Weight
+    if delta != nil {
+      delta.add(covariates[i], d.Value - d.Offset, d.Weight)
+    }
+  }
+  txn, err := withContext(ctx).Begin()
+  if err != nil {
+    return err
+  }
+  if maxRows > 0 {
+    err = m.lockCounts(txn)
+    if err == nil {
+      err = m.checkRowQuota(len(data), maxRows)
+    }
+    if err != nil {
+      txn.Rollback()
+      return err
     }
-    covariates[i].Label = coefficient.Label
-    covariates[i].Value = covMap[coefficient.Label]
-    covariates[i].Datum = datumId
-    covariates[i].Id = covId
   }
-  d := &Datum{
-    Id: datumId,
-    Value: value,
-    Model: m.Id,
+  for i, d := range data {
+    err = txn.Insert(d)
+    for j := range covariates[i] {
+      if err == nil {
+        err = txn.Insert(&covariates[i][j])
+      }
+    }
+    if err != nil {
+      txn.Rollback()
+      return fmt.Errorf("Saving datum: %w", err)
+    }
   }
-  m.NumTrainingData++
-  txn, err := DBMAP.Begin()
+  err = m.addCounts(txn, len(data), sumWeights)
   if err != nil {
-    return nil, err
+    txn.Rollback()
+    return fmt.Errorf("Saving data: %w", err)
   }
-  txn.Insert(d)
-  txn.Update(m)
-  for _, covariate := range covariates {
-    txn.Insert(&covariate)
+  if delta != nil {
+    err = updateStatistics(txn, m.Id, delta)
+    if err != nil {
+      txn.Rollback()
+      return fmt.Errorf("Updating statistics: %w", err)
+    }
   }
   err = txn.Commit()
   if err != nil {
-    return nil, err
+    return err
   }
-  return d, nil
+  metrics.DataRows.WithLabelValues(m.Type).Add(float64(len(data)))
+  m.updatePosterior(ctx)
+  return nil
+}
+
+// checkRowQuota returns a Quota error if n more data would give the model
+// more than maxRows.
+func (m *Model) checkRowQuota(n int, maxRows int) error {
+  if m.NumTrainingData + n <= maxRows {
+    return nil
+  }
+  return newError(Quota, "Model %v has %v data; %v more would exceed its limit of %v", m.Id, m.NumTrainingData, n, maxRows)
 }
 
-func (m *Model) GetData() ([]*Datum, error) {
+// addCounts adds n data of total weight sumWeights to the model's counts in
+// the database, so that concurrent inserts do not undo each other, and reads
+// the new counts into m.
+func (m *Model) addCounts(txn *gorp.Transaction, n int, sumWeights float64) error {
+  _, err := txn.Exec("update models set num_training_data = num_training_data + $1, sum_weights = sum_weights + $2 where id=$3", n, sumWeights, m.Id)
+  if err != nil {
+    return err
+  }
+  return m.lockCounts(txn)
+}
+
+// lockCounts locks the model's row until the end of txn and reads its data
+// counts into m, so that saving m in txn keeps the counts of data added
+// since m was read.
+func (m *Model) lockCounts(txn *gorp.Transaction) error {
+  n, err := txn.SelectInt("select num_training_data from models where id=$1 for update", m.Id)
+  if err != nil {
+    return err
+  }
+  sumWeights, err := txn.SelectFloat("select sum_weights from models where id=$1", m.Id)
+  if err != nil {
+    return err
+  }
+  m.NumTrainingData = int(n)
+  m.SumWeights = sumWeights
+  return nil
+}
+
+func (m *Model) DeleteDatum(ctx context.Context, d *Datum) error {
+  covariates, err := d.GetCovariates(ctx)
+  if err != nil {
+    return err
+  }
+  txn, err := withContext(ctx).Begin()
+  if err != nil {
+    return err
+  }
+  _, err = txn.Exec("delete from covariates where datum=$1", d.Id)
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+  result, err := txn.Exec("delete from data where id=$1", d.Id)
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+  // a concurrent delete may have removed it since it was read
+  n, err := result.RowsAffected()
+  if err == nil && n == 0 {
+    err = newError(NotFound, "Datum %v not found", d.Id)
+  }
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+  err = m.addCounts(txn, -1, -d.Weight)
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+  if m.HasStatistics() {
+    delta := newStatisticsDelta(len(covariates))
+    delta.add(covariates, d.Value - d.Offset, -d.Weight)
+    err = updateStatistics(txn, m.Id, delta)
+    if err != nil {
+      txn.Rollback()
+      return err
+    }
+  }
+  err = txn.Commit()
+  if err != nil {
+    return err
+  }
+  m.updatePosterior(ctx)
+  return nil
+}
+
+func (m *Model) GetData(ctx context.Context) ([]*Datum, error) {
   var data []*Datum
-  _, err := DBMAP.Select(&data, "select * from data where model=:model", map[string]interface{} {"model": m.Id})
+  _, err := withContext(ctx).Select(&data, "select * from data where model=:model", map[string]interface{} {"model": m.Id})
   if err != nil {
     return nil, err
   }
   return data, nil
 }
 
-func (d *Datum) GetCovariates() ([]Covariate, error) {
+func (d *Datum) GetCovariates(ctx context.Context) ([]Covariate, error) {
   var covariates []Covariate
-  _, err := DBMAP.Select(&covariates, "select * from covariates where datum=:datum order by label", map[string]interface{} {"datum": d.Id})
+  _, err := withContext(ctx).Select(&covariates, "select * from covariates where datum=:datum order by label", map[string]interface{} {"datum": d.Id})
   if err != nil {
     return nil, err
   }
   return covariates, nil
 }
-func GetDatumById(id string) (*Datum, error) {
-  obj, err := DBMAP.Get(Datum{}, id)
+func GetDatumById(ctx context.Context, id string) (*Datum, error) {
+  obj, err := withContext(ctx).Get(Datum{}, id)
   if err != nil {
-    log.Fatal("Error getting datum", err)
-    return nil, err
+    return nil, fmt.Errorf("Getting datum %v: %w", id, err)
   }
   if obj == nil {
-    return nil, nil
+    return nil, newError(NotFound, "Datum %v not found", id)
   }
   datum := obj.(*Datum)
   return datum, nil
 }
 
-func (m *Model) DeleteData() error {
+func (m *Model) DeleteData(ctx context.Context) error {
   var dataIds []string
-  _, err := DBMAP.Select(&dataIds, "select id from data where model=:model", map[string]interface{}{"model": m.Id})
+  _, err := withContext(ctx).Select(&dataIds, "select id from data where model=:model", map[string]interface{}{"model": m.Id})
   if err != nil {
     return err
   }
-  txn, err := DBMAP.Begin()
+  txn, err := withContext(ctx).Begin()
   if err != nil {
     return err
   }
   for _, datumId := range dataIds {
-    txn.Exec("delete from covariates where datum=:datum",  map[string]interface{} {"datum": datumId})
+    _, err = txn.Exec("delete from covariates where datum=:datum",  map[string]interface{} {"datum": datumId})
+    if err != nil {
+      txn.Rollback()
+      return err
+    }
+  }
+  _, err = txn.Exec("delete from data where model=:model", map[string]interface{} {"model": m.Id})
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+  _, err = txn.Exec("update statistics set value = 0 where model=$1", m.Id)
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+  _, err = txn.Exec("update models set num_training_data = 0, sum_weights = 0 where id=$1", m.Id)
+  if err != nil {
+    txn.Rollback()
+    return err
   }
-  txn.Exec("delete from data where model=:model", map[string]interface{} {"model": m.Id})
   err = txn.Commit()
   if err != nil {
     return err
   }
 
   m.NumTrainingData = 0
-  coefficients, err := m.GetCoefficients()
+  m.SumWeights = 0.0
+  // the reset coefficients are no version
+  m.Version = 0
+  coefficients, err := m.GetCoefficients(ctx)
   if err != nil {
     return err
   }
-  for _, coefficient := range coefficients {
-    coefficient.Value = 0.0
+  for i := range coefficients {
+    coefficients[i].Value = 0.0
+    coefficients[i].Source = ""
+  }
+  params, err := m.GetParameters(ctx)
+  if err != nil {
+    return err
+  }
+  params.Reset()
+  err = m.SaveWithParameters(ctx, coefficients, params)
+  if err != nil {
+    return err
   }
-  return m.SaveWithCoefficients(coefficients)
+  // back to the prior
+  m.updatePosterior(ctx)
+  return nil
 }
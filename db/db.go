@@ -1,56 +1,85 @@
 package db
 
 import (
-  "os"
-  "log"
+  "context"
   "database/sql"
   "github.com/coopernurse/gorp"
-  _ "github.com/lib/pq"
 )
 
 var DBMAP *gorp.DbMap
 
-func init() {
-  DBMAP = initDb()
+// tables are the tables of the database and the types of their rows.
+var tables = []struct {
+  name string
+  row interface{}
+}{
+  {"models", Model{}},
+  {"coefficients", Coefficient{}},
+  {"covariates", Covariate{}},
+  {"data", Datum{}},
+  {"statistics", Statistic{}},
+  {"class_coefficients", ClassCoefficient{}},
+  {"thresholds", Threshold{}},
+  {"baseline_hazards", BaselineHazard{}},
+  {"posterior_covariances", PosteriorCovariance{}},
+  {"model_versions", ModelVersion{}},
+  {"version_coefficients", VersionCoefficient{}},
+  {"api_keys", ApiKey{}},
+  {"learn_jobs", LearnJob{}},
 }
 
-func initDb() *gorp.DbMap {
-  user := os.Getenv("USER")
-  password := os.Getenv("PASS")
-  dbname := os.Getenv("DBNAME")
-  sqlOptionsString := "sslmode=disable"
-  if dbname != "" {
-    sqlOptionsString += " dbname=" + dbname
-  }
-  if user != "" {
-    sqlOptionsString += " user=" + user
-  }
-  if password != "" {
-    sqlOptionsString += " password=" + password
+// Init connects to the database at dataSourceName, a lib/pq connection
+// string, and creates any missing tables. It must be called before anything
+// that reads or saves models; training and predicting with a Fit in memory
+// need no database. A maxOpenConns of 0 means no limit.
+func Init(dataSourceName string, maxOpenConns int, maxIdleConns int) error {
+  dbmap, err := initDb(dataSourceName)
+  if err != nil {
+    return err
   }
+  dbmap.Db.SetMaxOpenConns(maxOpenConns)
+  dbmap.Db.SetMaxIdleConns(maxIdleConns)
+  DBMAP = dbmap
+  return nil
+}
+
+// withContext returns DBMAP running its queries, and the transactions it
+// begins, under ctx.
+func withContext(ctx context.Context) *gorp.DbMap {
+  return DBMAP.WithContext(ctx).(*gorp.DbMap)
+}
+
+// Close closes the connections to the database.
+func Close() error {
+  return DBMAP.Db.Close()
+}
+
+func initDb(dataSourceName string) (*gorp.DbMap, error) {
   // connect to db using standard Go database/sql API
   // use whatever database/sql driver you wish
-  db, err := sql.Open("postgres", sqlOptionsString)
+  db, err := sql.Open(timedDriverName, dataSourceName)
   if err != nil {
-    log.Fatal(err)
+    return nil, err
   }
 
   // construct a gorp DbMap
   dbmap := &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
 
-  // add a table, setting the table name to 'posts' and
-  // specifying that the Id property is an auto incrementing PK
-  dbmap.AddTableWithName(Model{}, "models").SetKeys(false, "Id")
-  dbmap.AddTableWithName(Coefficient{}, "coefficients").SetKeys(false, "Id")
-  dbmap.AddTableWithName(Covariate{}, "covariates").SetKeys(false, "Id")
-  dbmap.AddTableWithName(Datum{}, "data").SetKeys(false, "Id")
+  // add the tables, each keyed by its (non auto incrementing) Id
+  for _, t := range tables {
+    dbmap.AddTableWithName(t.row, t.name).SetKeys(false, "Id")
+  }
 
   // create the table. in a production system you'd generally
   // use a migration tool, or create the tables via scripts
   err = dbmap.CreateTablesIfNotExists()
   if err != nil {
-    log.Fatal(err)
+    return nil, err
+  }
+  err = migrate(context.Background(), dbmap)
+  if err != nil {
+    return nil, err
   }
 
-  return dbmap
+  return dbmap, nil
 }
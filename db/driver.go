@@ -0,0 +1,109 @@
+package db
+
+import (
+  "github.com/aotimme/cloudml/metrics"
+  "github.com/lib/pq"
+  "context"
+  "database/sql"
+  "database/sql/driver"
+  "strings"
+  "time"
+)
+
+// timedDriverName is lib/pq timing every query in metrics.QueryDuration.
+const timedDriverName = "cloudml-postgres"
+
+func init() {
+  sql.Register(timedDriverName, timedDriver{&pq.Driver{}})
+}
+
+type timedDriver struct {
+  driver.Driver
+}
+
+func (d timedDriver) Open(name string) (driver.Conn, error) {
+  c, err := d.Driver.Open(name)
+  if err != nil {
+    return nil, err
+  }
+  return &timedConn{c}, nil
+}
+
+// timedConn times the queries of a connection, passing on the optional
+// interfaces of database/sql/driver. Anything the connection does not do
+// itself is left to database/sql with driver.ErrSkip.
+type timedConn struct {
+  driver.Conn
+}
+
+func observeQuery(query string, start time.Time) {
+  statement := "other"
+  fields := strings.Fields(query)
+  if len(fields) > 0 {
+    statement = strings.ToLower(fields[0])
+  }
+  metrics.QueryDuration.WithLabelValues(statement).Observe(time.Since(start).Seconds())
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+  execer, ok := c.Conn.(driver.ExecerContext)
+  if !ok {
+    return nil, driver.ErrSkip
+  }
+  defer observeQuery(query, time.Now())
+  return execer.ExecContext(ctx, query, args)
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+  queryer, ok := c.Conn.(driver.QueryerContext)
+  if !ok {
+    return nil, driver.ErrSkip
+  }
+  defer observeQuery(query, time.Now())
+  return queryer.QueryContext(ctx, query, args)
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+  preparer, ok := c.Conn.(driver.ConnPrepareContext)
+  if !ok {
+    return c.Conn.Prepare(query)
+  }
+  return preparer.PrepareContext(ctx, query)
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+  beginner, ok := c.Conn.(driver.ConnBeginTx)
+  if !ok {
+    return c.Conn.Begin()
+  }
+  return beginner.BeginTx(ctx, opts)
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+  pinger, ok := c.Conn.(driver.Pinger)
+  if !ok {
+    return nil
+  }
+  return pinger.Ping(ctx)
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+  resetter, ok := c.Conn.(driver.SessionResetter)
+  if !ok {
+    return nil
+  }
+  return resetter.ResetSession(ctx)
+}
+
+func (c *timedConn) IsValid() bool {
+  validator, ok := c.Conn.(driver.Validator)
+  return !ok || validator.IsValid()
+}
+
+func (c *timedConn) CheckNamedValue(nv *driver.NamedValue) error {
+  checker, ok := c.Conn.(driver.NamedValueChecker)
+  if !ok {
+    return driver.ErrSkip
+  }
+  return checker.CheckNamedValue(nv)
+}
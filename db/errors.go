@@ -0,0 +1,102 @@
+package db
+
+import (
+  "github.com/lib/pq"
+  "context"
+  "errors"
+  "fmt"
+)
+
+// Kind classifies errors so that callers can tell a bad request from a
+// missing model or a failing database.
+type Kind int
+
+const (
+  // Internal errors are those of the database or of this package.
+  Internal Kind = iota
+  // Invalid errors are settings or values that can never be accepted.
+  Invalid
+  NotFound
+  // Conflict errors are changes that clash with what is already saved.
+  Conflict
+  // Unprocessable errors are well formed requests that the model cannot
+  // take, such as a datum of an unknown class or data that cannot be fitted.
+  Unprocessable
+  // Canceled errors are operations stopped by their context, because the
+  // request timed out or the client went away.
+  Canceled
+  // Quota errors are changes beyond a quota, such as the rows of a model.
+  Quota
+)
+
+type Error struct {
+  Kind Kind
+  Message string
+}
+
+func (e *Error) Error() string {
+  return e.Message
+}
+
+// DatumError is the error of the datum at Index of a batch.
+type DatumError struct {
+  Index int
+  Err error
+}
+
+func (e *DatumError) Error() string {
+  return e.Err.Error()
+}
+
+func (e *DatumError) Unwrap() error {
+  return e.Err
+}
+
+func newError(kind Kind, format string, args ...interface{}) *Error {
+  return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// withKind gives err the kind unless it already has one.
+func withKind(kind Kind, err error) error {
+  var e *Error
+  if err == nil || errors.As(err, &e) || isCanceled(err) {
+    return err
+  }
+  return &Error{Kind: kind, Message: err.Error()}
+}
+
+// isCanceled reports whether err comes from a done context, including
+// statements the database canceled for one.
+func isCanceled(err error) bool {
+  if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+    return true
+  }
+  var pqErr *pq.Error
+  return errors.As(err, &pqErr) && pqErr.Code == "57014"
+}
+
+// KindOf returns the kind of err or of the error it wraps. Unique violations
+// of the database are conflicts, errors of a done context are canceled and
+// any other error without a kind is internal.
+func KindOf(err error) Kind {
+  var e *Error
+  if errors.As(err, &e) {
+    return e.Kind
+  }
+  if isCanceled(err) {
+    return Canceled
+  }
+  var pqErr *pq.Error
+  if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+    return Conflict
+  }
+  return Internal
+}
+
+func IsNotFound(err error) bool {
+  return KindOf(err) == NotFound
+}
+
+func IsCanceled(err error) bool {
+  return KindOf(err) == Canceled
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+  "github.com/aotimme/cloudml/glm"
+  "errors"
+)
+
+// glmFamilies maps the GLM model types to their family. Models of type "glm"
+// name their family explicitly.
+var glmFamilies = map[string]string{
+  "logistic": "binomial",
+  "linear": "gaussian",
+  "poisson": "poisson",
+  "gamma": "gamma",
+  "inverse_gaussian": "inverse_gaussian",
+}
+
+func (m *Model) IsGLM() bool {
+  _, ok := glmFamilies[m.Type]
+  return ok || m.Type == "glm"
+}
+
+func (m *Model) GetGLM() (*glm.GLM, error) {
+  family := m.Family
+  if family == "" {
+    family = glmFamilies[m.Type]
+  }
+  return glm.New(family, m.Link)
+}
+
+// ConfigureGLM checks the family and link of a new GLM model and fills in
+// the defaults, so that they are stored explicitly.
+func (m *Model) ConfigureGLM() error {
+  if m.Type == "glm" {
+    if m.Family == "" {
+      return errors.New("GLM models need a family")
+    }
+  } else if m.Family == "" {
+    m.Family = glmFamilies[m.Type]
+  } else if m.Family != glmFamilies[m.Type] {
+    return errors.New("Family does not match the model type")
+  }
+  g, err := m.GetGLM()
+  if err != nil {
+    return err
+  }
+  m.Link = g.Link.Name()
+  return nil
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+  "context"
+  "database/sql"
+  "fmt"
+  "reflect"
+)
+
+// Ping checks that the database can be reached.
+func Ping(ctx context.Context) error {
+  if DBMAP == nil {
+    return newError(Internal, "Database not initialized")
+  }
+  return DBMAP.Db.PingContext(ctx)
+}
+
+// column is a column of a table as gorp maps it, with the type of its field.
+type column struct {
+  table string
+  name string
+  typ reflect.Type
+}
+
+// columns returns the columns of the rows of type t, as gorp names them.
+func columns(table string, t reflect.Type) []column {
+  var cols []column
+  for i := 0; i < t.NumField(); i++ {
+    f := t.Field(i)
+    name := f.Tag.Get("db")
+    if name == "-" {
+      continue
+    }
+    if name == "" {
+      name = f.Name
+    }
+    cols = append(cols, column{table: table, name: name, typ: f.Type})
+  }
+  return cols
+}
+
+// MissingColumns returns the columns, as "table.column", that the database
+// lacks. Init adds them, so any left are those it failed to add.
+func MissingColumns(ctx context.Context) ([]string, error) {
+  if DBMAP == nil {
+    return nil, newError(Internal, "Database not initialized")
+  }
+  cols, err := missingColumns(ctx, DBMAP.Db)
+  if err != nil {
+    return nil, err
+  }
+  var missing []string
+  for _, col := range cols {
+    missing = append(missing, col.table + "." + col.name)
+  }
+  return missing, nil
+}
+
+func missingColumns(ctx context.Context, db *sql.DB) ([]column, error) {
+  rows, err := db.QueryContext(ctx, "select table_name, column_name from information_schema.columns where table_schema = current_schema()")
+  if err != nil {
+    return nil, fmt.Errorf("Getting columns: %w", err)
+  }
+  defer rows.Close()
+  present := make(map[string]bool)
+  for rows.Next() {
+    var table, name string
+    err = rows.Scan(&table, &name)
+    if err != nil {
+      return nil, fmt.Errorf("Getting columns: %w", err)
+    }
+    present[table + "." + name] = true
+  }
+  err = rows.Err()
+  if err != nil {
+    return nil, fmt.Errorf("Getting columns: %w", err)
+  }
+  var missing []column
+  for _, t := range tables {
+    for _, col := range columns(t.name, reflect.TypeOf(t.row)) {
+      if !present[col.table + "." + col.name] {
+        missing = append(missing, col)
+      }
+    }
+  }
+  return missing, nil
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+  "context"
+  "fmt"
+  "time"
+)
+
+// SaveLearnJobs saves the ids of models left to train, in order, for
+// TakeLearnJobs.
+func SaveLearnJobs(ctx context.Context, modelIds []string) error {
+  txn, err := withContext(ctx).Begin()
+  if err != nil {
+    return fmt.Errorf("Saving learn jobs: %w", err)
+  }
+  now := time.Now().UTC()
+  for i, modelId := range modelIds {
+    id, err := newUUID()
+    if err == nil {
+      // keep the order of jobs saved at once
+      err = txn.Insert(&LearnJob{Id: id, Model: modelId, Queued: now.Add(time.Duration(i) * time.Microsecond)})
+    }
+    if err != nil {
+      txn.Rollback()
+      return fmt.Errorf("Saving learn jobs: %w", err)
+    }
+  }
+  return txn.Commit()
+}
+
+// TakeLearnJobs removes the saved learn jobs, returning the ids of their
+// models, oldest first.
+func TakeLearnJobs(ctx context.Context) ([]string, error) {
+  txn, err := withContext(ctx).Begin()
+  if err != nil {
+    return nil, fmt.Errorf("Getting learn jobs: %w", err)
+  }
+  var jobs []LearnJob
+  _, err = txn.Select(&jobs, "select * from learn_jobs order by queued")
+  if err == nil {
+    _, err = txn.Exec("delete from learn_jobs")
+  }
+  if err != nil {
+    txn.Rollback()
+    return nil, fmt.Errorf("Getting learn jobs: %w", err)
+  }
+  err = txn.Commit()
+  if err != nil {
+    return nil, fmt.Errorf("Getting learn jobs: %w", err)
+  }
+  modelIds := make([]string, len(jobs))
+  for i, job := range jobs {
+    modelIds[i] = job.Model
+  }
+  return modelIds, nil
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+  "context"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "math"
+  "strings"
+  "time"
+)
+
+// keyPrefix marks cloudml API keys, so that they are easy to recognize in
+// configuration and logs.
+const keyPrefix = "cml_"
+
+// Roles of API keys, each allowed what the ones before it are: readers get
+// and predict with models, writers add and remove data, trainers create,
+// import, train and promote models and remove all their data, admins delete
+// models and manage the keys of their tenant, and super admins use the models
+// and manage the keys of every tenant.
+const (
+  RoleReader = "reader"
+  RoleWriter = "writer"
+  RoleTrainer = "trainer"
+  RoleAdmin = "admin"
+  RoleSuperAdmin = "superadmin"
+)
+
+var roles = []string{RoleReader, RoleWriter, RoleTrainer, RoleAdmin, RoleSuperAdmin}
+
+func roleRank(role string) int {
+  for i, r := range roles {
+    if r == role {
+      return i
+    }
+  }
+  return -1
+}
+
+func IsRole(role string) bool {
+  return roleRank(role) >= 0
+}
+
+func HashKey(key string) string {
+  sum := sha256.Sum256([]byte(key))
+  return hex.EncodeToString(sum[:])
+}
+
+// CreateApiKey saves k, a new key with its tenant, role and any quotas set,
+// and returns the key itself, which is not stored and cannot be recovered.
+func CreateApiKey(ctx context.Context, k *ApiKey) (string, error) {
+  k.Tenant = strings.TrimSpace(k.Tenant)
+  if k.Tenant == "" {
+    return "", newError(Invalid, "Keys need a tenant")
+  }
+  if !IsRole(k.Role) {
+    return "", newError(Invalid, "Unknown role %q; roles are %v", k.Role, strings.Join(roles, ", "))
+  }
+  if math.IsNaN(k.RateLimit) || math.IsInf(k.RateLimit, 0) {
+    return "", newError(Invalid, "Invalid rate limit")
+  }
+  secret := make([]byte, 32)
+  _, err := rand.Read(secret)
+  if err != nil {
+    return "", fmt.Errorf("Creating key: %w", err)
+  }
+  key := keyPrefix + hex.EncodeToString(secret)
+  k.Id, err = newUUID()
+  if err != nil {
+    return "", fmt.Errorf("Creating key id: %w", err)
+  }
+  k.Hash = HashKey(key)
+  k.Created = time.Now().UTC()
+  err = withContext(ctx).Insert(k)
+  if err != nil {
+    return "", fmt.Errorf("Saving key: %w", err)
+  }
+  return key, nil
+}
+
+// GetApiKey returns the stored key matching key, or a NotFound error.
+func GetApiKey(ctx context.Context, key string) (*ApiKey, error) {
+  var keys []ApiKey
+  _, err := withContext(ctx).Select(&keys, "select * from api_keys where hash=:hash", map[string]interface{} {"hash": HashKey(key)})
+  if err != nil {
+    return nil, fmt.Errorf("Getting key: %w", err)
+  }
+  if len(keys) == 0 {
+    return nil, newError(NotFound, "Unknown API key")
+  }
+  return &keys[0], nil
+}
+
+// GetApiKeyById returns the key with the id, or a NotFound error.
+func GetApiKeyById(ctx context.Context, id string) (*ApiKey, error) {
+  var keys []ApiKey
+  _, err := withContext(ctx).Select(&keys, "select * from api_keys where id=:id", map[string]interface{} {"id": id})
+  if err != nil {
+    return nil, fmt.Errorf("Getting key %v: %w", id, err)
+  }
+  if len(keys) == 0 {
+    return nil, newError(NotFound, "Key %v not found", id)
+  }
+  return &keys[0], nil
+}
+
+// GetApiKeys returns every key, oldest first.
+func GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+  var keys []ApiKey
+  _, err := withContext(ctx).Select(&keys, "select * from api_keys order by created")
+  if err != nil {
+    return nil, fmt.Errorf("Getting keys: %w", err)
+  }
+  return keys, nil
+}
+
+func DeleteApiKeyById(ctx context.Context, id string) error {
+  result, err := withContext(ctx).Exec("delete from api_keys where id=$1", id)
+  if err != nil {
+    return fmt.Errorf("Deleting key %v: %w", id, err)
+  }
+  n, err := result.RowsAffected()
+  if err != nil {
+    return fmt.Errorf("Deleting key %v: %w", id, err)
+  }
+  if n == 0 {
+    return newError(NotFound, "Key %v not found", id)
+  }
+  return nil
+}
+
+// Allows reports whether the key's role includes role.
+func (k *ApiKey) Allows(role string) bool {
+  return roleRank(k.Role) >= roleRank(role) && IsRole(role)
+}
+
+// IsSuperAdmin reports whether the key may act for every tenant.
+func (k *ApiKey) IsSuperAdmin() bool {
+  return k.Role == RoleSuperAdmin
+}
+
+// CanAccess reports whether the key may use the model: super admin keys may
+// use every model and other keys those of their tenant.
+func (k *ApiKey) CanAccess(m *Model) bool {
+  return k.IsSuperAdmin() || m.Tenant == k.Tenant
+}
+
+// CanManage reports whether the key may create, list and revoke other: super
+// admin keys manage the keys of every tenant and admin keys those of their
+// own, in both cases only those whose role is no greater than theirs.
+func (k *ApiKey) CanManage(other *ApiKey) bool {
+  if !k.Allows(other.Role) {
+    return false
+  }
+  return k.IsSuperAdmin() || (k.Allows(RoleAdmin) && other.Tenant == k.Tenant)
+}
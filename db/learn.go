@@ -1,33 +1,62 @@
 package db
 
 import (
-  "github.com/aotimme/cloudml/logistic"
+  "github.com/aotimme/cloudml/cox"
+  "github.com/aotimme/cloudml/glm"
   "github.com/aotimme/cloudml/linear"
-  "log"
+  "github.com/aotimme/cloudml/logging"
+  "github.com/aotimme/cloudml/multinomial"
+  "github.com/aotimme/cloudml/robust"
+  "github.com/aotimme/cloudml/metrics"
+  "context"
   "errors"
+  "sort"
+  "time"
 )
 
-func (m *Model) GetDataArray() ([][]float64, []float64, error) {
-  data, err := m.GetData()
+type DataArray struct {
+  Covariates [][]float64
+  Values []float64
+  Weights []float64
+  Offsets []float64
+  Classes []string
+  Durations []float64
+  Events []bool
+}
+
+func (m *Model) GetDataArray(ctx context.Context) (*DataArray, error) {
+  data, err := m.GetData(ctx)
   if err != nil {
-    return nil, nil, err
+    return nil, err
   }
   n := m.NumTrainingData
   p := m.NumCovariates
-  dataArray := make([][]float64, n)
-  values := make([]float64, n)
+  dataArray := &DataArray{
+    Covariates: make([][]float64, n),
+    Values: make([]float64, n),
+    Weights: make([]float64, n),
+    Offsets: make([]float64, n),
+    Classes: make([]string, n),
+    Durations: make([]float64, n),
+    Events: make([]bool, n),
+  }
   for i, datum := range data {
-    dataArray[i] = make([]float64, p)
-    covariates, err := datum.GetCovariates()
+    dataArray.Covariates[i] = make([]float64, p)
+    covariates, err := datum.GetCovariates(ctx)
     if err != nil {
-      return nil, nil, err
+      return nil, err
     }
     for j, cov := range covariates {
-      dataArray[i][j] = cov.Value
+      dataArray.Covariates[i][j] = cov.Value
     }
-    values[i] = datum.Value
+    dataArray.Values[i] = datum.Value
+    dataArray.Weights[i] = datum.Weight
+    dataArray.Offsets[i] = datum.Offset
+    dataArray.Classes[i] = datum.Class
+    dataArray.Durations[i] = datum.Duration
+    dataArray.Events[i] = datum.Event
   }
-  return dataArray, values, nil
+  return dataArray, nil
 }
 
 func GetCoefficientsArrayFromCoefficients(coefficients []Coefficient) []float64 {
@@ -38,90 +67,325 @@ func GetCoefficientsArrayFromCoefficients(coefficients []Coefficient) []float64
   return array
 }
 
-func (m *Model) Learn() error {
-  dataArray, values, err := m.GetDataArray()
+// Learn trains the model and records the result as a new version.
+func (m *Model) Learn(ctx context.Context) error {
+  start := time.Now()
+  fit, err := m.train(ctx)
+  if err == nil {
+    err = m.saveVersion(ctx, fit, "trained")
+  }
+  metrics.ObserveTraining(m.Type, "learn", start, err)
+  return err
+}
+
+// learn trains the model and saves the result without a new version.
+func (m *Model) learn(ctx context.Context) error {
+  fit, err := m.train(ctx)
   if err != nil {
     return err
   }
-  coefficients, err := m.GetCoefficients()
+  err = m.SaveWithParameters(ctx, fit.Coefficients, fit.Parameters)
   if err != nil {
+    logging.Errorf(ctx, "Error saving model")
     return err
   }
-  var coefArray []float64
-  if m.Type == "logistic" {
-    coefArray, err = logistic.Learn(dataArray, values, m.Lambda, GetCoefficientsArrayFromCoefficients(coefficients), 100)
+  return nil
+}
+
+// train fits the model to its saved data, or to its statistics if it keeps
+// them. Nothing is saved.
+func (m *Model) train(ctx context.Context) (*Fit, error) {
+  fit, err := m.GetFit(ctx)
+  if err != nil {
+    return nil, err
+  }
+  if m.HasStatistics() {
+    xtx, xty, yty, err := m.GetStatisticsArrays(ctx)
     if err != nil {
-      log.Printf("Error running regression: %v\n", err)
-      return err
+      return nil, err
+    }
+    err = fit.trainFromStatistics(ctx, xtx, xty, yty)
+    if err != nil {
+      return nil, err
+    }
+  } else {
+    d, err := m.GetDataArray(ctx)
+    if err != nil {
+      return nil, err
     }
-    m.TrainRmse = logistic.RMSE(coefArray, dataArray, values)
-  } else if m.Type == "linear" {
-    coefArray, err = linear.Learn(dataArray, values, m.Lambda)
+    err = fit.Train(ctx, d)
+    if err != nil {
+      return nil, err
+    }
+  }
+  if fit.Iterations > 0 {
+    metrics.TrainingIterations.WithLabelValues(m.Type).Observe(float64(fit.Iterations))
+  }
+  return fit, nil
+}
+
+// Train fits the coefficients and parameters of f to d in memory, updating
+// the training metrics of f.Model. Nothing is saved.
+func (f *Fit) Train(ctx context.Context, d *DataArray) error {
+  m := f.Model
+  f.Iterations = 0
+  if m.HasStatistics() {
+    xtx, xty, yty := d.GetStatisticsArrays(len(f.Coefficients))
+    return withKind(Unprocessable, f.trainFromStatistics(ctx, xtx, xty, yty))
+  }
+  var err error
+  if m.Type == "multinomial" {
+    err = f.trainMultinomial(ctx, d)
+  } else if m.Type == "ordinal" {
+    err = f.trainOrdinal(ctx, d)
+  } else if m.Type == "cox" {
+    err = f.trainCox(ctx, d)
+  } else if m.usesRobust() {
+    var coefArray []float64
+    coefArray, f.Iterations, err = m.learnRobust(ctx, d, GetCoefficientsArrayFromCoefficients(f.Coefficients))
+    f.setCoefficients(coefArray)
+  } else if m.IsGLM() {
+    var g *glm.GLM
+    g, err = m.GetGLM()
     if err != nil {
-      log.Printf("Error running regression\n")
       return err
     }
-    m.TrainRmse = linear.RMSE(coefArray, dataArray, values)
+    var coefArray []float64
+    coefArray, f.Iterations, err = g.Learn(ctx, d.Covariates, d.Values, d.Weights, d.Offsets, m.Lambda, GetCoefficientsArrayFromCoefficients(f.Coefficients), 100)
+    if err == nil {
+      m.TrainRmse = g.RMSE(coefArray, d.Covariates, d.Values, d.Weights, d.Offsets)
+      f.setCoefficients(coefArray)
+    }
+  } else {
+    err = errors.New("Unknown model type")
+  }
+  if err != nil {
+    logging.Errorf(ctx, "Error running regression: %v", err)
+    return withKind(Unprocessable, err)
+  }
+  return nil
+}
+
+// trainFromStatistics fits the models that keep statistics: least squares
+// and bayesian linear regression.
+func (f *Fit) trainFromStatistics(ctx context.Context, xtx [][]float64, xty []float64, yty float64) error {
+  m := f.Model
+  if m.Type == "bayesian_linear" {
+    return f.trainBayesian(ctx, xtx, xty, yty)
+  }
+  coefArray, err := linear.LearnFromStatistics(xtx, xty, m.Lambda)
+  if err != nil {
+    logging.Errorf(ctx, "Error running regression")
+    return err
   }
+  m.TrainRmse = linear.RMSEFromStatistics(coefArray, xtx, xty, yty, m.SumWeights)
+  f.setCoefficients(coefArray)
+  return nil
+}
+
+func (f *Fit) setCoefficients(coefArray []float64) {
   for j, value := range coefArray {
-    coefficients[j].Value = value
+    f.Coefficients[j].Value = value
+  }
+}
+
+func (f *Fit) trainMultinomial(ctx context.Context, d *DataArray) error {
+  m := f.Model
+  classCoefficients := f.Parameters.ClassCoefficients
+  classes := GetClasses(classCoefficients)
+  labels, err := getClassIndices(classes, d.Classes)
+  if err != nil {
+    return err
   }
-  err = m.SaveWithCoefficients(coefficients)
+  betaStart := GetClassCoefficientsArray(classCoefficients, m.NumCovariates)
+  beta, iterations, err := multinomial.Learn(ctx, d.Covariates, labels, d.Weights, m.Lambda, betaStart, 100)
   if err != nil {
-    log.Printf("Error saving model\n")
     return err
   }
+  f.Iterations = iterations
+  m.TrainRmse = multinomial.RMSE(beta, d.Covariates, labels, d.Weights)
+  for i := range classCoefficients {
+    classCoefficients[i].Value = beta[i / m.NumCovariates][i % m.NumCovariates]
+  }
   return nil
 }
 
-func (m *Model) CV() error {
-  dataArray, values, err := m.GetDataArray()
+func (m *Model) CV(ctx context.Context) error {
+  start := time.Now()
+  err := m.cv(ctx)
+  metrics.ObserveTraining(m.Type, "cv", start, err)
+  return err
+}
+
+func (m *Model) cv(ctx context.Context) error {
+  fit, err := m.GetFit(ctx)
+  if err != nil {
+    return err
+  }
+  d, err := m.GetDataArray(ctx)
   if err != nil {
     return err
   }
-  var cv float64
-  if m.Type == "logistic" {
-    cv, err = logistic.CV(dataArray, values, m.Lambda)
+  err = fit.CV(ctx, d)
+  if err != nil {
+    return err
+  }
+  err = m.Update(ctx)
+  if err != nil {
+    logging.Errorf(ctx, "Error saving model")
+    return err
+  }
+  return nil
+}
+
+// CV cross-validates the model of f on d, setting its CV metric.
+func (f *Fit) CV(ctx context.Context, d *DataArray) error {
+  m := f.Model
+  var err error
+  if m.usesRobust() {
+    err = m.cvRobust(ctx, d)
+  } else if m.IsGLM() {
+    var g *glm.GLM
+    g, err = m.GetGLM()
     if err != nil {
-      log.Printf("Error running cv: %v\n", err)
       return err
     }
-  } else if m.Type == "linear" {
-    cv, err = linear.CV(dataArray, values, m.Lambda)
+    m.CvRmse, err = g.CV(ctx, d.Covariates, d.Values, d.Weights, d.Offsets, m.Lambda)
+  } else if m.Type == "multinomial" {
+    classes := GetClasses(f.Parameters.ClassCoefficients)
+    var labels []int
+    labels, err = getClassIndices(classes, d.Classes)
     if err != nil {
-      log.Printf("Error running cv: %v\n", err)
       return err
     }
+    m.CvRmse, err = multinomial.CV(ctx, d.Covariates, labels, d.Weights, len(classes), m.Lambda)
+  } else if m.Type == "ordinal" {
+    m.CvRmse, err = f.cvOrdinal(ctx, d)
+  } else if m.Type == "bayesian_linear" {
+    // the posterior mean is the ridge estimate with lambda = alpha sigma²
+    m.CvRmse, err = linear.CV(ctx, d.Covariates, d.Values, d.Weights, d.Offsets, m.PriorPrecision * m.NoiseVariance)
+  } else if m.Type == "cox" {
+    m.CvConcordance, err = cox.CV(ctx, d.Covariates, d.Durations, d.Events, d.Weights, d.Offsets, m.Lambda)
   }
-  m.CvRmse = cv
-  err = m.Update()
   if err != nil {
-    log.Printf("Error saving model\n")
-    return err
+    logging.Errorf(ctx, "Error running cv: %v", err)
+    return withKind(Unprocessable, err)
   }
   return nil
 }
 
-func (m *Model) Predict(covariates map[string]float64) (float64, error) {
-  coefficients, err := m.GetCoefficients()
+// Fit is everything a prediction needs: the model along with its
+// coefficients and parameters, either as currently saved or as of a version.
+type Fit struct {
+  Model *Model
+  Coefficients []Coefficient
+  Parameters *Parameters
+  // Iterations is how many iterations the last Train ran, 0 if the model was
+  // fitted in closed form.
+  Iterations int
+}
+
+func (m *Model) GetFit(ctx context.Context) (*Fit, error) {
+  coefficients, err := m.GetCoefficients(ctx)
   if err != nil {
-    return 0.0, err
+    return nil, err
   }
-  dot := 0.0
-  for _, coef := range coefficients {
-    dot += coef.Value * covariates[coef.Label]
+  params, err := m.GetParameters(ctx)
+  if err != nil {
+    return nil, err
   }
-  coefArray := GetCoefficientsArrayFromCoefficients(coefficients)
-  covs := make([]float64, len(coefficients))
-  for j, coef := range coefficients {
-    covs[j] = covariates[coef.Label]
+  return &Fit{Model: m, Coefficients: coefficients, Parameters: params}, nil
+}
+
+// NewFit checks the settings of a new model, filling in the defaults, and
+// returns its untrained fit with coefficients for the covariates. Multinomial
+// models need classes and ordinal models levels.
+func NewFit(m *Model, covariates []string, classes []string, levels []float64) (*Fit, error) {
+  if !IsModelType(m.Type) {
+    return nil, newError(Invalid, "Unknown model type %q", m.Type)
+  }
+  // coefficients are kept in order of label
+  labels := make([]string, len(covariates))
+  copy(labels, covariates)
+  sort.Strings(labels)
+  coefficients := make([]Coefficient, len(labels))
+  for j, label := range labels {
+    if label == "" || (j > 0 && label == labels[j - 1]) {
+      return nil, newError(Invalid, "Invalid or repeated covariate %q", label)
+    }
+    coefficients[j].Label = label
+  }
+  params := &Parameters{}
+  var err error
+  if m.IsGLM() {
+    err = m.ConfigureGLM()
+  } else if m.Type == "multinomial" {
+    params.ClassCoefficients, err = newClassCoefficients(classes, labels)
+  } else if m.Type == "ordinal" {
+    params.Thresholds, err = newThresholds(levels)
+  } else if m.Type == "bayesian_linear" {
+    err = m.ConfigureBayesian()
+  }
+  if err == nil {
+    err = m.ConfigureRobust()
+  }
+  if err != nil {
+    return nil, withKind(Invalid, err)
+  }
+  m.NumCovariates = len(coefficients)
+  return &Fit{Model: m, Coefficients: coefficients, Parameters: params}, nil
+}
+
+// covariateArray orders the covariates as the coefficients. The intercept is
+// 1 unless given.
+func (f *Fit) covariateArray(covariates map[string]float64) []float64 {
+  covs := make([]float64, len(f.Coefficients))
+  for j, coef := range f.Coefficients {
+    value, ok := covariates[coef.Label]
+    if !ok && coef.Label == f.Model.Intercept {
+      value = 1.0
+    }
+    covs[j] = value
   }
-  if m.Type == "logistic" {
-    result := logistic.Predict(coefArray, covs)
+  return covs
+}
+
+func (f *Fit) Predict(covariates map[string]float64, offset float64) (float64, error) {
+  m := f.Model
+  coefArray := GetCoefficientsArrayFromCoefficients(f.Coefficients)
+  covs := f.covariateArray(covariates)
+  if m.usesRobust() {
+    result := robust.Predict(coefArray, covs, offset)
     return result, nil
-  } else if m.Type == "linear" {
-    result := linear.Predict(coefArray, covs)
+  } else if m.IsGLM() {
+    g, err := m.GetGLM()
+    if err != nil {
+      return 0.0, err
+    }
+    result := g.Predict(coefArray, covs, offset)
     return result, nil
   }
   return 0.0, errors.New("Unknown model type")
 }
+
+// PredictClasses returns the probability of each class of a multinomial
+// model along with the most probable class.
+func (f *Fit) PredictClasses(covariates map[string]float64) (map[string]float64, string, error) {
+  m := f.Model
+  if m.Type != "multinomial" {
+    return nil, "", errors.New("Model does not predict classes")
+  }
+  classCoefficients := f.Parameters.ClassCoefficients
+  classes := GetClasses(classCoefficients)
+  beta := GetClassCoefficientsArray(classCoefficients, m.NumCovariates)
+  covs := f.covariateArray(covariates)
+  probabilities := make(map[string]float64)
+  best := ""
+  for k, prob := range multinomial.Predict(beta, covs) {
+    probabilities[classes[k]] = prob
+    if best == "" || prob > probabilities[best] {
+      best = classes[k]
+    }
+  }
+  return probabilities, best, nil
+}
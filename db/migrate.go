@@ -0,0 +1,80 @@
+package db
+
+import (
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "fmt"
+  "reflect"
+  "time"
+  "github.com/coopernurse/gorp"
+)
+
+// columnDefaults are the values of the rows already there of added columns
+// whose zero value would be wrong.
+var columnDefaults = map[string]string{
+  // data were unweighted
+  "data.weight": "1",
+}
+
+// columnBackfills fill in added columns from the other columns of their rows.
+var columnBackfills = map[string]string{
+  "models.sum_weights": "update models set sum_weights = num_training_data",
+}
+
+// indexes are created by migrate if they do not exist.
+var indexes = []string{
+  "create unique index if not exists model_versions_model_version on model_versions (model, version)",
+}
+
+// migrate adds the columns that tables created by earlier versions lack, as
+// CreateTablesIfNotExists never alters a table, and the indexes. It is run by
+// Init, in one transaction, and does nothing once they are there.
+func migrate(ctx context.Context, dbmap *gorp.DbMap) error {
+  missing, err := missingColumns(ctx, dbmap.Db)
+  if err != nil {
+    return err
+  }
+  txn, err := dbmap.Db.BeginTx(ctx, nil)
+  if err != nil {
+    return fmt.Errorf("Migrating: %w", err)
+  }
+  for _, col := range missing {
+    name := col.table + "." + col.name
+    def, ok := columnDefaults[name]
+    if !ok {
+      def = zeroDefault(col.typ)
+    }
+    sqlType := dbmap.Dialect.ToSqlType(col.typ, 0, false)
+    _, err = txn.ExecContext(ctx, fmt.Sprintf("alter table %v add column if not exists %v %v not null default %v", col.table, col.name, sqlType, def))
+    if err == nil && columnBackfills[name] != "" {
+      _, err = txn.ExecContext(ctx, columnBackfills[name])
+    }
+    if err != nil {
+      txn.Rollback()
+      return fmt.Errorf("Adding column %v: %w", name, err)
+    }
+    logging.Infof(ctx, "Added column %v", name)
+  }
+  for _, index := range indexes {
+    _, err = txn.ExecContext(ctx, index)
+    if err != nil {
+      txn.Rollback()
+      return fmt.Errorf("Creating index: %w", err)
+    }
+  }
+  return txn.Commit()
+}
+
+// zeroDefault is the zero value of columns of type t in SQL.
+func zeroDefault(t reflect.Type) string {
+  switch t.Kind() {
+  case reflect.String:
+    return "''"
+  case reflect.Bool:
+    return "false"
+  }
+  if t == reflect.TypeOf(time.Time{}) {
+    return "now()"
+  }
+  return "0"
+}
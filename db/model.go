@@ -1,19 +1,51 @@
 package db
 
 import (
-  "log"
+  "github.com/aotimme/cloudml/logging"
+  "context"
   "errors"
+  "fmt"
+  "github.com/coopernurse/gorp"
 )
 
-func GetAllModelIds() ([]string, error) {
+var modelTypes = []string{"logistic", "linear", "poisson", "gamma", "inverse_gaussian", "glm", "multinomial", "ordinal", "quantile", "cox", "bayesian_linear"}
+
+func IsModelType(modelType string) bool {
+  for _, t := range modelTypes {
+    if t == modelType {
+      return true
+    }
+  }
+  return false
+}
+
+func GetAllModelIds(ctx context.Context) ([]string, error) {
+  var modelIds []string
+  _, err := withContext(ctx).Select(&modelIds, "select id from models")
+  if err != nil {
+    return nil, err
+  }
+  return modelIds, nil
+}
+
+// GetModelIdsByTenant returns the ids of the tenant's models.
+func GetModelIdsByTenant(ctx context.Context, tenant string) ([]string, error) {
   var modelIds []string
-  _, err := DBMAP.Select(&modelIds, "select id from models")
+  _, err := withContext(ctx).Select(&modelIds, "select id from models where tenant=:tenant", map[string]interface{} {"tenant": tenant})
   if err != nil {
     return nil, err
   }
   return modelIds, nil
 }
 
+func CountModelsByTenant(ctx context.Context, tenant string) (int, error) {
+  n, err := withContext(ctx).SelectInt("select count(*) from models where tenant=:tenant", map[string]interface{} {"tenant": tenant})
+  if err != nil {
+    return 0, err
+  }
+  return int(n), nil
+}
+
 //func GetAllModels() ([]Model, error) {
 //  modelIds, err := GetAllModelIds()
 //  if err != nil {
@@ -29,131 +61,256 @@ func GetAllModelIds() ([]string, error) {
 //  return models, nil
 //}
 
-func GetModelById(id string) (*Model, error) {
+func GetModelById(ctx context.Context, id string) (*Model, error) {
   //filename := path.Join(DATA_DIR, id, "model.json")
-  obj, err := DBMAP.Get(Model{}, id)
+  obj, err := withContext(ctx).Get(Model{}, id)
   if err != nil {
-    log.Fatal("Error getting model", err)
-    return nil, err
+    return nil, fmt.Errorf("Getting model %v: %w", id, err)
   }
   if obj == nil {
-    return nil, nil
+    return nil, newError(NotFound, "Model %v not found", id)
   }
   model := obj.(*Model)
   return model, nil
 }
 
-func GetModelAndCoefficientsById(id string) (*Model, []Coefficient, error) {
-  model, err := GetModelById(id)
+func GetModelAndCoefficientsById(ctx context.Context, id string) (*Model, []Coefficient, error) {
+  model, err := GetModelById(ctx, id)
   if err != nil {
-    log.Fatalln("Error getting model", err)
     return nil, nil, err
   }
-  if model == nil {
-    return nil, nil, nil
-  }
-  coefficients, err := model.GetCoefficients()
+  coefficients, err := model.GetCoefficients(ctx)
   if err != nil {
     return nil, nil, err
   }
   return model, coefficients, nil
 }
 
-func (m *Model) GetCoefficients() ([]Coefficient, error) {
+func (m *Model) GetCoefficients(ctx context.Context) ([]Coefficient, error) {
   var coefficients []Coefficient
-  _, err := DBMAP.Select(&coefficients, "select * from coefficients where model=:model order by label", map[string]interface{} { "model": m.Id})
+  _, err := withContext(ctx).Select(&coefficients, "select * from coefficients where model=:model order by label", map[string]interface{} { "model": m.Id})
   if err != nil {
     return nil, err
   }
   return coefficients, nil
 }
 
-func (model *Model) Update() error {
+// GetIntercept returns the label of the model's intercept or, failing that,
+// of a covariate that is 1 for every datum of the model, which exports use as
+// the intercept. It returns "" if there is none.
+func (m *Model) GetIntercept(ctx context.Context) (string, error) {
+  if m.Intercept != "" {
+    return m.Intercept, nil
+  }
+  var labels []string
+  _, err := withContext(ctx).Select(&labels, "select covariates.label from covariates, data where covariates.datum = data.id and data.model=:model group by covariates.label having min(covariates.value) = 1 and max(covariates.value) = 1 order by covariates.label", map[string]interface{} {"model": m.Id})
+  if err != nil {
+    return "", err
+  }
+  if len(labels) == 0 {
+    return "", nil
+  }
+  return labels[0], nil
+}
+
+func (model *Model) Update(ctx context.Context) error {
   if model.Id == "" {
     return errors.New("Cannot update model without id")
   }
-  _, err := DBMAP.Update(model)
-  return err
+  txn, err := withContext(ctx).Begin()
+  if err != nil {
+    return err
+  }
+  err = model.lockCounts(txn)
+  if err == nil {
+    _, err = txn.Update(model)
+  }
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+  return txn.Commit()
+}
+
+func (model *Model) SaveWithCoefficients(ctx context.Context, coefficients []Coefficient) error {
+  return model.SaveWithParameters(ctx, coefficients, nil)
 }
 
-func (model *Model) SaveWithCoefficients(coefficients []Coefficient) error {
+// SaveWithParameters saves the model, its coefficients and any additional
+// fitted parameters in a single transaction.
+func (model *Model) SaveWithParameters(ctx context.Context, coefficients []Coefficient, params *Parameters) error {
+  if params == nil {
+    params = &Parameters{}
+  }
+  txn, err := withContext(ctx).Begin()
+  if err != nil {
+    return fmt.Errorf("Saving model: %w", err)
+  }
+  err = model.saveWithParameters(txn, coefficients, params)
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+  err = txn.Commit()
+  if err != nil {
+    return fmt.Errorf("Saving model: %w", err)
+  }
+  return nil
+}
+
+// saveWithParameters saves the model, its coefficients and parameters in txn.
+func (model *Model) saveWithParameters(txn *gorp.Transaction, coefficients []Coefficient, params *Parameters) error {
+  var err error
   isNew := model.Id == ""
   if isNew {
     modelId, err := newUUID()
     if err != nil {
-      log.Fatal("UUID error", err)
-      return err
+      return fmt.Errorf("Creating model id: %w", err)
     }
     model.Id = modelId
     for i, _ := range coefficients {
       id, err := newUUID()
       if err != nil {
-        log.Fatal("UUID error", err)
-        return err
+        return fmt.Errorf("Creating coefficient id: %w", err)
       }
       coefficients[i].Id = id
       coefficients[i].Model = modelId
     }
+    err = params.setIds(modelId)
+    if err != nil {
+      return err
+    }
   }
   model.NumCovariates = len(coefficients)
-  txn, err := DBMAP.Begin()
-  if err != nil {
-    log.Fatal("Transaction Begin error", err)
-    return err
-  }
   if isNew {
-    txn.Insert(model)
-    for _, coefficient := range coefficients {
-      txn.Insert(&coefficient)
+    err = txn.Insert(model)
+    if err != nil {
+      return fmt.Errorf("Saving model: %w", err)
+    }
+    for i := range coefficients {
+      err = txn.Insert(&coefficients[i])
+      if err != nil {
+        return fmt.Errorf("Saving coefficient %q: %w", coefficients[i].Label, err)
+      }
+    }
+    err = params.insert(txn)
+    if err != nil {
+      return err
+    }
+    if model.HasStatistics() {
+      statistics, err := newStatistics(model.Id, model.NumCovariates)
+      if err != nil {
+        return err
+      }
+      for s := range statistics {
+        err = txn.Insert(&statistics[s])
+        if err != nil {
+          return fmt.Errorf("Saving statistics: %w", err)
+        }
+      }
     }
   } else {
-    txn.Update(model)
-    for _, coefficient := range coefficients {
-      txn.Update(&coefficient)
+    err = model.lockCounts(txn)
+    if err == nil {
+      _, err = txn.Update(model)
+    }
+    if err != nil {
+      return fmt.Errorf("Saving model: %w", err)
+    }
+    for i := range coefficients {
+      _, err = txn.Update(&coefficients[i])
+      if err != nil {
+        return fmt.Errorf("Saving coefficient %q: %w", coefficients[i].Label, err)
+      }
+    }
+    err = params.update(txn, model.Id)
+    if err != nil {
+      return err
     }
-  }
-  err = txn.Commit()
-  if err != nil {
-    log.Fatal("failed insert", err)
-    return err
   }
   return nil
 }
 
-func DeleteModelById(modelId string) error {
+func DeleteModelById(ctx context.Context, modelId string) error {
   paramMap := map[string]interface{} {"model": modelId}
 
   var dataIds []string
-  _, err := DBMAP.Select(&dataIds, "select id from data where model=:model", paramMap)
+  _, err := withContext(ctx).Select(&dataIds, "select id from data where model=:model", paramMap)
   if err != nil {
     return err
   }
 
-  txn, err := DBMAP.Begin()
+  txn, err := withContext(ctx).Begin()
   if err != nil {
-    return err
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
   }
   for _, datumId := range dataIds {
     _, err = txn.Exec("delete from covariates where datum=$1",  datumId)
     if err != nil {
-      log.Printf("err on delete covariates (datum = %v): %v\n", datumId, err)
-      return txn.Rollback()
+      logging.Errorf(ctx, "err on delete covariates (datum = %v): %v", datumId, err)
+      txn.Rollback()
+      return fmt.Errorf("Deleting model %v: %w", modelId, err)
     }
   }
   _, err = txn.Exec("delete from data where model=$1", modelId)
   if err != nil {
-    log.Printf("err on delete data: %v\n", err)
-    return txn.Rollback()
+    logging.Errorf(ctx, "err on delete data: %v", err)
+    txn.Rollback()
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
+  }
+  _, err = txn.Exec("delete from statistics where model=$1", modelId)
+  if err != nil {
+    logging.Errorf(ctx, "err on delete statistics: %v", err)
+    txn.Rollback()
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
+  }
+  _, err = txn.Exec("delete from version_coefficients where model=$1", modelId)
+  if err != nil {
+    logging.Errorf(ctx, "err on delete version coefficients: %v", err)
+    txn.Rollback()
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
+  }
+  _, err = txn.Exec("delete from model_versions where model=$1", modelId)
+  if err != nil {
+    logging.Errorf(ctx, "err on delete model versions: %v", err)
+    txn.Rollback()
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
+  }
+  _, err = txn.Exec("delete from posterior_covariances where model=$1", modelId)
+  if err != nil {
+    logging.Errorf(ctx, "err on delete posterior covariances: %v", err)
+    txn.Rollback()
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
+  }
+  _, err = txn.Exec("delete from baseline_hazards where model=$1", modelId)
+  if err != nil {
+    logging.Errorf(ctx, "err on delete baseline hazards: %v", err)
+    txn.Rollback()
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
+  }
+  _, err = txn.Exec("delete from thresholds where model=$1", modelId)
+  if err != nil {
+    logging.Errorf(ctx, "err on delete thresholds: %v", err)
+    txn.Rollback()
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
+  }
+  _, err = txn.Exec("delete from class_coefficients where model=$1", modelId)
+  if err != nil {
+    logging.Errorf(ctx, "err on delete class coefficients: %v", err)
+    txn.Rollback()
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
   }
   _, err = txn.Exec("delete from coefficients where model=$1", modelId)
   if err != nil {
-    log.Printf("err on delete coefficients: %v\n", err)
-    return txn.Rollback()
+    logging.Errorf(ctx, "err on delete coefficients: %v", err)
+    txn.Rollback()
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
   }
   _, err = txn.Exec("delete from models where id=$1", modelId)
   if err != nil {
-    log.Printf("err on delete model: %v\n", err)
-    return txn.Rollback()
+    logging.Errorf(ctx, "err on delete model: %v", err)
+    txn.Rollback()
+    return fmt.Errorf("Deleting model %v: %w", modelId, err)
   }
   return txn.Commit()
 }
@@ -0,0 +1,89 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "sort"
+)
+
+func (m *Model) GetClassCoefficients(ctx context.Context) ([]ClassCoefficient, error) {
+  var classCoefficients []ClassCoefficient
+  _, err := withContext(ctx).Select(&classCoefficients, "select * from class_coefficients where model=:model order by class, label", map[string]interface{} {"model": m.Id})
+  if err != nil {
+    return nil, err
+  }
+  return classCoefficients, nil
+}
+
+// newClassCoefficients creates the (zero) per-class coefficients of a
+// multinomial model. Classes are sorted so that the first is the reference.
+func newClassCoefficients(classes []string, labels []string) ([]ClassCoefficient, error) {
+  var unique []string
+  seen := make(map[string]bool)
+  for _, class := range classes {
+    if !seen[class] {
+      seen[class] = true
+      unique = append(unique, class)
+    }
+  }
+  if len(unique) < 2 {
+    return nil, errors.New("Multinomial models need at least two classes")
+  }
+  sort.Strings(unique)
+  var classCoefficients []ClassCoefficient
+  for _, class := range unique {
+    for _, label := range labels {
+      classCoefficients = append(classCoefficients, ClassCoefficient{
+        Class: class,
+        Label: label,
+      })
+    }
+  }
+  return classCoefficients, nil
+}
+
+// GetClasses returns the class labels of the given class coefficients, in
+// order. The first is the reference class.
+func GetClasses(classCoefficients []ClassCoefficient) []string {
+  var classes []string
+  for _, coef := range classCoefficients {
+    if len(classes) == 0 || classes[len(classes) - 1] != coef.Class {
+      classes = append(classes, coef.Class)
+    }
+  }
+  return classes
+}
+
+// GetClassCoefficientsArray returns one coefficient vector per class, in the
+// order of GetClasses.
+func GetClassCoefficientsArray(classCoefficients []ClassCoefficient, numCovariates int) [][]float64 {
+  if numCovariates == 0 {
+    return nil
+  }
+  array := make([][]float64, len(classCoefficients) / numCovariates)
+  for i, coef := range classCoefficients {
+    k, j := i / numCovariates, i % numCovariates
+    if array[k] == nil {
+      array[k] = make([]float64, numCovariates)
+    }
+    array[k][j] = coef.Value
+  }
+  return array
+}
+
+func getClassIndices(classes []string, dataClasses []string) ([]int, error) {
+  indexMap := make(map[string]int)
+  for k, class := range classes {
+    indexMap[class] = k
+  }
+  indices := make([]int, len(dataClasses))
+  for i, class := range dataClasses {
+    k, ok := indexMap[class]
+    if !ok {
+      return nil, fmt.Errorf("Unknown class %q", class)
+    }
+    indices[i] = k
+  }
+  return indices, nil
+}
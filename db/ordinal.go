@@ -0,0 +1,119 @@
+package db
+
+import (
+  "github.com/aotimme/cloudml/ordinal"
+  "context"
+  "errors"
+  "fmt"
+  "sort"
+)
+
+func (m *Model) GetThresholds(ctx context.Context) ([]Threshold, error) {
+  var thresholds []Threshold
+  _, err := withContext(ctx).Select(&thresholds, "select * from thresholds where model=:model order by threshold_index", map[string]interface{} {"model": m.Id})
+  if err != nil {
+    return nil, err
+  }
+  return thresholds, nil
+}
+
+// newThresholds creates the (zero) thresholds between the sorted levels of
+// an ordinal model.
+func newThresholds(levels []float64) ([]Threshold, error) {
+  sorted := make([]float64, len(levels))
+  copy(sorted, levels)
+  sort.Float64s(sorted)
+  var thresholds []Threshold
+  for k := 1; k < len(sorted); k++ {
+    if sorted[k] == sorted[k - 1] {
+      continue
+    }
+    thresholds = append(thresholds, Threshold{
+      Index: len(thresholds),
+      Lower: sorted[k - 1],
+      Upper: sorted[k],
+    })
+  }
+  if len(thresholds) == 0 {
+    return nil, errors.New("Ordinal models need at least two levels")
+  }
+  return thresholds, nil
+}
+
+// GetLevels returns the ordered levels delimited by the given thresholds.
+func GetLevels(thresholds []Threshold) []float64 {
+  if len(thresholds) == 0 {
+    return nil
+  }
+  levels := make([]float64, len(thresholds) + 1)
+  for k, threshold := range thresholds {
+    levels[k] = threshold.Lower
+    levels[k + 1] = threshold.Upper
+  }
+  return levels
+}
+
+func GetThresholdsArray(thresholds []Threshold) []float64 {
+  array := make([]float64, len(thresholds))
+  for k, threshold := range thresholds {
+    array[k] = threshold.Value
+  }
+  return array
+}
+
+func getLevelIndices(levels []float64, values []float64) ([]int, error) {
+  indexMap := make(map[float64]int)
+  for k, level := range levels {
+    indexMap[level] = k
+  }
+  indices := make([]int, len(values))
+  for i, value := range values {
+    k, ok := indexMap[value]
+    if !ok {
+      return nil, fmt.Errorf("Unknown level %v", value)
+    }
+    indices[i] = k
+  }
+  return indices, nil
+}
+
+func (f *Fit) trainOrdinal(ctx context.Context, d *DataArray) error {
+  m := f.Model
+  thresholds := f.Parameters.Thresholds
+  levels := GetLevels(thresholds)
+  labels, err := getLevelIndices(levels, d.Values)
+  if err != nil {
+    return err
+  }
+  theta, beta, iterations, err := ordinal.Learn(ctx, d.Covariates, labels, d.Weights, d.Offsets, m.Lambda, GetThresholdsArray(thresholds), GetCoefficientsArrayFromCoefficients(f.Coefficients), 100)
+  if err != nil {
+    return err
+  }
+  f.Iterations = iterations
+  m.TrainRmse = ordinal.RMSE(theta, beta, d.Covariates, labels, d.Weights, d.Offsets, levels)
+  f.setCoefficients(beta)
+  for k, value := range theta {
+    thresholds[k].Value = value
+  }
+  return nil
+}
+
+func (f *Fit) cvOrdinal(ctx context.Context, d *DataArray) (float64, error) {
+  levels := GetLevels(f.Parameters.Thresholds)
+  labels, err := getLevelIndices(levels, d.Values)
+  if err != nil {
+    return 0.0, err
+  }
+  return ordinal.CV(ctx, d.Covariates, labels, d.Weights, d.Offsets, levels, f.Model.Lambda)
+}
+
+// PredictLevels returns the levels of an ordinal model along with the
+// cumulative probability P(value <= level) and the probability of each.
+func (f *Fit) PredictLevels(covariates map[string]float64, offset float64) ([]float64, []float64, []float64, error) {
+  if f.Model.Type != "ordinal" {
+    return nil, nil, nil, errors.New("Model does not predict levels")
+  }
+  thresholds := f.Parameters.Thresholds
+  cumulative, probs := ordinal.Predict(GetThresholdsArray(thresholds), GetCoefficientsArrayFromCoefficients(f.Coefficients), f.covariateArray(covariates), offset)
+  return GetLevels(thresholds), cumulative, probs, nil
+}
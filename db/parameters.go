@@ -0,0 +1,176 @@
+package db
+
+import (
+  "context"
+  "github.com/coopernurse/gorp"
+)
+
+// Parameters are the fitted values some model types store alongside their
+// coefficients.
+type Parameters struct {
+  ClassCoefficients []ClassCoefficient
+  Thresholds []Threshold
+  // BaselineHazards replace all of the model's baseline hazards when saved,
+  // unless nil.
+  BaselineHazards []BaselineHazard
+  // PosteriorCovariances likewise replace the model's posterior covariance.
+  PosteriorCovariances []PosteriorCovariance
+}
+
+func (m *Model) GetParameters(ctx context.Context) (*Parameters, error) {
+  classCoefficients, err := m.GetClassCoefficients(ctx)
+  if err != nil {
+    return nil, err
+  }
+  thresholds, err := m.GetThresholds(ctx)
+  if err != nil {
+    return nil, err
+  }
+  baselineHazards, err := m.GetBaselineHazards(ctx)
+  if err != nil {
+    return nil, err
+  }
+  posteriorCovariances, err := m.GetPosteriorCovariances(ctx)
+  if err != nil {
+    return nil, err
+  }
+  return &Parameters{
+    ClassCoefficients: classCoefficients,
+    Thresholds: thresholds,
+    BaselineHazards: baselineHazards,
+    PosteriorCovariances: posteriorCovariances,
+  }, nil
+}
+
+// Reset sets every parameter back to zero and drops the baseline hazards and
+// posterior covariance.
+func (params *Parameters) Reset() {
+  for i := range params.ClassCoefficients {
+    params.ClassCoefficients[i].Value = 0.0
+  }
+  for i := range params.Thresholds {
+    params.Thresholds[i].Value = 0.0
+  }
+  if params.BaselineHazards != nil {
+    params.BaselineHazards = []BaselineHazard{}
+  }
+  if params.PosteriorCovariances != nil {
+    params.PosteriorCovariances = []PosteriorCovariance{}
+  }
+}
+
+func (params *Parameters) setIds(modelId string) error {
+  for i := range params.ClassCoefficients {
+    id, err := newUUID()
+    if err != nil {
+      return err
+    }
+    params.ClassCoefficients[i].Id = id
+    params.ClassCoefficients[i].Model = modelId
+  }
+  for i := range params.Thresholds {
+    id, err := newUUID()
+    if err != nil {
+      return err
+    }
+    params.Thresholds[i].Id = id
+    params.Thresholds[i].Model = modelId
+  }
+  for i := range params.BaselineHazards {
+    id, err := newUUID()
+    if err != nil {
+      return err
+    }
+    params.BaselineHazards[i].Id = id
+    params.BaselineHazards[i].Model = modelId
+  }
+  for i := range params.PosteriorCovariances {
+    id, err := newUUID()
+    if err != nil {
+      return err
+    }
+    params.PosteriorCovariances[i].Id = id
+    params.PosteriorCovariances[i].Model = modelId
+  }
+  return nil
+}
+
+func (params *Parameters) insert(txn *gorp.Transaction) error {
+  for i := range params.ClassCoefficients {
+    err := txn.Insert(&params.ClassCoefficients[i])
+    if err != nil {
+      return err
+    }
+  }
+  for i := range params.Thresholds {
+    err := txn.Insert(&params.Thresholds[i])
+    if err != nil {
+      return err
+    }
+  }
+  for i := range params.BaselineHazards {
+    err := txn.Insert(&params.BaselineHazards[i])
+    if err != nil {
+      return err
+    }
+  }
+  for i := range params.PosteriorCovariances {
+    err := txn.Insert(&params.PosteriorCovariances[i])
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (params *Parameters) update(txn *gorp.Transaction, modelId string) error {
+  for i := range params.ClassCoefficients {
+    _, err := txn.Update(&params.ClassCoefficients[i])
+    if err != nil {
+      return err
+    }
+  }
+  for i := range params.Thresholds {
+    _, err := txn.Update(&params.Thresholds[i])
+    if err != nil {
+      return err
+    }
+  }
+  if params.BaselineHazards != nil {
+    _, err := txn.Exec("delete from baseline_hazards where model=$1", modelId)
+    if err != nil {
+      return err
+    }
+    for i := range params.BaselineHazards {
+      id, err := newUUID()
+      if err != nil {
+        return err
+      }
+      params.BaselineHazards[i].Id = id
+      params.BaselineHazards[i].Model = modelId
+      err = txn.Insert(&params.BaselineHazards[i])
+      if err != nil {
+        return err
+      }
+    }
+  }
+  if params.PosteriorCovariances != nil {
+    _, err := txn.Exec("delete from posterior_covariances where model=$1", modelId)
+    if err != nil {
+      return err
+    }
+    for i := range params.PosteriorCovariances {
+      id, err := newUUID()
+      if err != nil {
+        return err
+      }
+      params.PosteriorCovariances[i].Id = id
+      params.PosteriorCovariances[i].Model = modelId
+      err = txn.Insert(&params.PosteriorCovariances[i])
+      if err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+  "github.com/aotimme/cloudml/robust"
+  "context"
+  "errors"
+)
+
+// ConfigureRobust checks the robust and quantile settings of a new model and
+// fills in the defaults.
+func (m *Model) ConfigureRobust() error {
+  if m.Robust {
+    if m.Type != "linear" || (m.Link != "" && m.Link != "identity") {
+      return errors.New("Only linear models with the identity link can be robust")
+    }
+    if m.HuberK == 0.0 {
+      m.HuberK = robust.DefaultHuberK
+    }
+    if m.HuberK < 0.0 {
+      return errors.New("huber_k must be positive")
+    }
+  }
+  if m.Type == "quantile" {
+    if m.Quantile == 0.0 {
+      m.Quantile = 0.5
+    }
+    if m.Quantile <= 0.0 || m.Quantile >= 1.0 {
+      return errors.New("quantile must be between 0 and 1")
+    }
+  }
+  return nil
+}
+
+// usesRobust reports whether the model is fitted by the robust package.
+func (m *Model) usesRobust() bool {
+  return m.Robust || m.Type == "quantile"
+}
+
+func (m *Model) learnRobust(ctx context.Context, d *DataArray, betaStart []float64) ([]float64, int, error) {
+  if m.Type == "quantile" {
+    beta, iterations, err := robust.Quantile(ctx, d.Covariates, d.Values, d.Weights, d.Offsets, m.Lambda, m.Quantile, betaStart, 200)
+    if err != nil {
+      return nil, iterations, err
+    }
+    m.TrainPinball = robust.Pinball(beta, d.Covariates, d.Values, d.Weights, d.Offsets, m.Quantile)
+    return beta, iterations, nil
+  }
+  beta, iterations, err := robust.Huber(ctx, d.Covariates, d.Values, d.Weights, d.Offsets, m.Lambda, m.HuberK, betaStart, 100)
+  if err != nil {
+    return nil, iterations, err
+  }
+  m.TrainRmse = robust.RMSE(beta, d.Covariates, d.Values, d.Weights, d.Offsets)
+  return beta, iterations, nil
+}
+
+func (m *Model) cvRobust(ctx context.Context, d *DataArray) error {
+  if m.Type == "quantile" {
+    cv, err := robust.QuantileCV(ctx, d.Covariates, d.Values, d.Weights, d.Offsets, m.Lambda, m.Quantile)
+    if err != nil {
+      return err
+    }
+    m.CvPinball = cv
+    return nil
+  }
+  cv, err := robust.HuberCV(ctx, d.Covariates, d.Values, d.Weights, d.Offsets, m.Lambda, m.HuberK)
+  if err != nil {
+    return err
+  }
+  m.CvRmse = cv
+  return nil
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "github.com/coopernurse/gorp"
+  "github.com/lib/pq"
+)
+
+// HasStatistics reports whether the model keeps running sufficient
+// statistics that are updated on every datum insert and delete, which is the
+// case for least squares (gaussian family, identity link) and bayesian linear
+// regression.
+func (m *Model) HasStatistics() bool {
+  if m.Type == "bayesian_linear" {
+    return true
+  }
+  if !m.IsGLM() || m.Robust {
+    return false
+  }
+  g, err := m.GetGLM()
+  return err == nil && g.Family.Name() == "gaussian" && g.Link.Name() == "identity"
+}
+
+func newStatistics(modelId string, p int) ([]Statistic, error) {
+  var statistics []Statistic
+  for j := 0; j <= p; j++ {
+    for k := j; k <= p; k++ {
+      id, err := newUUID()
+      if err != nil {
+        return nil, err
+      }
+      statistics = append(statistics, Statistic{
+        Id: id,
+        Model: modelId,
+        Row: j,
+        Col: k,
+      })
+    }
+  }
+  return statistics, nil
+}
+
+// statisticsDelta accumulates weight * zᵀz over data, where z is a datum's
+// covariates (ordered by label) followed by its value less its offset. Only
+// the upper triangle is kept.
+type statisticsDelta [][]float64
+
+func newStatisticsDelta(p int) statisticsDelta {
+  delta := make(statisticsDelta, p + 1)
+  for j := range delta {
+    delta[j] = make([]float64, p + 1)
+  }
+  return delta
+}
+
+// add adds a datum; a negative weight removes it.
+func (delta statisticsDelta) add(covariates []Covariate, value float64, weight float64) {
+  z := make([]float64, len(covariates) + 1)
+  for j, covariate := range covariates {
+    z[j] = covariate.Value
+  }
+  z[len(covariates)] = value
+  for j := range z {
+    for k := j; k < len(z); k++ {
+      delta[j][k] += weight * z[j] * z[k]
+    }
+  }
+}
+
+// updateStatistics adds delta to the model's statistics in a single
+// statement, however many data it holds.
+func updateStatistics(txn *gorp.Transaction, modelId string, delta statisticsDelta) error {
+  var rows, cols []int64
+  var values []float64
+  for j := range delta {
+    for k := j; k < len(delta); k++ {
+      rows = append(rows, int64(j))
+      cols = append(cols, int64(k))
+      values = append(values, delta[j][k])
+    }
+  }
+  _, err := txn.Exec("update statistics set value = statistics.value + d.delta from unnest($2::int[], $3::int[], $4::float8[]) as d(row_index, col_index, delta) where statistics.model=$1 and statistics.row_index=d.row_index and statistics.col_index=d.col_index", modelId, pq.Array(rows), pq.Array(cols), pq.Array(values))
+  return err
+}
+
+func (m *Model) GetStatistics(ctx context.Context) ([]Statistic, error) {
+  var statistics []Statistic
+  _, err := withContext(ctx).Select(&statistics, "select * from statistics where model=:model", map[string]interface{} {"model": m.Id})
+  if err != nil {
+    return nil, err
+  }
+  return statistics, nil
+}
+
+// GetStatisticsArrays returns XᵀWX, XᵀWY and YᵀWY for the model, rebuilding the
+// statistics from the stored data if they are missing.
+func (m *Model) GetStatisticsArrays(ctx context.Context) ([][]float64, []float64, float64, error) {
+  p := m.NumCovariates
+  statistics, err := m.GetStatistics(ctx)
+  if err != nil {
+    return nil, nil, 0.0, err
+  }
+  if len(statistics) != (p + 1) * (p + 2) / 2 {
+    logging.Infof(ctx, "Rebuilding statistics for model %v", m.Id)
+    err = m.RebuildStatistics(ctx)
+    if err != nil {
+      return nil, nil, 0.0, err
+    }
+    statistics, err = m.GetStatistics(ctx)
+    if err != nil {
+      return nil, nil, 0.0, err
+    }
+  }
+  xtx := make([][]float64, p)
+  for j := range xtx {
+    xtx[j] = make([]float64, p)
+  }
+  xty := make([]float64, p)
+  yty := 0.0
+  for _, statistic := range statistics {
+    j, k := statistic.Row, statistic.Col
+    if j == p && k == p {
+      yty = statistic.Value
+    } else if k == p {
+      xty[j] = statistic.Value
+    } else {
+      xtx[j][k] = statistic.Value
+      xtx[k][j] = statistic.Value
+    }
+  }
+  return xtx, xty, yty, nil
+}
+
+// GetStatisticsArrays computes XᵀWX, XᵀWY and YᵀWY from the data, where Y is
+// the values less the offsets, and p covariates.
+func (d *DataArray) GetStatisticsArrays(p int) ([][]float64, []float64, float64) {
+  xtx := make([][]float64, p)
+  for j := range xtx {
+    xtx[j] = make([]float64, p)
+  }
+  xty := make([]float64, p)
+  yty := 0.0
+  for i, x := range d.Covariates {
+    w := d.Weights[i]
+    y := d.Values[i] - d.Offsets[i]
+    for j := range x {
+      for k := range x {
+        xtx[j][k] += w * x[j] * x[k]
+      }
+      xty[j] += w * x[j] * y
+    }
+    yty += w * y * y
+  }
+  return xtx, xty, yty
+}
+
+// RebuildStatistics recomputes the model's statistics from all of its data.
+func (m *Model) RebuildStatistics(ctx context.Context) error {
+  d, err := m.GetDataArray(ctx)
+  if err != nil {
+    return err
+  }
+  statistics, err := newStatistics(m.Id, m.NumCovariates)
+  if err != nil {
+    return err
+  }
+  p := m.NumCovariates
+  xtx, xty, yty := d.GetStatisticsArrays(p)
+  for s, statistic := range statistics {
+    j, k := statistic.Row, statistic.Col
+    if j == p && k == p {
+      statistics[s].Value = yty
+    } else if k == p {
+      statistics[s].Value = xty[j]
+    } else {
+      statistics[s].Value = xtx[j][k]
+    }
+  }
+  txn, err := withContext(ctx).Begin()
+  if err != nil {
+    return err
+  }
+  _, err = txn.Exec("delete from statistics where model=$1", m.Id)
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+  for s := range statistics {
+    err = txn.Insert(&statistics[s])
+    if err != nil {
+      txn.Rollback()
+      return err
+    }
+  }
+  return txn.Commit()
+}
@@ -1,18 +1,72 @@
 package db
 
+import (
+  "time"
+)
+
 type Model struct {
   Id string `db:"id"`
+  // Tenant owns the model; see ApiKey.
+  Tenant string `db:"tenant"`
   Type string `db:"type"`
+  Family string `db:"family"`
+  Link string `db:"link"`
+  Robust bool `db:"robust"`
+  HuberK float64 `db:"huber_k"`
+  Quantile float64 `db:"quantile"`
+  PriorPrecision float64 `db:"prior_precision"`
+  NoiseVariance float64 `db:"noise_variance"`
+  EmpiricalBayes bool `db:"empirical_bayes"`
+  Version int `db:"version"`
+  NumVersions int `db:"num_versions"`
+  // Intercept is the label of the covariate that is always 1, if known.
+  Intercept string `db:"intercept"`
   Lambda float64 `db:"lambda"`
   NumTrainingData int `db:"num_training_data"`
+  SumWeights float64 `db:"sum_weights"`
   NumCovariates int `db:"num_covariates"`
   TrainRmse float64 `db:"train_rmse"`
   CvRmse float64 `db:"cv_rmse"`
+  TrainPinball float64 `db:"train_pinball"`
+  CvPinball float64 `db:"cv_pinball"`
+  TrainConcordance float64 `db:"train_concordance"`
+  CvConcordance float64 `db:"cv_concordance"`
 }
+// Coefficient.Source is "trained" or "imported" once the coefficient has been
+// fitted, and "" before.
 type Coefficient struct {
   Id string `db:"id"`
   Label string `db:"label"`
   Value float64 `db:"value"`
+  Source string `db:"source"`
+  Model string `db:"model"`
+}
+// ClassCoefficient is the coefficient of a covariate for one class of a
+// multinomial model. The first class (by label) is the reference class and
+// its coefficients stay at zero.
+type ClassCoefficient struct {
+  Id string `db:"id"`
+  Class string `db:"class"`
+  Label string `db:"label"`
+  Value float64 `db:"value"`
+  Model string `db:"model"`
+}
+// Threshold is the cut-point of an ordinal model between the levels Lower
+// and Upper, so that logit P(value <= Lower) = Value - x·β.
+type Threshold struct {
+  Id string `db:"id"`
+  Index int `db:"threshold_index"`
+  Lower float64 `db:"lower"`
+  Upper float64 `db:"upper"`
+  Value float64 `db:"value"`
+  Model string `db:"model"`
+}
+// BaselineHazard is the Breslow estimate of the cumulative baseline hazard
+// of a Cox model at an event time.
+type BaselineHazard struct {
+  Id string `db:"id"`
+  Time float64 `db:"time"`
+  Value float64 `db:"value"`
   Model string `db:"model"`
 }
 type Covariate struct {
@@ -24,6 +78,79 @@ type Covariate struct {
 type Datum struct {
   Id string `db:"id"`
   Value float64 `db:"value"`
+  Weight float64 `db:"weight"`
+  Offset float64 `db:"offset_value"`
+  Class string `db:"class"`
+  Duration float64 `db:"duration"`
+  Event bool `db:"event"`
   //Covariates []Covariate `db:"covariates"`
   Model string `db:"model"`
 }
+// PosteriorCovariance is one entry of the upper triangle of the posterior
+// covariance of the coefficients of a bayesian_linear model, ordered by label.
+type PosteriorCovariance struct {
+  Id string `db:"id"`
+  Model string `db:"model"`
+  Row int `db:"row_index"`
+  Col int `db:"col_index"`
+  Value float64 `db:"value"`
+}
+// ModelVersion is an immutable snapshot of a model after a training run. The
+// parameters other than the coefficients are kept as JSON.
+type ModelVersion struct {
+  Id string `db:"id"`
+  Model string `db:"model"`
+  Version int `db:"version"`
+  Created time.Time `db:"created"`
+  Lambda float64 `db:"lambda"`
+  PriorPrecision float64 `db:"prior_precision"`
+  NoiseVariance float64 `db:"noise_variance"`
+  NumTrainingData int `db:"num_training_data"`
+  SumWeights float64 `db:"sum_weights"`
+  TrainRmse float64 `db:"train_rmse"`
+  CvRmse float64 `db:"cv_rmse"`
+  TrainPinball float64 `db:"train_pinball"`
+  CvPinball float64 `db:"cv_pinball"`
+  TrainConcordance float64 `db:"train_concordance"`
+  CvConcordance float64 `db:"cv_concordance"`
+  Parameters string `db:"parameters"`
+}
+type VersionCoefficient struct {
+  Id string `db:"id"`
+  Model string `db:"model"`
+  ModelVersion string `db:"model_version"`
+  Label string `db:"label"`
+  Value float64 `db:"value"`
+}
+// Statistic is one entry of the upper triangle of [X Y]ᵀW[X Y] for a model,
+// where the columns of X are the covariates ordered by label, Y is the value
+// minus the offset and W holds the weights. Index NumCovariates refers to Y.
+type Statistic struct {
+  Id string `db:"id"`
+  Model string `db:"model"`
+  Row int `db:"row_index"`
+  Col int `db:"col_index"`
+  Value float64 `db:"value"`
+}
+// ApiKey is a key to the API of a tenant. Only the SHA-256 hash of the key is
+// stored. The role (see RoleReader) sets what the key may do.
+type ApiKey struct {
+  Id string `db:"id"`
+  Hash string `db:"hash"`
+  Tenant string `db:"tenant"`
+  Role string `db:"role"`
+  Created time.Time `db:"created"`
+  // Quotas of the key, each 0 for the server's default or negative for no
+  // limit.
+  RateLimit float64 `db:"rate_limit"`
+  MaxModels int `db:"max_models"`
+  MaxRowsPerModel int `db:"max_rows_per_model"`
+  MaxTrainingJobs int `db:"max_training_jobs"`
+}
+// LearnJob is a model left to train when the server stopped, to be trained
+// when it starts again.
+type LearnJob struct {
+  Id string `db:"id"`
+  Model string `db:"model"`
+  Queued time.Time `db:"queued"`
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+  "context"
+  "encoding/json"
+  "time"
+  "github.com/coopernurse/gorp"
+)
+
+// GetVersions returns the model's versions, oldest first.
+func (m *Model) GetVersions(ctx context.Context) ([]ModelVersion, error) {
+  var versions []ModelVersion
+  _, err := withContext(ctx).Select(&versions, "select * from model_versions where model=:model order by version", map[string]interface{} {"model": m.Id})
+  if err != nil {
+    return nil, err
+  }
+  return versions, nil
+}
+
+// GetVersion returns the given version of the model, or a NotFound error if
+// there is none.
+func (m *Model) GetVersion(ctx context.Context, version int) (*ModelVersion, error) {
+  var versions []ModelVersion
+  _, err := withContext(ctx).Select(&versions, "select * from model_versions where model=:model and version=:version", map[string]interface{} {"model": m.Id, "version": version})
+  if err != nil {
+    return nil, err
+  }
+  if len(versions) == 0 {
+    return nil, newError(NotFound, "Version %v of model %v not found", version, m.Id)
+  }
+  return &versions[0], nil
+}
+
+func (v *ModelVersion) GetCoefficients(ctx context.Context) ([]VersionCoefficient, error) {
+  var coefficients []VersionCoefficient
+  _, err := withContext(ctx).Select(&coefficients, "select * from version_coefficients where model_version=:model_version order by label", map[string]interface{} {"model_version": v.Id})
+  if err != nil {
+    return nil, err
+  }
+  return coefficients, nil
+}
+
+// saveVersion saves the fit of the model as just trained (or imported) and
+// records it as the model's next version, which becomes the current one, in a
+// single transaction. source marks where its coefficients came from.
+func (m *Model) saveVersion(ctx context.Context, f *Fit, source string) error {
+  txn, err := withContext(ctx).Begin()
+  if err != nil {
+    return err
+  }
+  err = m.nextVersion(txn)
+  if err == nil {
+    err = m.saveWithParameters(txn, f.Coefficients, f.Parameters)
+  }
+  if err == nil {
+    err = m.insertVersion(txn, f, source)
+  }
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+  return txn.Commit()
+}
+
+// nextVersion locks the model's row, so that concurrent runs are numbered one
+// after the other, and makes the version after its last one current.
+func (m *Model) nextVersion(txn *gorp.Transaction) error {
+  version := int64(1)
+  if m.Id != "" {
+    _, err := txn.Exec("select id from models where id=$1 for update", m.Id)
+    if err != nil {
+      return err
+    }
+    version, err = txn.SelectInt("select coalesce(max(version), 0) + 1 from model_versions where model=$1", m.Id)
+    if err != nil {
+      return err
+    }
+  }
+  m.NumVersions = int(version)
+  m.Version = int(version)
+  return nil
+}
+
+// insertVersion records the saved fit f as version m.Version.
+func (m *Model) insertVersion(txn *gorp.Transaction, f *Fit, source string) error {
+  params, err := json.Marshal(f.Parameters)
+  if err != nil {
+    return err
+  }
+  versionId, err := newUUID()
+  if err != nil {
+    return err
+  }
+  version := &ModelVersion{
+    Id: versionId,
+    Model: m.Id,
+    Version: m.Version,
+    Created: time.Now().UTC(),
+    Lambda: m.Lambda,
+    PriorPrecision: m.PriorPrecision,
+    NoiseVariance: m.NoiseVariance,
+    NumTrainingData: m.NumTrainingData,
+    SumWeights: m.SumWeights,
+    TrainRmse: m.TrainRmse,
+    CvRmse: m.CvRmse,
+    TrainPinball: m.TrainPinball,
+    CvPinball: m.CvPinball,
+    TrainConcordance: m.TrainConcordance,
+    CvConcordance: m.CvConcordance,
+    Parameters: string(params),
+  }
+  err = txn.Insert(version)
+  if err != nil {
+    return err
+  }
+  for _, coefficient := range f.Coefficients {
+    id, err := newUUID()
+    if err != nil {
+      return err
+    }
+    err = txn.Insert(&VersionCoefficient{
+      Id: id,
+      Model: m.Id,
+      ModelVersion: versionId,
+      Label: coefficient.Label,
+      Value: coefficient.Value,
+    })
+    if err != nil {
+      return err
+    }
+  }
+  _, err = txn.Exec("update coefficients set source=$1 where model=$2", source, m.Id)
+  return err
+}
+
+// Import saves a new model whose coefficients and parameters were fitted
+// elsewhere, as its first version.
+func (m *Model) Import(ctx context.Context, coefficients []Coefficient, params *Parameters) error {
+  if m.Id != "" {
+    return newError(Invalid, "Only new models can be imported")
+  }
+  if params == nil {
+    params = &Parameters{}
+  }
+  return m.saveVersion(ctx, &Fit{Model: m, Coefficients: coefficients, Parameters: params}, "imported")
+}
+
+// GetFit returns the model as it was at version v. Only the fitted values
+// come from the version; the data counts are those of the training run.
+func (v *ModelVersion) GetFit(ctx context.Context, m *Model) (*Fit, error) {
+  model := *m
+  model.Version = v.Version
+  model.Lambda = v.Lambda
+  model.PriorPrecision = v.PriorPrecision
+  model.NoiseVariance = v.NoiseVariance
+  model.NumTrainingData = v.NumTrainingData
+  model.SumWeights = v.SumWeights
+  model.TrainRmse = v.TrainRmse
+  model.CvRmse = v.CvRmse
+  model.TrainPinball = v.TrainPinball
+  model.CvPinball = v.CvPinball
+  model.TrainConcordance = v.TrainConcordance
+  model.CvConcordance = v.CvConcordance
+  versionCoefficients, err := v.GetCoefficients(ctx)
+  if err != nil {
+    return nil, err
+  }
+  coefficients, err := m.GetCoefficients(ctx)
+  if err != nil {
+    return nil, err
+  }
+  values := make(map[string]float64)
+  for _, coefficient := range versionCoefficients {
+    values[coefficient.Label] = coefficient.Value
+  }
+  for j := range coefficients {
+    coefficients[j].Value = values[coefficients[j].Label]
+  }
+  // promoted coefficients keep their source
+  params := &Parameters{}
+  err = json.Unmarshal([]byte(v.Parameters), params)
+  if err != nil {
+    return nil, err
+  }
+  return &Fit{Model: &model, Coefficients: coefficients, Parameters: params}, nil
+}
+
+// Promote makes version v the model's current fit again, as a rollback. The
+// model keeps its data, so its data counts are not restored.
+func (m *Model) Promote(ctx context.Context, v *ModelVersion) error {
+  fit, err := v.GetFit(ctx, m)
+  if err != nil {
+    return err
+  }
+  numTrainingData, sumWeights := m.NumTrainingData, m.SumWeights
+  *m = *fit.Model
+  m.NumTrainingData = numTrainingData
+  m.SumWeights = sumWeights
+  // replace the baseline hazards and posterior covariance even if the
+  // version has none
+  params := fit.Parameters
+  if params.BaselineHazards == nil {
+    params.BaselineHazards = []BaselineHazard{}
+  }
+  if params.PosteriorCovariances == nil {
+    params.PosteriorCovariances = []PosteriorCovariance{}
+  }
+  return m.SaveWithParameters(ctx, fit.Coefficients, params)
+}
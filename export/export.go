@@ -0,0 +1,96 @@
+package export
+
+import (
+  "github.com/aotimme/cloudml/db"
+)
+
+// Format and FormatVersion identify the portable JSON format.
+const (
+  Format = "cloudml"
+  FormatVersion = 1
+)
+
+type Coefficient struct {
+  Label string `json:"label"`
+  Value float64 `json:"value"`
+}
+
+type ClassCoefficient struct {
+  Class string `json:"class"`
+  Label string `json:"label"`
+  Value float64 `json:"value"`
+}
+
+type Threshold struct {
+  Lower float64 `json:"lower"`
+  Upper float64 `json:"upper"`
+  Value float64 `json:"value"`
+}
+
+type BaselineHazard struct {
+  Time float64 `json:"time"`
+  CumulativeHazard float64 `json:"cumulative_hazard"`
+}
+
+// Model is a trained model in the portable JSON format, which holds
+// everything needed to score it offline. Intercept names the covariate that
+// is always 1, if there is one.
+type Model struct {
+  Format string `json:"format"`
+  FormatVersion int `json:"format_version"`
+  Type string `json:"type"`
+  Family string `json:"family,omitempty"`
+  Link string `json:"link,omitempty"`
+  Robust bool `json:"robust,omitempty"`
+  HuberK float64 `json:"huber_k,omitempty"`
+  Quantile float64 `json:"quantile,omitempty"`
+  PriorPrecision float64 `json:"prior_precision,omitempty"`
+  NoiseVariance float64 `json:"noise_variance,omitempty"`
+  Lambda float64 `json:"lambda"`
+  Version int `json:"version,omitempty"`
+  NumTrainingData int `json:"num_training_data"`
+  Intercept string `json:"intercept,omitempty"`
+  Coefficients []Coefficient `json:"coefficients"`
+  ClassCoefficients []ClassCoefficient `json:"class_coefficients,omitempty"`
+  Thresholds []Threshold `json:"thresholds,omitempty"`
+  BaselineHazards []BaselineHazard `json:"baseline_hazards,omitempty"`
+  Covariance [][]float64 `json:"covariance,omitempty"`
+}
+
+// FromFit exports the model, with coefficients and parameters, of fit.
+func FromFit(fit *db.Fit, intercept string) *Model {
+  m := fit.Model
+  e := &Model{
+    Format: Format,
+    FormatVersion: FormatVersion,
+    Type: m.Type,
+    Family: m.Family,
+    Link: m.Link,
+    Robust: m.Robust,
+    HuberK: m.HuberK,
+    Quantile: m.Quantile,
+    Lambda: m.Lambda,
+    Version: m.Version,
+    NumTrainingData: m.NumTrainingData,
+    Intercept: intercept,
+    Coefficients: make([]Coefficient, len(fit.Coefficients)),
+  }
+  for j, c := range fit.Coefficients {
+    e.Coefficients[j] = Coefficient{Label: c.Label, Value: c.Value}
+  }
+  for _, c := range fit.Parameters.ClassCoefficients {
+    e.ClassCoefficients = append(e.ClassCoefficients, ClassCoefficient{Class: c.Class, Label: c.Label, Value: c.Value})
+  }
+  for _, t := range fit.Parameters.Thresholds {
+    e.Thresholds = append(e.Thresholds, Threshold{Lower: t.Lower, Upper: t.Upper, Value: t.Value})
+  }
+  for _, h := range fit.Parameters.BaselineHazards {
+    e.BaselineHazards = append(e.BaselineHazards, BaselineHazard{Time: h.Time, CumulativeHazard: h.Value})
+  }
+  if m.Type == "bayesian_linear" {
+    e.PriorPrecision = m.PriorPrecision
+    e.NoiseVariance = m.NoiseVariance
+    e.Covariance = db.GetPosteriorCovarianceArray(m, fit.Parameters.PosteriorCovariances)
+  }
+  return e
+}
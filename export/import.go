@@ -0,0 +1,163 @@
+package export
+
+import (
+  "github.com/aotimme/cloudml/db"
+  "errors"
+  "fmt"
+  "sort"
+)
+
+// ToDB converts e into a new model along with its coefficients and
+// parameters, ready for db.Model.Import.
+func (e *Model) ToDB() (*db.Model, []db.Coefficient, *db.Parameters, error) {
+  if e.Format != Format {
+    return nil, nil, nil, fmt.Errorf("Unknown format %q", e.Format)
+  }
+  if e.FormatVersion > FormatVersion {
+    return nil, nil, nil, fmt.Errorf("Unsupported format version %v", e.FormatVersion)
+  }
+  if !db.IsModelType(e.Type) {
+    return nil, nil, nil, fmt.Errorf("Unknown model type %q", e.Type)
+  }
+  m := &db.Model{
+    Type: e.Type,
+    Family: e.Family,
+    Link: e.Link,
+    Robust: e.Robust,
+    HuberK: e.HuberK,
+    Quantile: e.Quantile,
+    PriorPrecision: e.PriorPrecision,
+    NoiseVariance: e.NoiseVariance,
+    Lambda: e.Lambda,
+    Intercept: e.Intercept,
+  }
+  var err error
+  if m.IsGLM() {
+    err = m.ConfigureGLM()
+  } else if m.Type == "bayesian_linear" {
+    err = m.ConfigureBayesian()
+  }
+  if err == nil {
+    err = m.ConfigureRobust()
+  }
+  if err != nil {
+    return nil, nil, nil, err
+  }
+
+  // coefficients are kept in order of label
+  order := make([]int, len(e.Coefficients))
+  for j := range order {
+    order[j] = j
+  }
+  sort.Slice(order, func(a, b int) bool { return e.Coefficients[order[a]].Label < e.Coefficients[order[b]].Label })
+  coefficients := make([]db.Coefficient, len(e.Coefficients))
+  labels := make(map[string]bool)
+  for j, i := range order {
+    label := e.Coefficients[i].Label
+    if label == "" || labels[label] {
+      return nil, nil, nil, fmt.Errorf("Invalid or repeated coefficient label %q", label)
+    }
+    labels[label] = true
+    coefficients[j] = db.Coefficient{Label: label, Value: e.Coefficients[i].Value}
+  }
+  if e.Intercept != "" && !labels[e.Intercept] {
+    return nil, nil, nil, fmt.Errorf("Intercept %q is not a coefficient", e.Intercept)
+  }
+
+  params := &db.Parameters{}
+  switch m.Type {
+  case "multinomial":
+    params.ClassCoefficients, err = e.classCoefficients(labels)
+  case "ordinal":
+    params.Thresholds, err = e.thresholds()
+  case "cox":
+    params.BaselineHazards, err = e.baselineHazards()
+  case "bayesian_linear":
+    params.PosteriorCovariances, err = e.posteriorCovariances(order)
+  }
+  if err != nil {
+    return nil, nil, nil, err
+  }
+  return m, coefficients, params, nil
+}
+
+func (e *Model) classCoefficients(labels map[string]bool) ([]db.ClassCoefficient, error) {
+  counts := make(map[string]int)
+  seen := make(map[string]bool)
+  classCoefficients := make([]db.ClassCoefficient, len(e.ClassCoefficients))
+  for i, c := range e.ClassCoefficients {
+    key := c.Class + "\x00" + c.Label
+    if !labels[c.Label] || seen[key] {
+      return nil, fmt.Errorf("Invalid or repeated class coefficient %q for class %q", c.Label, c.Class)
+    }
+    seen[key] = true
+    counts[c.Class]++
+    classCoefficients[i] = db.ClassCoefficient{Class: c.Class, Label: c.Label, Value: c.Value}
+  }
+  if len(counts) < 2 {
+    return nil, errors.New("Multinomial models need at least two classes")
+  }
+  for class, count := range counts {
+    if count != len(labels) {
+      return nil, fmt.Errorf("Class %q needs a coefficient for every covariate", class)
+    }
+  }
+  return classCoefficients, nil
+}
+
+func (e *Model) thresholds() ([]db.Threshold, error) {
+  if len(e.Thresholds) == 0 {
+    return nil, errors.New("Ordinal models need at least two levels")
+  }
+  thresholds := make([]db.Threshold, len(e.Thresholds))
+  for k, t := range e.Thresholds {
+    if t.Lower >= t.Upper || (k > 0 && (t.Lower != e.Thresholds[k - 1].Upper || t.Value <= e.Thresholds[k - 1].Value)) {
+      return nil, errors.New("Thresholds must be in increasing order of level and value")
+    }
+    thresholds[k] = db.Threshold{Index: k, Lower: t.Lower, Upper: t.Upper, Value: t.Value}
+  }
+  return thresholds, nil
+}
+
+func (e *Model) baselineHazards() ([]db.BaselineHazard, error) {
+  baselineHazards := make([]db.BaselineHazard, len(e.BaselineHazards))
+  for k, h := range e.BaselineHazards {
+    baselineHazards[k] = db.BaselineHazard{Time: h.Time, Value: h.CumulativeHazard}
+  }
+  sort.Slice(baselineHazards, func(a, b int) bool { return baselineHazards[a].Time < baselineHazards[b].Time })
+  for k := 1; k < len(baselineHazards); k++ {
+    if baselineHazards[k].Value < baselineHazards[k - 1].Value {
+      return nil, errors.New("Cumulative hazards must not decrease over time")
+    }
+  }
+  return baselineHazards, nil
+}
+
+// posteriorCovariances returns the upper triangle of the covariance, whose
+// rows and columns are ordered as the exported coefficients, reordered as the
+// coefficients sorted by label.
+func (e *Model) posteriorCovariances(order []int) ([]db.PosteriorCovariance, error) {
+  if e.Covariance == nil {
+    return nil, nil
+  }
+  p := len(order)
+  if len(e.Covariance) != p {
+    return nil, errors.New("Covariance needs a row for every coefficient")
+  }
+  for _, row := range e.Covariance {
+    if len(row) != p {
+      return nil, errors.New("Covariance needs a column for every coefficient")
+    }
+  }
+  var posteriorCovariances []db.PosteriorCovariance
+  for j := 0; j < p; j++ {
+    for k := j; k < p; k++ {
+      posteriorCovariances = append(posteriorCovariances, db.PosteriorCovariance{
+        Row: j,
+        Col: k,
+        Value: e.Covariance[order[j]][order[k]],
+      })
+    }
+  }
+  return posteriorCovariances, nil
+}
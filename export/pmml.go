@@ -0,0 +1,484 @@
+package export
+
+import (
+  "encoding/xml"
+  "errors"
+  "fmt"
+  "sort"
+  "strconv"
+)
+
+// Target is the name of the target field in PMML documents.
+const Target = "value"
+
+type pmmlDocument struct {
+  XMLName xml.Name `xml:"PMML"`
+  Xmlns string `xml:"xmlns,attr,omitempty"`
+  Version string `xml:"version,attr"`
+  Header pmmlHeader `xml:"Header"`
+  DataDictionary pmmlDataDictionary `xml:"DataDictionary"`
+  RegressionModel *pmmlRegressionModel `xml:"RegressionModel"`
+  GeneralRegressionModel *pmmlGeneralRegressionModel `xml:"GeneralRegressionModel"`
+}
+
+type pmmlHeader struct {
+  Description string `xml:"description,attr,omitempty"`
+  Application *pmmlApplication `xml:"Application"`
+}
+
+type pmmlApplication struct {
+  Name string `xml:"name,attr"`
+}
+
+type pmmlDataDictionary struct {
+  NumberOfFields int `xml:"numberOfFields,attr"`
+  DataFields []pmmlDataField `xml:"DataField"`
+}
+
+type pmmlDataField struct {
+  Name string `xml:"name,attr"`
+  Optype string `xml:"optype,attr"`
+  DataType string `xml:"dataType,attr"`
+  Values []pmmlValue `xml:"Value"`
+}
+
+type pmmlValue struct {
+  Value string `xml:"value,attr"`
+}
+
+type pmmlMiningSchema struct {
+  MiningFields []pmmlMiningField `xml:"MiningField"`
+}
+
+type pmmlMiningField struct {
+  Name string `xml:"name,attr"`
+  UsageType string `xml:"usageType,attr,omitempty"`
+}
+
+type pmmlRegressionModel struct {
+  ModelName string `xml:"modelName,attr,omitempty"`
+  FunctionName string `xml:"functionName,attr"`
+  NormalizationMethod string `xml:"normalizationMethod,attr,omitempty"`
+  MiningSchema pmmlMiningSchema `xml:"MiningSchema"`
+  RegressionTables []pmmlRegressionTable `xml:"RegressionTable"`
+}
+
+type pmmlRegressionTable struct {
+  Intercept float64 `xml:"intercept,attr"`
+  TargetCategory string `xml:"targetCategory,attr,omitempty"`
+  NumericPredictors []pmmlNumericPredictor `xml:"NumericPredictor"`
+  // only read, to reject them
+  CategoricalPredictors []pmmlPredictor `xml:"CategoricalPredictor"`
+  PredictorTerms []pmmlPredictor `xml:"PredictorTerm"`
+}
+
+type pmmlNumericPredictor struct {
+  Name string `xml:"name,attr"`
+  Exponent int `xml:"exponent,attr,omitempty"`
+  Coefficient float64 `xml:"coefficient,attr"`
+}
+
+type pmmlGeneralRegressionModel struct {
+  ModelName string `xml:"modelName,attr,omitempty"`
+  ModelType string `xml:"modelType,attr"`
+  FunctionName string `xml:"functionName,attr"`
+  Distribution string `xml:"distribution,attr,omitempty"`
+  LinkFunction string `xml:"linkFunction,attr,omitempty"`
+  LinkParameter *float64 `xml:"linkParameter,attr"`
+  MiningSchema pmmlMiningSchema `xml:"MiningSchema"`
+  ParameterList pmmlParameterList `xml:"ParameterList"`
+  FactorList *pmmlPredictorList `xml:"FactorList"`
+  CovariateList pmmlPredictorList `xml:"CovariateList"`
+  PPMatrix pmmlPPMatrix `xml:"PPMatrix"`
+  ParamMatrix pmmlParamMatrix `xml:"ParamMatrix"`
+}
+
+type pmmlParameterList struct {
+  Parameters []pmmlParameter `xml:"Parameter"`
+}
+
+type pmmlParameter struct {
+  Name string `xml:"name,attr"`
+  Label string `xml:"label,attr,omitempty"`
+}
+
+type pmmlPredictorList struct {
+  Predictors []pmmlPredictor `xml:"Predictor"`
+}
+
+type pmmlPredictor struct {
+  Name string `xml:"name,attr"`
+}
+
+type pmmlPPMatrix struct {
+  PPCells []pmmlPPCell `xml:"PPCell"`
+}
+
+type pmmlPPCell struct {
+  Value string `xml:"value,attr"`
+  PredictorName string `xml:"predictorName,attr"`
+  ParameterName string `xml:"parameterName,attr"`
+}
+
+type pmmlParamMatrix struct {
+  PCells []pmmlPCell `xml:"PCell"`
+}
+
+type pmmlPCell struct {
+  TargetCategory string `xml:"targetCategory,attr,omitempty"`
+  ParameterName string `xml:"parameterName,attr"`
+  Beta float64 `xml:"beta,attr"`
+  DF int `xml:"df,attr,omitempty"`
+}
+
+// pmmlDistributions and pmmlLinks name the GLM families and links as in PMML
+// GeneralRegressionModel. The inverse links are power links.
+var pmmlDistributions = map[string]string{
+  "gaussian": "normal",
+  "binomial": "binomial",
+  "poisson": "poisson",
+  "gamma": "gamma",
+  "inverse_gaussian": "igauss",
+}
+
+var pmmlLinks = map[string]string{
+  "identity": "identity",
+  "log": "log",
+  "logit": "logit",
+  "probit": "probit",
+  "cloglog": "cloglog",
+  "inverse": "power",
+  "inverse_squared": "power",
+}
+
+var pmmlLinkParameters = map[string]float64{
+  "inverse": -1.0,
+  "inverse_squared": -2.0,
+}
+
+// PMML returns e as a PMML 4.2 document: a RegressionModel for linear,
+// logistic and multinomial models and a GeneralRegressionModel for the other
+// generalized linear models. Offsets are not part of the document.
+func PMML(e *Model) ([]byte, error) {
+  doc := &pmmlDocument{
+    Xmlns: "http://www.dmg.org/PMML-4_2",
+    Version: "4.2",
+    Header: pmmlHeader{
+      Description: fmt.Sprintf("cloudml %v model", e.Type),
+      Application: &pmmlApplication{Name: "cloudml"},
+    },
+  }
+  var fields []pmmlDataField
+  schema := pmmlMiningSchema{}
+  linear := e.Type == "quantile" || e.Type == "bayesian_linear" || ((e.Type == "linear" || e.Robust) && e.Link == "identity")
+  if e.Type == "multinomial" {
+    var classes []string
+    for _, c := range e.ClassCoefficients {
+      if len(classes) == 0 || classes[len(classes) - 1] != c.Class {
+        classes = append(classes, c.Class)
+      }
+    }
+    fields = append(fields, categoricalField(classes))
+  } else if e.Type == "logistic" && e.Link == "logit" {
+    fields = append(fields, categoricalField([]string{"0", "1"}))
+  } else if linear || pmmlDistributions[e.Family] != "" {
+    fields = append(fields, pmmlDataField{Name: Target, Optype: "continuous", DataType: "double"})
+  } else {
+    return nil, fmt.Errorf("PMML export is not supported for %v models", e.Type)
+  }
+  schema.MiningFields = append(schema.MiningFields, pmmlMiningField{Name: Target, UsageType: "target"})
+  for _, c := range e.Coefficients {
+    if c.Label == e.Intercept {
+      continue
+    }
+    fields = append(fields, pmmlDataField{Name: c.Label, Optype: "continuous", DataType: "double"})
+    schema.MiningFields = append(schema.MiningFields, pmmlMiningField{Name: c.Label})
+  }
+  doc.DataDictionary = pmmlDataDictionary{NumberOfFields: len(fields), DataFields: fields}
+
+  if e.Type == "multinomial" {
+    model := &pmmlRegressionModel{
+      ModelName: e.Type,
+      FunctionName: "classification",
+      NormalizationMethod: "softmax",
+      MiningSchema: schema,
+    }
+    for _, c := range e.ClassCoefficients {
+      k := len(model.RegressionTables) - 1
+      if k < 0 || model.RegressionTables[k].TargetCategory != c.Class {
+        model.RegressionTables = append(model.RegressionTables, pmmlRegressionTable{TargetCategory: c.Class})
+        k++
+      }
+      addPredictor(&model.RegressionTables[k], e.Intercept, c.Label, c.Value)
+    }
+    doc.RegressionModel = model
+  } else if e.Type == "logistic" && e.Link == "logit" {
+    // the logit normalization gives P(1), and the table for 0 is empty
+    table := pmmlRegressionTable{TargetCategory: "1"}
+    for _, c := range e.Coefficients {
+      addPredictor(&table, e.Intercept, c.Label, c.Value)
+    }
+    doc.RegressionModel = &pmmlRegressionModel{
+      ModelName: e.Type,
+      FunctionName: "classification",
+      NormalizationMethod: "logit",
+      MiningSchema: schema,
+      RegressionTables: []pmmlRegressionTable{table, pmmlRegressionTable{TargetCategory: "0"}},
+    }
+  } else if linear {
+    table := pmmlRegressionTable{}
+    for _, c := range e.Coefficients {
+      addPredictor(&table, e.Intercept, c.Label, c.Value)
+    }
+    doc.RegressionModel = &pmmlRegressionModel{
+      ModelName: e.Type,
+      FunctionName: "regression",
+      MiningSchema: schema,
+      RegressionTables: []pmmlRegressionTable{table},
+    }
+  } else {
+    model := &pmmlGeneralRegressionModel{
+      ModelName: e.Type,
+      ModelType: "generalizedLinear",
+      FunctionName: "regression",
+      Distribution: pmmlDistributions[e.Family],
+      LinkFunction: pmmlLinks[e.Link],
+      MiningSchema: schema,
+    }
+    if p, ok := pmmlLinkParameters[e.Link]; ok {
+      model.LinkParameter = &p
+    }
+    for j, c := range e.Coefficients {
+      name := fmt.Sprintf("p%v", j)
+      model.ParameterList.Parameters = append(model.ParameterList.Parameters, pmmlParameter{Name: name, Label: c.Label})
+      model.ParamMatrix.PCells = append(model.ParamMatrix.PCells, pmmlPCell{ParameterName: name, Beta: c.Value, DF: 1})
+      if c.Label == e.Intercept {
+        continue
+      }
+      model.CovariateList.Predictors = append(model.CovariateList.Predictors, pmmlPredictor{Name: c.Label})
+      model.PPMatrix.PPCells = append(model.PPMatrix.PPCells, pmmlPPCell{Value: "1", PredictorName: c.Label, ParameterName: name})
+    }
+    doc.GeneralRegressionModel = model
+  }
+  data, err := xml.MarshalIndent(doc, "", "  ")
+  if err != nil {
+    return nil, err
+  }
+  return append([]byte(xml.Header), data...), nil
+}
+
+func categoricalField(categories []string) pmmlDataField {
+  field := pmmlDataField{Name: Target, Optype: "categorical", DataType: "string"}
+  for _, category := range categories {
+    field.Values = append(field.Values, pmmlValue{Value: category})
+  }
+  return field
+}
+
+// addPredictor adds the coefficient to the table, as its intercept if the
+// label is that of the intercept.
+func addPredictor(table *pmmlRegressionTable, intercept string, label string, value float64) {
+  if label == intercept {
+    table.Intercept = value
+    return
+  }
+  table.NumericPredictors = append(table.NumericPredictors, pmmlNumericPredictor{Name: label, Coefficient: value})
+}
+
+// interceptLabel is the covariate that imported intercepts become.
+const interceptLabel = "intercept"
+
+// ParsePMML reads a PMML RegressionModel, or a GeneralRegressionModel of a
+// (generalized) linear model, with numeric predictors only. Intercepts become
+// the "intercept" covariate.
+func ParsePMML(data []byte) (*Model, error) {
+  doc := &pmmlDocument{}
+  err := xml.Unmarshal(data, doc)
+  if err != nil {
+    return nil, err
+  }
+  var e *Model
+  if doc.RegressionModel != nil {
+    e, err = parseRegressionModel(doc.RegressionModel)
+  } else if doc.GeneralRegressionModel != nil {
+    e, err = parseGeneralRegressionModel(doc.GeneralRegressionModel)
+  } else {
+    err = errors.New("PMML document has no regression model")
+  }
+  if err != nil {
+    return nil, err
+  }
+  e.Format = Format
+  e.FormatVersion = FormatVersion
+  return e, nil
+}
+
+// tableCoefficients returns the coefficients of a regression table, including
+// any intercept.
+func tableCoefficients(table pmmlRegressionTable) (map[string]float64, error) {
+  if len(table.CategoricalPredictors) > 0 || len(table.PredictorTerms) > 0 {
+    return nil, errors.New("Only numeric predictors can be imported")
+  }
+  coefficients := make(map[string]float64)
+  if table.Intercept != 0.0 {
+    coefficients[interceptLabel] = table.Intercept
+  }
+  for _, predictor := range table.NumericPredictors {
+    if predictor.Exponent > 1 {
+      return nil, fmt.Errorf("Predictor %q has an exponent", predictor.Name)
+    }
+    if _, ok := coefficients[predictor.Name]; ok {
+      return nil, fmt.Errorf("Repeated predictor %q", predictor.Name)
+    }
+    coefficients[predictor.Name] = predictor.Coefficient
+  }
+  return coefficients, nil
+}
+
+func sortedLabels(coefficients ...map[string]float64) []string {
+  seen := make(map[string]bool)
+  var labels []string
+  for _, cs := range coefficients {
+    for label := range cs {
+      if !seen[label] {
+        seen[label] = true
+        labels = append(labels, label)
+      }
+    }
+  }
+  sort.Strings(labels)
+  return labels
+}
+
+func parseRegressionModel(rm *pmmlRegressionModel) (*Model, error) {
+  tables := make([]map[string]float64, len(rm.RegressionTables))
+  for k, table := range rm.RegressionTables {
+    coefficients, err := tableCoefficients(table)
+    if err != nil {
+      return nil, err
+    }
+    tables[k] = coefficients
+  }
+  labels := sortedLabels(tables...)
+  e := &Model{}
+  for _, label := range labels {
+    if label == interceptLabel {
+      e.Intercept = interceptLabel
+    }
+  }
+  method := rm.NormalizationMethod
+  if rm.FunctionName == "regression" && len(tables) == 1 && (method == "" || method == "none") {
+    e.Type, e.Family, e.Link = "linear", "gaussian", "identity"
+    for _, label := range labels {
+      e.Coefficients = append(e.Coefficients, Coefficient{Label: label, Value: tables[0][label]})
+    }
+  } else if rm.FunctionName == "classification" && len(tables) == 2 && method == "logit" {
+    // the first table gives the probability of its category, which is 1
+    // unless it is 0
+    sign := 1.0
+    if rm.RegressionTables[0].TargetCategory == "0" {
+      sign = -1.0
+    }
+    e.Type, e.Family, e.Link = "logistic", "binomial", "logit"
+    for _, label := range labels {
+      e.Coefficients = append(e.Coefficients, Coefficient{Label: label, Value: sign * tables[0][label]})
+    }
+  } else if rm.FunctionName == "classification" && len(tables) >= 2 && method == "softmax" {
+    e.Type = "multinomial"
+    for _, label := range labels {
+      e.Coefficients = append(e.Coefficients, Coefficient{Label: label})
+    }
+    for k, table := range rm.RegressionTables {
+      for _, label := range labels {
+        e.ClassCoefficients = append(e.ClassCoefficients, ClassCoefficient{Class: table.TargetCategory, Label: label, Value: tables[k][label]})
+      }
+    }
+  } else {
+    return nil, fmt.Errorf("Unsupported %v RegressionModel with %v tables and normalization %q", rm.FunctionName, len(tables), method)
+  }
+  return e, nil
+}
+
+func parseGeneralRegressionModel(g *pmmlGeneralRegressionModel) (*Model, error) {
+  if g.FactorList != nil && len(g.FactorList.Predictors) > 0 {
+    return nil, errors.New("Only numeric predictors can be imported")
+  }
+  e := &Model{}
+  switch g.ModelType {
+  case "regression":
+    e.Family, e.Link = "gaussian", "identity"
+  case "generalizedLinear":
+    for family, distribution := range pmmlDistributions {
+      if distribution == g.Distribution || (g.Distribution == "" && family == "gaussian") {
+        e.Family = family
+      }
+    }
+    if e.Family == "" {
+      return nil, fmt.Errorf("Unsupported distribution %q", g.Distribution)
+    }
+    if g.LinkFunction == "power" {
+      if g.LinkParameter == nil {
+        return nil, errors.New("Power link without a parameter")
+      }
+      for link, p := range pmmlLinkParameters {
+        if p == *g.LinkParameter {
+          e.Link = link
+        }
+      }
+      if *g.LinkParameter == 1.0 {
+        e.Link = "identity"
+      }
+    } else {
+      for link, name := range pmmlLinks {
+        if name == g.LinkFunction && name != "power" {
+          e.Link = link
+        }
+      }
+    }
+    if e.Link == "" {
+      return nil, fmt.Errorf("Unsupported link %q", g.LinkFunction)
+    }
+  default:
+    return nil, fmt.Errorf("Unsupported GeneralRegressionModel type %q", g.ModelType)
+  }
+  for t, family := range map[string]string{"linear": "gaussian", "logistic": "binomial", "poisson": "poisson", "gamma": "gamma", "inverse_gaussian": "inverse_gaussian"} {
+    if family == e.Family {
+      e.Type = t
+    }
+  }
+
+  predictors := make(map[string]string)
+  for _, cell := range g.PPMatrix.PPCells {
+    value, err := strconv.ParseFloat(cell.Value, 64)
+    if err != nil || value != 1.0 {
+      return nil, fmt.Errorf("Predictor %q has an exponent", cell.PredictorName)
+    }
+    if _, ok := predictors[cell.ParameterName]; ok {
+      return nil, fmt.Errorf("Parameter %q is an interaction", cell.ParameterName)
+    }
+    predictors[cell.ParameterName] = cell.PredictorName
+  }
+  betas := make(map[string]float64)
+  for _, cell := range g.ParamMatrix.PCells {
+    betas[cell.ParameterName] = cell.Beta
+  }
+  coefficients := make(map[string]float64)
+  for _, parameter := range g.ParameterList.Parameters {
+    label, ok := predictors[parameter.Name]
+    if !ok {
+      if e.Intercept != "" {
+        return nil, errors.New("Only one parameter can be the intercept")
+      }
+      label = interceptLabel
+      e.Intercept = interceptLabel
+    }
+    if _, ok := coefficients[label]; ok {
+      return nil, fmt.Errorf("Repeated predictor %q", label)
+    }
+    coefficients[label] = betas[parameter.Name]
+  }
+  for _, label := range sortedLabels(coefficients) {
+    e.Coefficients = append(e.Coefficients, Coefficient{Label: label, Value: coefficients[label]})
+  }
+  return e, nil
+}
@@ -0,0 +1,117 @@
+package glm
+
+import (
+  "errors"
+  "fmt"
+  "math"
+)
+
+const epsilon = 1e-10
+
+// Family is the distribution of the response given its mean μ.
+type Family interface {
+  Name() string
+  // DefaultLink is the link used when none is configured.
+  DefaultLink() Link
+  Variance(mu float64) float64
+  // Valid reports whether y is a possible response.
+  Valid(y float64) bool
+  // Start is the initial guess for μ given the response y.
+  Start(y float64) float64
+  // Clamp keeps μ within the family's support.
+  Clamp(mu float64) float64
+  // Deviance is the unit deviance of y given μ.
+  Deviance(y float64, mu float64) float64
+}
+
+// ylogy returns y log(y / mu), which is 0 when y is 0.
+func ylogy(y float64, mu float64) float64 {
+  if y == 0.0 {
+    return 0.0
+  }
+  return y * math.Log(y / mu)
+}
+
+type Gaussian struct{}
+
+func (Gaussian) Name() string { return "gaussian" }
+func (Gaussian) DefaultLink() Link { return IdentityLink{} }
+func (Gaussian) Variance(mu float64) float64 { return 1.0 }
+func (Gaussian) Valid(y float64) bool { return true }
+func (Gaussian) Start(y float64) float64 { return y }
+func (Gaussian) Clamp(mu float64) float64 { return mu }
+func (Gaussian) Deviance(y float64, mu float64) float64 { return (y - mu) * (y - mu) }
+
+type Binomial struct{}
+
+func (Binomial) Name() string { return "binomial" }
+func (Binomial) DefaultLink() Link { return LogitLink{} }
+func (Binomial) Variance(mu float64) float64 { return mu * (1.0 - mu) }
+func (Binomial) Valid(y float64) bool { return y >= 0.0 && y <= 1.0 }
+func (Binomial) Start(y float64) float64 { return (y + 0.5) / 2.0 }
+func (Binomial) Clamp(mu float64) float64 { return math.Min(math.Max(mu, epsilon), 1.0 - epsilon) }
+func (Binomial) Deviance(y float64, mu float64) float64 {
+  return 2.0 * (ylogy(y, mu) + ylogy(1.0 - y, 1.0 - mu))
+}
+
+type Poisson struct{}
+
+func (Poisson) Name() string { return "poisson" }
+func (Poisson) DefaultLink() Link { return LogLink{} }
+func (Poisson) Variance(mu float64) float64 { return mu }
+func (Poisson) Valid(y float64) bool { return y >= 0.0 }
+func (Poisson) Start(y float64) float64 { return y + 0.1 }
+func (Poisson) Clamp(mu float64) float64 { return math.Max(mu, epsilon) }
+func (Poisson) Deviance(y float64, mu float64) float64 { return 2.0 * (ylogy(y, mu) - (y - mu)) }
+
+type Gamma struct{}
+
+func (Gamma) Name() string { return "gamma" }
+func (Gamma) DefaultLink() Link { return InverseLink{} }
+func (Gamma) Variance(mu float64) float64 { return mu * mu }
+func (Gamma) Valid(y float64) bool { return y > 0.0 }
+func (Gamma) Start(y float64) float64 { return y }
+func (Gamma) Clamp(mu float64) float64 { return math.Max(mu, epsilon) }
+func (Gamma) Deviance(y float64, mu float64) float64 { return 2.0 * ((y - mu) / mu - math.Log(y / mu)) }
+
+type InverseGaussian struct{}
+
+func (InverseGaussian) Name() string { return "inverse_gaussian" }
+func (InverseGaussian) DefaultLink() Link { return InverseSquaredLink{} }
+func (InverseGaussian) Variance(mu float64) float64 { return mu * mu * mu }
+func (InverseGaussian) Valid(y float64) bool { return y > 0.0 }
+func (InverseGaussian) Start(y float64) float64 { return y }
+func (InverseGaussian) Clamp(mu float64) float64 { return math.Max(mu, epsilon) }
+func (InverseGaussian) Deviance(y float64, mu float64) float64 { return (y - mu) * (y - mu) / (y * mu * mu) }
+
+var families = map[string]Family{
+  "gaussian": Gaussian{},
+  "binomial": Binomial{},
+  "poisson": Poisson{},
+  "gamma": Gamma{},
+  "inverse_gaussian": InverseGaussian{},
+}
+
+// Lookup returns the named family and link. An empty link name selects the
+// family's default link.
+func Lookup(familyName string, linkName string) (Family, Link, error) {
+  family, ok := families[familyName]
+  if !ok {
+    return nil, nil, fmt.Errorf("Unknown family %q", familyName)
+  }
+  if linkName == "" {
+    return family, family.DefaultLink(), nil
+  }
+  link, ok := links[linkName]
+  if !ok {
+    return nil, nil, fmt.Errorf("Unknown link %q", linkName)
+  }
+  return family, link, nil
+}
+
+var ErrInvalidValue = errors.New("Value outside the support of the family")
+
+// ErrTooFewData is returned by Learn, and by the other learners of cloudml,
+// when there are no more data than parameters and no ridge penalty to make
+// the fit unique.
+var ErrTooFewData = errors.New("Too few data for the number of covariates without a positive lambda")
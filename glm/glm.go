@@ -0,0 +1,251 @@
+package glm
+
+import (
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "fmt"
+  "math"
+  "math/rand"
+  "github.com/skelterjohn/go.matrix"
+)
+
+// GLM is a generalized linear model with the given family and link, fitted
+// by iteratively reweighted least squares.
+type GLM struct {
+  Family Family
+  Link Link
+}
+
+func New(familyName string, linkName string) (*GLM, error) {
+  family, link, err := Lookup(familyName, linkName)
+  if err != nil {
+    return nil, err
+  }
+  return &GLM{Family: family, Link: link}, nil
+}
+
+func dot(vec1, vec2 []float64) (val float64) {
+  for i, v := range vec1 {
+    val += v * vec2[i]
+  }
+  return
+}
+
+func isZero(vec []float64) bool {
+  for _, v := range vec {
+    if v != 0.0 {
+      return false
+    }
+  }
+  return true
+}
+
+// Predict returns the mean response μ = g⁻¹(x·β + offset).
+func (g *GLM) Predict(beta []float64, covariates []float64, offset float64) float64 {
+  return g.Link.Inverse(dot(beta, covariates) + offset)
+}
+
+// Learn fits the model by weighted IRLS with ridge penalty lambda. If
+// betaStart is all zeros the iterations start from μ = Family.Start(y). It
+// also returns the number of iterations run, at most iterations, and stops
+// with ctx.Err() if ctx is done before an iteration. Without a penalty it
+// needs more data than covariates.
+func (g *GLM) Learn(ctx context.Context, data [][]float64, values []float64, weights []float64, offsets []float64, lambda float64, betaStart []float64, iterations int) ([]float64, int, error) {
+  n := len(data)
+  p := len(betaStart)
+  for _, y := range values {
+    if !g.Family.Valid(y) {
+      return nil, 0, ErrInvalidValue
+    }
+  }
+  beta := make([]float64, p)
+  copy(beta, betaStart)
+  if p >= n && lambda == 0 {
+    return nil, 0, ErrTooFewData
+  }
+  eta := make([]float64, n)
+  mu := make([]float64, n)
+  if isZero(beta) {
+    for i, y := range values {
+      mu[i] = g.Family.Clamp(g.Family.Start(y))
+      eta[i] = g.Link.Link(mu[i])
+    }
+  } else {
+    for i, x := range data {
+      eta[i] = dot(beta, x) + offsets[i]
+      mu[i] = g.Family.Clamp(g.Link.Inverse(eta[i]))
+    }
+  }
+  deviance := math.Inf(1)
+  iter := 0
+  for {
+    if ctx.Err() != nil {
+      return nil, iter, ctx.Err()
+    }
+    iter++
+    XtWX := matrix.Eye(p)
+    XtWX.Scale(lambda)
+    XtWz := matrix.Zeros(p, 1)
+    for i, x := range data {
+      d := g.Link.MuEta(eta[i])
+      w := weights[i] * d * d / math.Max(g.Family.Variance(mu[i]), epsilon)
+      z := eta[i] - offsets[i] + (values[i] - mu[i]) / d
+      for j := 0; j < p; j++ {
+        XtWz.Set(j, 0, XtWz.Get(j, 0) + w * x[j] * z)
+        for k := 0; k < p; k++ {
+          XtWX.Set(j, k, XtWX.Get(j, k) + w * x[j] * x[k])
+        }
+      }
+    }
+    XtWXInv, err := XtWX.Inverse()
+    if err != nil {
+      return nil, iter, err
+    }
+    newBeta, err := XtWXInv.TimesDense(XtWz)
+    if err != nil {
+      return nil, iter, err
+    }
+    // halve the step while the penalized deviance increases or is not finite
+    step := make([]float64, p)
+    for j := 0; j < p; j++ {
+      step[j] = newBeta.Get(j, 0) - beta[j]
+    }
+    newDeviance := math.Inf(1)
+    for halvings := 0; halvings < 30; halvings++ {
+      candidate := make([]float64, p)
+      for j := range candidate {
+        candidate[j] = beta[j] + step[j]
+      }
+      newDeviance = g.deviance(candidate, data, values, weights, offsets, lambda)
+      if iter == 1 || newDeviance <= deviance * (1.0 + 1e-10) {
+        break
+      }
+      for j := range step {
+        step[j] /= 2.0
+      }
+    }
+    deviance = newDeviance
+    diff := 0.0
+    for j := 0; j < p; j++ {
+      diff += step[j] * step[j]
+      beta[j] += step[j]
+    }
+    for i, x := range data {
+      eta[i] = dot(beta, x) + offsets[i]
+      mu[i] = g.Family.Clamp(g.Link.Inverse(eta[i]))
+    }
+    if math.Sqrt(diff) < 1e-6 {
+      logging.Debugf(ctx, "Converged after %v iterations", iter)
+      break
+    }
+    if iter >= iterations {
+      logging.Warnf(ctx, "Did not converge after %v iterations", iter)
+      break
+    }
+  }
+  return beta, iter, nil
+}
+
+// deviance is the weighted deviance plus the ridge penalty, or +Inf where it
+// is not defined.
+func (g *GLM) deviance(beta []float64, data [][]float64, values []float64, weights []float64, offsets []float64, lambda float64) float64 {
+  dev := lambda * dot(beta, beta)
+  for i, x := range data {
+    dev += weights[i] * g.Family.Deviance(values[i], g.Family.Clamp(g.Link.Inverse(dot(beta, x) + offsets[i])))
+  }
+  if math.IsNaN(dev) {
+    return math.Inf(1)
+  }
+  return dev
+}
+
+// RMSE is the weighted root mean squared error of the predicted means.
+func (g *GLM) RMSE(beta []float64, data [][]float64, values []float64, weights []float64, offsets []float64) float64 {
+  rmse := 0.0
+  sumWeights := 0.0
+  for i, datum := range data {
+    rmse += weights[i] * math.Pow(values[i] - g.Predict(beta, datum, offsets[i]), 2.0)
+    sumWeights += weights[i]
+  }
+  rmse /= sumWeights
+  return math.Sqrt(rmse)
+}
+
+func (g *GLM) CV(ctx context.Context, data [][]float64, values []float64, weights []float64, offsets []float64, lambda float64) (float64, error) {
+  fold := 5
+  n := len(data)
+  p := len(data[0])
+  // NOTE: stop if p > fold*n
+  perm := rand.Perm(n)
+  for i, j := range perm {
+    data[i], data[j] = data[j], data[i]
+    values[i], values[j] = values[j], values[i]
+    weights[i], weights[j] = weights[j], weights[i]
+    offsets[i], offsets[j] = offsets[j], offsets[i]
+  }
+  numPer := n / fold
+  mod := n % fold
+  cv := 0.0
+  numRun := 0
+  var foldErr error
+  for i := 0; i < fold; i++ {
+    minBreakVal := 0
+    for j := 0; j < i; j++ {
+      minBreakVal += numPer
+      if j < mod {
+        minBreakVal++
+      }
+    }
+    maxBreakVal := 0
+    for j := 0; j < i + 1; j++ {
+      maxBreakVal += numPer
+      if j < mod {
+        maxBreakVal++
+      }
+    }
+    num := maxBreakVal - minBreakVal
+    trainValues := make([]float64, n - num)
+    trainWeights := make([]float64, n - num)
+    trainOffsets := make([]float64, n - num)
+    trainData := make([][]float64, n - num)
+    testValues := make([]float64, num)
+    testWeights := make([]float64, num)
+    testOffsets := make([]float64, num)
+    testData := make([][]float64, num)
+    for j := 0; j < n; j++ {
+      if j < minBreakVal {
+        trainData[j] = data[j]
+        trainValues[j] = values[j]
+        trainWeights[j] = weights[j]
+        trainOffsets[j] = offsets[j]
+      } else if j < maxBreakVal {
+        testData[j - minBreakVal] = data[j]
+        testValues[j - minBreakVal] = values[j]
+        testWeights[j - minBreakVal] = weights[j]
+        testOffsets[j - minBreakVal] = offsets[j]
+      } else {
+        trainData[j - num] = data[j]
+        trainValues[j - num] = values[j]
+        trainWeights[j - num] = weights[j]
+        trainOffsets[j - num] = offsets[j]
+      }
+    }
+    betaStart := make([]float64, p)
+    betas, _, err := g.Learn(ctx, trainData, trainValues, trainWeights, trainOffsets, lambda, betaStart, 100)
+    if err != nil {
+      if ctx.Err() != nil {
+        return 0.0, ctx.Err()
+      }
+      logging.Warnf(ctx, "CV error: %v", err)
+      foldErr = err
+      continue
+    }
+    numRun++
+    cv += g.RMSE(betas, testData, testValues, testWeights, testOffsets)
+  }
+  if numRun == 0 {
+    return 0.0, fmt.Errorf("Cross-validation failed on every fold: %w", foldErr)
+  }
+  cv /= float64(numRun)
+  return cv, nil
+}
@@ -0,0 +1,82 @@
+package glm
+
+import (
+  "math"
+)
+
+// Link maps the mean μ of the response to the linear predictor η = g(μ).
+type Link interface {
+  Name() string
+  // Link returns η = g(μ).
+  Link(mu float64) float64
+  // Inverse returns μ = g⁻¹(η).
+  Inverse(eta float64) float64
+  // MuEta returns dμ/dη at η.
+  MuEta(eta float64) float64
+}
+
+type IdentityLink struct{}
+
+func (IdentityLink) Name() string { return "identity" }
+func (IdentityLink) Link(mu float64) float64 { return mu }
+func (IdentityLink) Inverse(eta float64) float64 { return eta }
+func (IdentityLink) MuEta(eta float64) float64 { return 1.0 }
+
+type LogLink struct{}
+
+func (LogLink) Name() string { return "log" }
+func (LogLink) Link(mu float64) float64 { return math.Log(mu) }
+func (LogLink) Inverse(eta float64) float64 { return math.Max(math.Exp(eta), epsilon) }
+func (LogLink) MuEta(eta float64) float64 { return math.Max(math.Exp(eta), epsilon) }
+
+type InverseLink struct{}
+
+func (InverseLink) Name() string { return "inverse" }
+func (InverseLink) Link(mu float64) float64 { return 1.0 / mu }
+func (InverseLink) Inverse(eta float64) float64 { return 1.0 / eta }
+func (InverseLink) MuEta(eta float64) float64 { return -1.0 / (eta * eta) }
+
+type InverseSquaredLink struct{}
+
+func (InverseSquaredLink) Name() string { return "inverse_squared" }
+func (InverseSquaredLink) Link(mu float64) float64 { return 1.0 / (mu * mu) }
+func (InverseSquaredLink) Inverse(eta float64) float64 { return 1.0 / math.Sqrt(eta) }
+func (InverseSquaredLink) MuEta(eta float64) float64 { return -1.0 / (2.0 * math.Pow(eta, 1.5)) }
+
+type LogitLink struct{}
+
+func (LogitLink) Name() string { return "logit" }
+func (LogitLink) Link(mu float64) float64 { return math.Log(mu / (1.0 - mu)) }
+func (LogitLink) Inverse(eta float64) float64 { return 1.0 / (1.0 + math.Exp(-eta)) }
+func (l LogitLink) MuEta(eta float64) float64 {
+  mu := l.Inverse(eta)
+  return math.Max(mu * (1.0 - mu), epsilon)
+}
+
+type ProbitLink struct{}
+
+func (ProbitLink) Name() string { return "probit" }
+func (ProbitLink) Link(mu float64) float64 { return math.Sqrt2 * math.Erfinv(2.0 * mu - 1.0) }
+func (ProbitLink) Inverse(eta float64) float64 { return 0.5 * math.Erfc(-eta / math.Sqrt2) }
+func (ProbitLink) MuEta(eta float64) float64 {
+  return math.Max(math.Exp(-0.5 * eta * eta) / math.Sqrt(2.0 * math.Pi), epsilon)
+}
+
+type CLogLogLink struct{}
+
+func (CLogLogLink) Name() string { return "cloglog" }
+func (CLogLogLink) Link(mu float64) float64 { return math.Log(-math.Log(1.0 - mu)) }
+func (CLogLogLink) Inverse(eta float64) float64 { return -math.Expm1(-math.Exp(eta)) }
+func (CLogLogLink) MuEta(eta float64) float64 {
+  return math.Max(math.Exp(eta - math.Exp(eta)), epsilon)
+}
+
+var links = map[string]Link{
+  "identity": IdentityLink{},
+  "log": LogLink{},
+  "inverse": InverseLink{},
+  "inverse_squared": InverseSquaredLink{},
+  "logit": LogitLink{},
+  "probit": ProbitLink{},
+  "cloglog": CLogLogLink{},
+}
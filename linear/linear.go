@@ -1,9 +1,9 @@
 package linear
 
 import (
+  "github.com/aotimme/cloudml/glm"
+  "context"
   "math"
-  "math/rand"
-  "log"
   "github.com/skelterjohn/go.matrix"
 )
 
@@ -14,19 +14,30 @@ func dot(vec1, vec2 []float64) (val float64) {
   return
 }
 
-func Learn(data [][]float64, values []float64, lambda float64) ([]float64, error) {
-  n := len(data)
-  p := len(data[0])
-  X := matrix.MakeDenseMatrixStacked(data)
-  Y := matrix.MakeDenseMatrix(values, n, 1)
-  Xt := X.Transpose()
-  XtX, err := Xt.TimesDense(X)
-  if err != nil {
-    return nil, err
-  }
+var model = &glm.GLM{Family: glm.Gaussian{}, Link: glm.IdentityLink{}}
+
+// Learn fits weighted least squares (with ridge penalty lambda) of
+// values - offsets on data.
+func Learn(ctx context.Context, data [][]float64, values []float64, weights []float64, offsets []float64, lambda float64) ([]float64, error) {
+  betaStart := make([]float64, len(data[0]))
+  beta, _, err := model.Learn(ctx, data, values, weights, offsets, lambda, betaStart, 2)
+  return beta, err
+}
+
+// LearnFromStatistics fits the model from the sufficient statistics XᵀWX and
+// XᵀW(Y - offset) alone, so it costs O(p³) regardless of the number of data.
+func LearnFromStatistics(xtx [][]float64, xty []float64, lambda float64) ([]float64, error) {
+  p := len(xty)
+  XtX := matrix.MakeDenseMatrixStacked(xtx)
+  XtY := matrix.MakeDenseMatrix(xty, p, 1)
+  return solve(XtX, XtY, lambda)
+}
+
+func solve(XtX, XtY *matrix.DenseMatrix, lambda float64) ([]float64, error) {
+  p := XtX.Rows()
   lambdaMatrix := matrix.Eye(p)
   lambdaMatrix.Scale(lambda)
-  err = XtX.AddDense(lambdaMatrix)
+  err := XtX.AddDense(lambdaMatrix)
   if err != nil {
     return nil, err
   }
@@ -35,10 +46,6 @@ func Learn(data [][]float64, values []float64, lambda float64) ([]float64, error
   if err != nil {
     return nil, err
   }
-  XtY, err := Xt.TimesDense(Y)
-  if err != nil {
-    return nil, err
-  }
   coefficients, err := XtXInv.TimesDense(XtY)
   if err != nil {
     return nil, err
@@ -46,72 +53,31 @@ func Learn(data [][]float64, values []float64, lambda float64) ([]float64, error
   return coefficients.Array(), nil
 }
 
-func Predict(beta []float64, covariates []float64) float64 {
-  return dot(beta, covariates)
+func Predict(beta []float64, covariates []float64, offset float64) float64 {
+  return model.Predict(beta, covariates, offset)
 }
 
-func RMSE(beta []float64, data [][]float64, values []float64) float64 {
-  rmse := 0.0
-  for i, datum := range data {
-    rmse += math.Pow(values[i] - Predict(beta, datum), 2.0)
-  }
-  rmse /= float64(len(data))
-  return math.Sqrt(rmse)
+// RMSE is the weighted root mean squared error.
+func RMSE(beta []float64, data [][]float64, values []float64, weights []float64, offsets []float64) float64 {
+  return model.RMSE(beta, data, values, weights, offsets)
 }
 
-func CV(data [][]float64, values []float64, lambda float64) (float64, error) {
-  fold := 5
-  n := len(data)
-  // NOTE: stop if p > fold*n
-  perm := rand.Perm(n)
-  for i, j := range perm {
-    data[i], data[j] = data[j], data[i]
-    values[i], values[j] = values[j], values[i]
+// RMSEFromStatistics computes the weighted training RMSE from the sufficient
+// statistics, using RSS = YᵀWY - 2βᵀXᵀWY + βᵀXᵀWXβ.
+func RMSEFromStatistics(beta []float64, xtx [][]float64, xty []float64, yty float64, sumWeights float64) float64 {
+  if sumWeights <= 0.0 {
+    return 0.0
   }
-  numPer := n / fold
-  mod := n % fold
-  cv := 0.0
-  numRun := 0
-  for i := 0; i < fold; i++ {
-    minBreakVal := 0
-    for j := 0; j < i; j++ {
-      minBreakVal += numPer
-      if j < mod {
-        minBreakVal++
-      }
-    }
-    maxBreakVal := 0
-    for j := 0; j < i + 1; j++ {
-      maxBreakVal += numPer
-      if j < mod {
-        maxBreakVal++
-      }
-    }
-    num := maxBreakVal - minBreakVal
-    trainValues := make([]float64, n - num)
-    trainData := make([][]float64, n - num)
-    testValues := make([]float64, num)
-    testData := make([][]float64, num)
-    for j := 0; j < n; j++ {
-      if j < minBreakVal {
-        trainData[j] = data[j]
-        trainValues[j] = values[j]
-      } else if j < maxBreakVal {
-        testData[j - minBreakVal] = data[j]
-        testValues[j - minBreakVal] = values[j]
-      } else {
-        trainData[j - num] = data[j]
-        trainValues[j - num] = values[j]
-      }
-    }
-    betas, err := Learn(trainData, trainValues, lambda)
-    if err != nil {
-      log.Printf("CV error: %v\n", err)
-    } else {
-      numRun++
-    }
-    cv += RMSE(betas, testData, testValues)
+  rss := yty - 2.0 * dot(beta, xty)
+  for j, row := range xtx {
+    rss += beta[j] * dot(row, beta)
   }
-  cv /= float64(numRun)
-  return cv, nil
+  if rss < 0.0 {
+    rss = 0.0
+  }
+  return math.Sqrt(rss / sumWeights)
+}
+
+func CV(ctx context.Context, data [][]float64, values []float64, weights []float64, offsets []float64, lambda float64) (float64, error) {
+  return model.CV(ctx, data, values, weights, offsets, lambda)
 }
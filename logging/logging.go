@@ -0,0 +1,158 @@
+// Package logging writes the logs of cloudml as JSON lines. Each line is an
+// object with the time, level and message of the entry, the id of the request
+// it belongs to, if any, and its other fields:
+//
+//   {"time":"2024-05-01T12:00:00.000Z","level":"info","msg":"request","request_id":"1f2e…","method":"POST",…}
+//
+// Entries below the level set with SetLevel are dropped.
+package logging
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "sort"
+  "sync"
+  "time"
+)
+
+type Level int
+
+const (
+  Debug Level = iota
+  Info
+  Warn
+  Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+  if l < Debug || l > Error {
+    return fmt.Sprintf("level(%d)", int(l))
+  }
+  return levelNames[l]
+}
+
+// ParseLevel returns the level named s: "debug", "info", "warn" or "error".
+func ParseLevel(s string) (Level, error) {
+  for i, name := range levelNames {
+    if s == name {
+      return Level(i), nil
+    }
+  }
+  return Info, fmt.Errorf("Unknown log level %q", s)
+}
+
+// Fields are the values of an entry besides its message, such as the status
+// of a request. Errors are written as their messages.
+type Fields map[string]interface{}
+
+var logger = struct {
+  sync.Mutex
+  out io.Writer
+  level Level
+}{out: os.Stderr, level: Info}
+
+func SetOutput(w io.Writer) {
+  logger.Lock()
+  defer logger.Unlock()
+  logger.out = w
+}
+
+func SetLevel(level Level) {
+  logger.Lock()
+  defer logger.Unlock()
+  logger.level = level
+}
+
+type contextKey int
+
+const requestIdContextKey contextKey = 0
+
+// WithRequestId returns ctx carrying the id of its request, which is logged
+// with every entry logged under ctx.
+func WithRequestId(ctx context.Context, id string) context.Context {
+  return context.WithValue(ctx, requestIdContextKey, id)
+}
+
+func RequestId(ctx context.Context) string {
+  id, _ := ctx.Value(requestIdContextKey).(string)
+  return id
+}
+
+// Log writes an entry with the message and fields, if level is enabled.
+func Log(ctx context.Context, level Level, msg string, fields Fields) {
+  logger.Lock()
+  enabled := level >= logger.level
+  logger.Unlock()
+  if !enabled {
+    return
+  }
+  var buf bytes.Buffer
+  buf.WriteString("{")
+  writeField(&buf, "time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+  buf.WriteString(",")
+  writeField(&buf, "level", level.String())
+  buf.WriteString(",")
+  writeField(&buf, "msg", msg)
+  if ctx != nil {
+    id := RequestId(ctx)
+    if id != "" {
+      buf.WriteString(",")
+      writeField(&buf, "request_id", id)
+    }
+  }
+  names := make([]string, 0, len(fields))
+  for name := range fields {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    buf.WriteString(",")
+    writeField(&buf, name, fields[name])
+  }
+  buf.WriteString("}\n")
+  logger.Lock()
+  defer logger.Unlock()
+  logger.out.Write(buf.Bytes())
+}
+
+func writeField(buf *bytes.Buffer, name string, value interface{}) {
+  if err, ok := value.(error); ok {
+    value = err.Error()
+  }
+  key, _ := json.Marshal(name)
+  data, err := json.Marshal(value)
+  if err != nil {
+    data, _ = json.Marshal(fmt.Sprint(value))
+  }
+  buf.Write(key)
+  buf.WriteString(":")
+  buf.Write(data)
+}
+
+func Debugf(ctx context.Context, format string, args ...interface{}) {
+  Log(ctx, Debug, fmt.Sprintf(format, args...), nil)
+}
+
+func Infof(ctx context.Context, format string, args ...interface{}) {
+  Log(ctx, Info, fmt.Sprintf(format, args...), nil)
+}
+
+func Warnf(ctx context.Context, format string, args ...interface{}) {
+  Log(ctx, Warn, fmt.Sprintf(format, args...), nil)
+}
+
+func Errorf(ctx context.Context, format string, args ...interface{}) {
+  Log(ctx, Error, fmt.Sprintf(format, args...), nil)
+}
+
+// Fatalf logs an error and exits.
+func Fatalf(ctx context.Context, format string, args ...interface{}) {
+  Log(ctx, Error, fmt.Sprintf(format, args...), nil)
+  os.Exit(1)
+}
@@ -0,0 +1,78 @@
+// Package metrics holds the Prometheus metrics of cloudml-server, which it
+// serves on /metrics. They are only collected once registered with Register,
+// so that programs embedding cloudml get no global side effects.
+package metrics
+
+import (
+  "github.com/prometheus/client_golang/prometheus"
+  "time"
+)
+
+var (
+  // Requests and RequestDuration are labelled by the route template, such
+  // as "/api/models/{id}/predict", so that model ids do not make a series
+  // each.
+  Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "cloudml_http_requests_total",
+    Help: "HTTP requests by route, method and status code.",
+  }, []string{"route", "method", "code"})
+  RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Name: "cloudml_http_request_duration_seconds",
+    Help: "Latency of HTTP requests by route and method.",
+    Buckets: prometheus.DefBuckets,
+  }, []string{"route", "method"})
+
+  // TrainingDuration is labelled by model type and job, "learn" or "cv".
+  TrainingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Name: "cloudml_training_duration_seconds",
+    Help: "Duration of training and cross-validation jobs by model type.",
+    Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+  }, []string{"type", "job"})
+  TrainingErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "cloudml_training_errors_total",
+    Help: "Failed training and cross-validation jobs by model type.",
+  }, []string{"type", "job"})
+  // TrainingIterations only counts models fitted iteratively.
+  TrainingIterations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Name: "cloudml_training_iterations",
+    Help: "Iterations of the fits of training jobs by model type.",
+    Buckets: []float64{1, 2, 3, 5, 10, 20, 50, 100, 200},
+  }, []string{"type"})
+
+  Predictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "cloudml_predictions_total",
+    Help: "Predictions by model type.",
+  }, []string{"type"})
+  DataRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "cloudml_data_rows_total",
+    Help: "Data added to models by model type.",
+  }, []string{"type"})
+
+  // QueryDuration is labelled by the statement, such as "select" or
+  // "delete".
+  QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Name: "cloudml_db_query_duration_seconds",
+    Help: "Latency of database queries by statement.",
+    Buckets: prometheus.ExponentialBuckets(0.0005, 4, 9),
+  }, []string{"statement"})
+)
+
+// Register registers the metrics with r, such as prometheus.DefaultRegisterer.
+func Register(r prometheus.Registerer) error {
+  for _, c := range []prometheus.Collector{Requests, RequestDuration, TrainingDuration, TrainingErrors, TrainingIterations, Predictions, DataRows, QueryDuration} {
+    err := r.Register(c)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// ObserveTraining records a job of a model of type modelType that started
+// at start and failed if err is not nil.
+func ObserveTraining(modelType string, job string, start time.Time, err error) {
+  TrainingDuration.WithLabelValues(modelType, job).Observe(time.Since(start).Seconds())
+  if err != nil {
+    TrainingErrors.WithLabelValues(modelType, job).Inc()
+  }
+}
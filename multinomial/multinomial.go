@@ -0,0 +1,218 @@
+package multinomial
+
+import (
+  "github.com/aotimme/cloudml/glm"
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "fmt"
+  "math"
+  "math/rand"
+  "github.com/skelterjohn/go.matrix"
+)
+
+func dot(vec1, vec2 []float64) (val float64) {
+  for i, v := range vec1 {
+    val += v * vec2[i]
+  }
+  return
+}
+
+// Predict returns the probability of each class. beta holds one coefficient
+// vector per class; the first (reference) class is kept at zero.
+func Predict(beta [][]float64, covariates []float64) []float64 {
+  probs := make([]float64, len(beta))
+  max := math.Inf(-1)
+  for k, b := range beta {
+    probs[k] = dot(b, covariates)
+    if probs[k] > max {
+      max = probs[k]
+    }
+  }
+  sum := 0.0
+  for k := range probs {
+    probs[k] = math.Exp(probs[k] - max)
+    sum += probs[k]
+  }
+  for k := range probs {
+    probs[k] /= sum
+  }
+  return probs
+}
+
+// Learn fits the softmax regression by weighted Newton-Raphson. labels are
+// indices into betaStart, which has one row per class. It also returns the
+// number of iterations run. Once ctx is done it stops with ctx.Err().
+// Without a penalty it needs more data than coefficients.
+func Learn(ctx context.Context, data [][]float64, labels []int, weights []float64, lambda float64, betaStart [][]float64, iterations int) ([][]float64, int, error) {
+  n := len(data)
+  K := len(betaStart)
+  p := len(betaStart[0])
+  q := (K - 1) * p
+  iter := 0
+  beta := make([][]float64, K)
+  for k := range beta {
+    beta[k] = make([]float64, p)
+    copy(beta[k], betaStart[k])
+  }
+  if q >= n && lambda == 0 {
+    return nil, 0, glm.ErrTooFewData
+  }
+  for {
+    if ctx.Err() != nil {
+      return nil, iter, ctx.Err()
+    }
+    iter++
+    hessian := matrix.Eye(q)
+    hessian.Scale(lambda)
+    gradient := matrix.Zeros(q, 1)
+    for a := 1; a < K; a++ {
+      for j := 0; j < p; j++ {
+        gradient.Set((a - 1) * p + j, 0, -lambda * beta[a][j])
+      }
+    }
+    for i, x := range data {
+      mu := Predict(beta, x)
+      for a := 1; a < K; a++ {
+        y := 0.0
+        if labels[i] == a {
+          y = 1.0
+        }
+        r := weights[i] * (y - mu[a])
+        for j := 0; j < p; j++ {
+          row := (a - 1) * p + j
+          gradient.Set(row, 0, gradient.Get(row, 0) + r * x[j])
+        }
+        for b := 1; b < K; b++ {
+          c := -mu[b]
+          if a == b {
+            c += 1.0
+          }
+          c *= weights[i] * mu[a]
+          for j := 0; j < p; j++ {
+            for k := 0; k < p; k++ {
+              row, col := (a - 1) * p + j, (b - 1) * p + k
+              hessian.Set(row, col, hessian.Get(row, col) + c * x[j] * x[k])
+            }
+          }
+        }
+      }
+    }
+    hessInv, err := hessian.Inverse()
+    if err != nil {
+      return nil, iter, err
+    }
+    diff, err := hessInv.TimesDense(gradient)
+    if err != nil {
+      return nil, iter, err
+    }
+    for a := 1; a < K; a++ {
+      for j := 0; j < p; j++ {
+        beta[a][j] += diff.Get((a - 1) * p + j, 0)
+      }
+    }
+    if diff.TwoNorm() < 1e-6 {
+      logging.Debugf(ctx, "Converged after %v iterations", iter)
+      break
+    }
+    if iter >= iterations {
+      logging.Warnf(ctx, "Did not converge after %v iterations", iter)
+      break
+    }
+  }
+  return beta, iter, nil
+}
+
+// RMSE is the weighted root mean squared error between the predicted class
+// probabilities and the one-hot encoded labels.
+func RMSE(beta [][]float64, data [][]float64, labels []int, weights []float64) float64 {
+  rmse := 0.0
+  sumWeights := 0.0
+  for i, datum := range data {
+    for k, prob := range Predict(beta, datum) {
+      y := 0.0
+      if labels[i] == k {
+        y = 1.0
+      }
+      rmse += weights[i] * math.Pow(y - prob, 2.0)
+    }
+    sumWeights += weights[i]
+  }
+  rmse /= sumWeights
+  return math.Sqrt(rmse)
+}
+
+func CV(ctx context.Context, data [][]float64, labels []int, weights []float64, numClasses int, lambda float64) (float64, error) {
+  fold := 5
+  n := len(data)
+  p := len(data[0])
+  // NOTE: stop if p > fold*n
+  perm := rand.Perm(n)
+  for i, j := range perm {
+    data[i], data[j] = data[j], data[i]
+    labels[i], labels[j] = labels[j], labels[i]
+    weights[i], weights[j] = weights[j], weights[i]
+  }
+  numPer := n / fold
+  mod := n % fold
+  cv := 0.0
+  numRun := 0
+  var foldErr error
+  for i := 0; i < fold; i++ {
+    minBreakVal := 0
+    for j := 0; j < i; j++ {
+      minBreakVal += numPer
+      if j < mod {
+        minBreakVal++
+      }
+    }
+    maxBreakVal := 0
+    for j := 0; j < i + 1; j++ {
+      maxBreakVal += numPer
+      if j < mod {
+        maxBreakVal++
+      }
+    }
+    num := maxBreakVal - minBreakVal
+    trainLabels := make([]int, n - num)
+    trainWeights := make([]float64, n - num)
+    trainData := make([][]float64, n - num)
+    testLabels := make([]int, num)
+    testWeights := make([]float64, num)
+    testData := make([][]float64, num)
+    for j := 0; j < n; j++ {
+      if j < minBreakVal {
+        trainData[j] = data[j]
+        trainLabels[j] = labels[j]
+        trainWeights[j] = weights[j]
+      } else if j < maxBreakVal {
+        testData[j - minBreakVal] = data[j]
+        testLabels[j - minBreakVal] = labels[j]
+        testWeights[j - minBreakVal] = weights[j]
+      } else {
+        trainData[j - num] = data[j]
+        trainLabels[j - num] = labels[j]
+        trainWeights[j - num] = weights[j]
+      }
+    }
+    betaStart := make([][]float64, numClasses)
+    for k := range betaStart {
+      betaStart[k] = make([]float64, p)
+    }
+    betas, _, err := Learn(ctx, trainData, trainLabels, trainWeights, lambda, betaStart, 100)
+    if err != nil {
+      if ctx.Err() != nil {
+        return 0.0, ctx.Err()
+      }
+      logging.Warnf(ctx, "CV error: %v", err)
+      foldErr = err
+      continue
+    }
+    numRun++
+    cv += RMSE(betas, testData, testLabels, testWeights)
+  }
+  if numRun == 0 {
+    return 0.0, fmt.Errorf("Cross-validation failed on every fold: %w", foldErr)
+  }
+  cv /= float64(numRun)
+  return cv, nil
+}
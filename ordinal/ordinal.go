@@ -0,0 +1,313 @@
+package ordinal
+
+import (
+  "github.com/aotimme/cloudml/glm"
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "fmt"
+  "math"
+  "math/rand"
+  "github.com/skelterjohn/go.matrix"
+)
+
+func dot(vec1, vec2 []float64) (val float64) {
+  for i, v := range vec1 {
+    val += v * vec2[i]
+  }
+  return
+}
+
+func expit(val float64) float64 {
+  return 1.0 / (1.0 + math.Exp(-val))
+}
+
+// Predict returns the cumulative probability P(Y <= k) and the probability
+// P(Y = k) of every level k under the proportional-odds model
+// logit P(Y <= k) = theta[k] - x·beta - offset.
+func Predict(theta []float64, beta []float64, covariates []float64, offset float64) ([]float64, []float64) {
+  eta := dot(beta, covariates) + offset
+  K := len(theta) + 1
+  cumulative := make([]float64, K)
+  probs := make([]float64, K)
+  prev := 0.0
+  for k := 0; k < K; k++ {
+    if k < K - 1 {
+      cumulative[k] = expit(theta[k] - eta)
+    } else {
+      cumulative[k] = 1.0
+    }
+    probs[k] = cumulative[k] - prev
+    prev = cumulative[k]
+  }
+  return cumulative, probs
+}
+
+func increasing(theta []float64) bool {
+  for k := 1; k < len(theta); k++ {
+    if theta[k] <= theta[k - 1] {
+      return false
+    }
+  }
+  return true
+}
+
+// StartThresholds returns the thresholds of the model without covariates,
+// i.e. the logits of the cumulative (weighted) level proportions.
+func StartThresholds(labels []int, weights []float64, numLevels int) []float64 {
+  counts := make([]float64, numLevels)
+  total := 0.0
+  for i, label := range labels {
+    counts[label] += weights[i]
+    total += weights[i]
+  }
+  theta := make([]float64, numLevels - 1)
+  cumulative := 0.0
+  for k := range theta {
+    cumulative += counts[k]
+    prop := (cumulative + 0.5) / (total + 1.0)
+    theta[k] = math.Log(prop / (1.0 - prop))
+    if k > 0 && theta[k] <= theta[k - 1] {
+      theta[k] = theta[k - 1] + 1e-3
+    }
+  }
+  return theta
+}
+
+// levelTerms returns F(upper), F(lower) and their first and second
+// derivatives for a datum at level k with linear predictor eta.
+func levelTerms(theta []float64, k int, eta float64) (Fa, fa, dfa, Fb, fb, dfb float64) {
+  Fa = 1.0
+  if k < len(theta) {
+    Fa = expit(theta[k] - eta)
+    fa = Fa * (1.0 - Fa)
+    dfa = fa * (1.0 - 2.0 * Fa)
+  }
+  if k > 0 {
+    Fb = expit(theta[k - 1] - eta)
+    fb = Fb * (1.0 - Fb)
+    dfb = fb * (1.0 - 2.0 * Fb)
+  }
+  return
+}
+
+func objective(theta []float64, beta []float64, data [][]float64, labels []int, weights []float64, offsets []float64, lambda float64) float64 {
+  obj := -0.5 * lambda * dot(beta, beta)
+  for i, x := range data {
+    Fa, _, _, Fb, _, _ := levelTerms(theta, labels[i], dot(beta, x) + offsets[i])
+    obj += weights[i] * math.Log(math.Max(Fa - Fb, 1e-300))
+  }
+  return obj
+}
+
+// Learn fits the thresholds and coefficients by Newton-Raphson on the
+// (weighted, ridge-penalized) log likelihood, halving steps that would
+// decrease it or leave the thresholds out of order. labels are level indices.
+// It also returns the number of iterations run. Once ctx is done it stops
+// with ctx.Err(). Without a penalty it needs more data than parameters.
+func Learn(ctx context.Context, data [][]float64, labels []int, weights []float64, offsets []float64, lambda float64, thetaStart []float64, betaStart []float64, iterations int) ([]float64, []float64, int, error) {
+  n := len(data)
+  K := len(thetaStart) + 1
+  p := len(betaStart)
+  q := K - 1 + p
+  theta := make([]float64, K - 1)
+  copy(theta, thetaStart)
+  beta := make([]float64, p)
+  copy(beta, betaStart)
+  if !increasing(theta) {
+    theta = StartThresholds(labels, weights, K)
+  }
+  if q >= n && lambda == 0 {
+    return nil, nil, 0, glm.ErrTooFewData
+  }
+  obj := objective(theta, beta, data, labels, weights, offsets, lambda)
+  iter := 0
+  for {
+    if ctx.Err() != nil {
+      return nil, nil, iter, ctx.Err()
+    }
+    iter++
+    gradient := matrix.Zeros(q, 1)
+    hessian := matrix.Zeros(q, q)
+    for j := 0; j < p; j++ {
+      gradient.Set(K - 1 + j, 0, -lambda * beta[j])
+      hessian.Set(K - 1 + j, K - 1 + j, lambda)
+    }
+    dP := make([]float64, q)
+    d2P := make([][]float64, q)
+    for a := range d2P {
+      d2P[a] = make([]float64, q)
+    }
+    for i, x := range data {
+      k := labels[i]
+      Fa, fa, dfa, Fb, fb, dfb := levelTerms(theta, k, dot(beta, x) + offsets[i])
+      P := math.Max(Fa - Fb, 1e-300)
+      for a := range dP {
+        dP[a] = 0.0
+        for b := range d2P[a] {
+          d2P[a][b] = 0.0
+        }
+      }
+      if k < K - 1 {
+        dP[k] = fa
+        d2P[k][k] = dfa
+        for j := 0; j < p; j++ {
+          d2P[k][K - 1 + j] = -dfa * x[j]
+          d2P[K - 1 + j][k] = -dfa * x[j]
+        }
+      }
+      if k > 0 {
+        dP[k - 1] = -fb
+        d2P[k - 1][k - 1] = -dfb
+        for j := 0; j < p; j++ {
+          d2P[k - 1][K - 1 + j] = dfb * x[j]
+          d2P[K - 1 + j][k - 1] = dfb * x[j]
+        }
+      }
+      for j := 0; j < p; j++ {
+        dP[K - 1 + j] = -(fa - fb) * x[j]
+        for l := 0; l < p; l++ {
+          d2P[K - 1 + j][K - 1 + l] = (dfa - dfb) * x[j] * x[l]
+        }
+      }
+      // the (negative) hessian of log P is dP dPᵀ / P² - d²P / P
+      for a := 0; a < q; a++ {
+        gradient.Set(a, 0, gradient.Get(a, 0) + weights[i] * dP[a] / P)
+        for b := 0; b < q; b++ {
+          hessian.Set(a, b, hessian.Get(a, b) + weights[i] * (dP[a] * dP[b] / (P * P) - d2P[a][b] / P))
+        }
+      }
+    }
+    hessInv, err := hessian.Inverse()
+    if err != nil {
+      return nil, nil, iter, err
+    }
+    diff, err := hessInv.TimesDense(gradient)
+    if err != nil {
+      return nil, nil, iter, err
+    }
+    step := 1.0
+    newTheta := make([]float64, K - 1)
+    newBeta := make([]float64, p)
+    for halvings := 0; ; halvings++ {
+      for k := range newTheta {
+        newTheta[k] = theta[k] + step * diff.Get(k, 0)
+      }
+      for j := range newBeta {
+        newBeta[j] = beta[j] + step * diff.Get(K - 1 + j, 0)
+      }
+      if increasing(newTheta) {
+        newObj := objective(newTheta, newBeta, data, labels, weights, offsets, lambda)
+        if newObj >= obj || halvings >= 30 {
+          obj = newObj
+          break
+        }
+      }
+      step /= 2.0
+    }
+    theta, beta = newTheta, newBeta
+    if step * diff.TwoNorm() < 1e-6 {
+      logging.Debugf(ctx, "Converged after %v iterations", iter)
+      break
+    }
+    if iter >= iterations {
+      logging.Warnf(ctx, "Did not converge after %v iterations", iter)
+      break
+    }
+  }
+  return theta, beta, iter, nil
+}
+
+// RMSE is the weighted root mean squared error between the expected level
+// and the observed level.
+func RMSE(theta []float64, beta []float64, data [][]float64, labels []int, weights []float64, offsets []float64, levels []float64) float64 {
+  rmse := 0.0
+  sumWeights := 0.0
+  for i, datum := range data {
+    _, probs := Predict(theta, beta, datum, offsets[i])
+    expected := dot(probs, levels)
+    rmse += weights[i] * math.Pow(levels[labels[i]] - expected, 2.0)
+    sumWeights += weights[i]
+  }
+  rmse /= sumWeights
+  return math.Sqrt(rmse)
+}
+
+func CV(ctx context.Context, data [][]float64, labels []int, weights []float64, offsets []float64, levels []float64, lambda float64) (float64, error) {
+  fold := 5
+  n := len(data)
+  p := len(data[0])
+  // NOTE: stop if p > fold*n
+  perm := rand.Perm(n)
+  for i, j := range perm {
+    data[i], data[j] = data[j], data[i]
+    labels[i], labels[j] = labels[j], labels[i]
+    weights[i], weights[j] = weights[j], weights[i]
+    offsets[i], offsets[j] = offsets[j], offsets[i]
+  }
+  numPer := n / fold
+  mod := n % fold
+  cv := 0.0
+  numRun := 0
+  var foldErr error
+  for i := 0; i < fold; i++ {
+    minBreakVal := 0
+    for j := 0; j < i; j++ {
+      minBreakVal += numPer
+      if j < mod {
+        minBreakVal++
+      }
+    }
+    maxBreakVal := 0
+    for j := 0; j < i + 1; j++ {
+      maxBreakVal += numPer
+      if j < mod {
+        maxBreakVal++
+      }
+    }
+    num := maxBreakVal - minBreakVal
+    trainLabels := make([]int, n - num)
+    trainWeights := make([]float64, n - num)
+    trainOffsets := make([]float64, n - num)
+    trainData := make([][]float64, n - num)
+    testLabels := make([]int, num)
+    testWeights := make([]float64, num)
+    testOffsets := make([]float64, num)
+    testData := make([][]float64, num)
+    for j := 0; j < n; j++ {
+      if j < minBreakVal {
+        trainData[j] = data[j]
+        trainLabels[j] = labels[j]
+        trainWeights[j] = weights[j]
+        trainOffsets[j] = offsets[j]
+      } else if j < maxBreakVal {
+        testData[j - minBreakVal] = data[j]
+        testLabels[j - minBreakVal] = labels[j]
+        testWeights[j - minBreakVal] = weights[j]
+        testOffsets[j - minBreakVal] = offsets[j]
+      } else {
+        trainData[j - num] = data[j]
+        trainLabels[j - num] = labels[j]
+        trainWeights[j - num] = weights[j]
+        trainOffsets[j - num] = offsets[j]
+      }
+    }
+    thetaStart := make([]float64, len(levels) - 1)
+    betaStart := make([]float64, p)
+    theta, beta, _, err := Learn(ctx, trainData, trainLabels, trainWeights, trainOffsets, lambda, thetaStart, betaStart, 100)
+    if err != nil {
+      if ctx.Err() != nil {
+        return 0.0, ctx.Err()
+      }
+      logging.Warnf(ctx, "CV error: %v", err)
+      foldErr = err
+      continue
+    }
+    numRun++
+    cv += RMSE(theta, beta, testData, testLabels, testWeights, testOffsets, levels)
+  }
+  if numRun == 0 {
+    return 0.0, fmt.Errorf("Cross-validation failed on every fold: %w", foldErr)
+  }
+  cv /= float64(numRun)
+  return cv, nil
+}
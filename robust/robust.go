@@ -0,0 +1,272 @@
+package robust
+
+import (
+  "github.com/aotimme/cloudml/glm"
+  "github.com/aotimme/cloudml/logging"
+  "context"
+  "fmt"
+  "math"
+  "math/rand"
+  "sort"
+  "github.com/skelterjohn/go.matrix"
+)
+
+// DefaultHuberK is the usual Huber tuning constant, in units of the robust
+// residual scale. It gives 95% efficiency for normal errors.
+const DefaultHuberK = 1.345
+
+func dot(vec1, vec2 []float64) (val float64) {
+  for i, v := range vec1 {
+    val += v * vec2[i]
+  }
+  return
+}
+
+func Predict(beta []float64, covariates []float64, offset float64) float64 {
+  return dot(beta, covariates) + offset
+}
+
+func residuals(beta []float64, data [][]float64, values []float64, offsets []float64) []float64 {
+  r := make([]float64, len(data))
+  for i, datum := range data {
+    r[i] = values[i] - Predict(beta, datum, offsets[i])
+  }
+  return r
+}
+
+// mad is the median absolute deviation of the residuals, scaled to estimate
+// the standard deviation of normal errors.
+func mad(r []float64) float64 {
+  abs := make([]float64, len(r))
+  for i, v := range r {
+    abs[i] = math.Abs(v)
+  }
+  sort.Float64s(abs)
+  n := len(abs)
+  median := abs[n / 2]
+  if n % 2 == 0 {
+    median = (abs[n / 2 - 1] + abs[n / 2]) / 2.0
+  }
+  return median / 0.6745
+}
+
+// irls repeatedly solves ridge-penalized weighted least squares of
+// values - offsets on data, with each datum's weight multiplied by
+// reweight(residuals). The first iteration is ordinary (weighted) least
+// squares. It also returns the number of iterations run. Once ctx is done it
+// stops with ctx.Err().
+func irls(ctx context.Context, data [][]float64, values []float64, weights []float64, offsets []float64, lambda float64, betaStart []float64, iterations int, reweight func([]float64) []float64) ([]float64, int, error) {
+  n := len(data)
+  p := len(betaStart)
+  beta := make([]float64, p)
+  copy(beta, betaStart)
+  if p >= n && lambda == 0 {
+    return nil, 0, glm.ErrTooFewData
+  }
+  rw := make([]float64, n)
+  for i := range rw {
+    rw[i] = 1.0
+  }
+  iter := 0
+  for {
+    if ctx.Err() != nil {
+      return nil, iter, ctx.Err()
+    }
+    iter++
+    XtWX := matrix.Eye(p)
+    XtWX.Scale(lambda)
+    XtWY := matrix.Zeros(p, 1)
+    for i, x := range data {
+      w := weights[i] * rw[i]
+      y := values[i] - offsets[i]
+      for j := 0; j < p; j++ {
+        XtWY.Set(j, 0, XtWY.Get(j, 0) + w * x[j] * y)
+        for k := 0; k < p; k++ {
+          XtWX.Set(j, k, XtWX.Get(j, k) + w * x[j] * x[k])
+        }
+      }
+    }
+    XtWXInv, err := XtWX.Inverse()
+    if err != nil {
+      return nil, iter, err
+    }
+    newBeta, err := XtWXInv.TimesDense(XtWY)
+    if err != nil {
+      return nil, iter, err
+    }
+    diff := 0.0
+    for j := 0; j < p; j++ {
+      diff += math.Pow(newBeta.Get(j, 0) - beta[j], 2.0)
+      beta[j] = newBeta.Get(j, 0)
+    }
+    if iter > 1 && math.Sqrt(diff) < 1e-6 {
+      logging.Debugf(ctx, "Converged after %v iterations", iter)
+      break
+    }
+    if iter >= iterations {
+      logging.Warnf(ctx, "Did not converge after %v iterations", iter)
+      break
+    }
+    rw = reweight(residuals(beta, data, values, offsets))
+  }
+  return beta, iter, nil
+}
+
+// Huber fits linear regression under the Huber loss with tuning constant k
+// (in units of the MAD scale of the residuals), by IRLS.
+func Huber(ctx context.Context, data [][]float64, values []float64, weights []float64, offsets []float64, lambda float64, k float64, betaStart []float64, iterations int) ([]float64, int, error) {
+  return irls(ctx, data, values, weights, offsets, lambda, betaStart, iterations, func(r []float64) []float64 {
+    scale := math.Max(mad(r), 1e-10)
+    rw := make([]float64, len(r))
+    for i, v := range r {
+      u := math.Abs(v) / scale
+      if u <= k {
+        rw[i] = 1.0
+      } else {
+        rw[i] = k / u
+      }
+    }
+    return rw
+  })
+}
+
+// Quantile fits the tau-th conditional quantile by minimizing the pinball
+// loss, using IRLS on a slightly smoothed absolute value.
+func Quantile(ctx context.Context, data [][]float64, values []float64, weights []float64, offsets []float64, lambda float64, tau float64, betaStart []float64, iterations int) ([]float64, int, error) {
+  return irls(ctx, data, values, weights, offsets, lambda, betaStart, iterations, func(r []float64) []float64 {
+    rw := make([]float64, len(r))
+    for i, v := range r {
+      if v >= 0.0 {
+        rw[i] = tau / math.Max(v, 1e-6)
+      } else {
+        rw[i] = (1.0 - tau) / math.Max(-v, 1e-6)
+      }
+    }
+    return rw
+  })
+}
+
+// RMSE is the weighted root mean squared error.
+func RMSE(beta []float64, data [][]float64, values []float64, weights []float64, offsets []float64) float64 {
+  rmse := 0.0
+  sumWeights := 0.0
+  for i, datum := range data {
+    rmse += weights[i] * math.Pow(values[i] - Predict(beta, datum, offsets[i]), 2.0)
+    sumWeights += weights[i]
+  }
+  rmse /= sumWeights
+  return math.Sqrt(rmse)
+}
+
+// Pinball is the weighted mean pinball (check) loss of the tau-th quantile.
+func Pinball(beta []float64, data [][]float64, values []float64, weights []float64, offsets []float64, tau float64) float64 {
+  loss := 0.0
+  sumWeights := 0.0
+  for i, datum := range data {
+    r := values[i] - Predict(beta, datum, offsets[i])
+    if r >= 0.0 {
+      loss += weights[i] * tau * r
+    } else {
+      loss -= weights[i] * (1.0 - tau) * r
+    }
+    sumWeights += weights[i]
+  }
+  return loss / sumWeights
+}
+
+func HuberCV(ctx context.Context, data [][]float64, values []float64, weights []float64, offsets []float64, lambda float64, k float64) (float64, error) {
+  learn := func(data [][]float64, values []float64, weights []float64, offsets []float64, betaStart []float64) ([]float64, error) {
+    beta, _, err := Huber(ctx, data, values, weights, offsets, lambda, k, betaStart, 100)
+    return beta, err
+  }
+  return cv(ctx, data, values, weights, offsets, learn, RMSE)
+}
+
+func QuantileCV(ctx context.Context, data [][]float64, values []float64, weights []float64, offsets []float64, lambda float64, tau float64) (float64, error) {
+  learn := func(data [][]float64, values []float64, weights []float64, offsets []float64, betaStart []float64) ([]float64, error) {
+    beta, _, err := Quantile(ctx, data, values, weights, offsets, lambda, tau, betaStart, 100)
+    return beta, err
+  }
+  score := func(beta []float64, data [][]float64, values []float64, weights []float64, offsets []float64) float64 {
+    return Pinball(beta, data, values, weights, offsets, tau)
+  }
+  return cv(ctx, data, values, weights, offsets, learn, score)
+}
+
+func cv(ctx context.Context, data [][]float64, values []float64, weights []float64, offsets []float64, learn func([][]float64, []float64, []float64, []float64, []float64) ([]float64, error), score func([]float64, [][]float64, []float64, []float64, []float64) float64) (float64, error) {
+  fold := 5
+  n := len(data)
+  p := len(data[0])
+  // NOTE: stop if p > fold*n
+  perm := rand.Perm(n)
+  for i, j := range perm {
+    data[i], data[j] = data[j], data[i]
+    values[i], values[j] = values[j], values[i]
+    weights[i], weights[j] = weights[j], weights[i]
+    offsets[i], offsets[j] = offsets[j], offsets[i]
+  }
+  numPer := n / fold
+  mod := n % fold
+  cv := 0.0
+  numRun := 0
+  var foldErr error
+  for i := 0; i < fold; i++ {
+    minBreakVal := 0
+    for j := 0; j < i; j++ {
+      minBreakVal += numPer
+      if j < mod {
+        minBreakVal++
+      }
+    }
+    maxBreakVal := 0
+    for j := 0; j < i + 1; j++ {
+      maxBreakVal += numPer
+      if j < mod {
+        maxBreakVal++
+      }
+    }
+    num := maxBreakVal - minBreakVal
+    trainValues := make([]float64, n - num)
+    trainWeights := make([]float64, n - num)
+    trainOffsets := make([]float64, n - num)
+    trainData := make([][]float64, n - num)
+    testValues := make([]float64, num)
+    testWeights := make([]float64, num)
+    testOffsets := make([]float64, num)
+    testData := make([][]float64, num)
+    for j := 0; j < n; j++ {
+      if j < minBreakVal {
+        trainData[j] = data[j]
+        trainValues[j] = values[j]
+        trainWeights[j] = weights[j]
+        trainOffsets[j] = offsets[j]
+      } else if j < maxBreakVal {
+        testData[j - minBreakVal] = data[j]
+        testValues[j - minBreakVal] = values[j]
+        testWeights[j - minBreakVal] = weights[j]
+        testOffsets[j - minBreakVal] = offsets[j]
+      } else {
+        trainData[j - num] = data[j]
+        trainValues[j - num] = values[j]
+        trainWeights[j - num] = weights[j]
+        trainOffsets[j - num] = offsets[j]
+      }
+    }
+    betas, err := learn(trainData, trainValues, trainWeights, trainOffsets, make([]float64, p))
+    if err != nil {
+      if ctx.Err() != nil {
+        return 0.0, ctx.Err()
+      }
+      logging.Warnf(ctx, "CV error: %v", err)
+      foldErr = err
+      continue
+    }
+    numRun++
+    cv += score(betas, testData, testValues, testWeights, testOffsets)
+  }
+  if numRun == 0 {
+    return 0.0, fmt.Errorf("Cross-validation failed on every fold: %w", foldErr)
+  }
+  cv /= float64(numRun)
+  return cv, nil
+}
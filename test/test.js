@@ -1,5 +1,6 @@
 var should  = require('should');
-var request = require('request').defaults({jar: false});
+// the key of a tenant, as printed by `cloudml-server create-key`
+var request = require('request').defaults({jar: false, headers: {'X-API-Key': process.env.CLOUDML_API_KEY || ''}});
 var async   = require('async');
 var _       = require('underscore');
 var fs      = require('fs');